@@ -0,0 +1,27 @@
+package api
+
+// HealthStatus is the status of a health check.
+type HealthStatus string
+
+// Health statuses.
+const (
+	HealthStatusPass HealthStatus = "pass"
+	HealthStatusFail HealthStatus = "fail"
+)
+
+// HealthResponse is the response of the health routes (`/healthz` and `/readyz`).
+// The status fails if any check fails.
+type HealthResponse struct {
+	Status HealthStatus `json:"status"`
+	// Checks are the results of the checks, by name.
+	Checks map[string]HealthCheck `json:"checks,omitempty"`
+}
+
+// HealthCheck is the result of a health check.
+type HealthCheck struct {
+	Status HealthStatus `json:"status"`
+	// Duration is the time the check took, ex: `1.5ms`.
+	Duration string `json:"duration"`
+	// Error explains why the check failed.
+	Error string `json:"error,omitempty"`
+}
@@ -0,0 +1,165 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// ProblemContentType is the media type of error responses.
+const ProblemContentType = "application/problem+json"
+
+// RequestIDHeader is the header of the ID of the request, which correlates the logs and the responses.
+const RequestIDHeader = "X-Request-ID"
+
+// ProblemTypeBase is the base URI of the problem types. The type of a problem is this URI followed by `#` and its code.
+// The URI identifies the problem type and points to the documentation of the codes below.
+const ProblemTypeBase = "https://github.com/kicodelibrary/go-http-server-2024/blob/main/api/problem.go"
+
+// ErrorCode is a machine readable error code. Codes are stable: clients can rely on them, unlike on the title and detail.
+type ErrorCode string
+
+// Error codes.
+const (
+	// CodeUnsupportedMediaType is returned when the Content-Type of the request is not supported by the route.
+	CodeUnsupportedMediaType ErrorCode = "unsupported_media_type"
+	// CodeInvalidBody is returned when the request body cannot be read or decoded.
+	CodeInvalidBody ErrorCode = "invalid_body"
+	// CodeBodyTooLarge is returned when the request body is larger than the maximum size of the route.
+	CodeBodyTooLarge ErrorCode = "body_too_large"
+	// CodeInvalidQuery is returned when the query parameters are invalid.
+	CodeInvalidQuery ErrorCode = "invalid_query"
+	// CodeInvalidPageToken is returned when the page token is invalid, or was issued for another sort order.
+	CodeInvalidPageToken ErrorCode = "invalid_page_token"
+	// CodeInvalidPatch is returned when the patch cannot be applied to the user.
+	CodeInvalidPatch ErrorCode = "invalid_patch"
+	// CodeValidationFailed is returned when the user is invalid. The violations list the invalid fields.
+	CodeValidationFailed ErrorCode = "validation_failed"
+	// CodeIDMismatch is returned when the ID in the body does not match the ID in the path.
+	CodeIDMismatch ErrorCode = "id_mismatch"
+	// CodeIDImmutable is returned when a patch changes the ID of the user.
+	CodeIDImmutable ErrorCode = "id_immutable"
+	// CodeUserNotFound is returned when the user does not exist.
+	CodeUserNotFound ErrorCode = "user_not_found"
+	// CodeUserAlreadyExists is returned when creating a user with the ID of an existing user.
+	CodeUserAlreadyExists ErrorCode = "user_already_exists"
+	// CodeEmailAlreadyExists is returned when the email of the user is used by another user.
+	CodeEmailAlreadyExists ErrorCode = "email_already_exists"
+	// CodePreconditionFailed is returned when the If-Match header does not match the user.
+	CodePreconditionFailed ErrorCode = "precondition_failed"
+	// CodeConflict is returned when the user was modified concurrently. The request can be retried.
+	CodeConflict ErrorCode = "conflict"
+	// CodeUnauthorized is returned when the request has no valid credentials.
+	CodeUnauthorized ErrorCode = "unauthorized"
+	// CodeForbidden is returned when the credentials are valid, but do not allow the request.
+	CodeForbidden ErrorCode = "forbidden"
+	// CodeRateLimited is returned when the client sent too many requests. The Retry-After header is the number of
+	// seconds to wait before retrying.
+	CodeRateLimited ErrorCode = "rate_limited"
+	// CodeInternal is returned for errors of the server. Details are not disclosed to the client.
+	CodeInternal ErrorCode = "internal"
+)
+
+// titles are the human readable summaries of the error codes.
+var titles = map[ErrorCode]string{
+	CodeUnsupportedMediaType: "Unsupported media type",
+	CodeInvalidBody:          "Invalid request body",
+	CodeBodyTooLarge:         "Request body too large",
+	CodeInvalidQuery:         "Invalid query parameters",
+	CodeInvalidPageToken:     "Invalid page token",
+	CodeInvalidPatch:         "Invalid patch",
+	CodeValidationFailed:     "Validation failed",
+	CodeIDMismatch:           "ID mismatch",
+	CodeIDImmutable:          "ID cannot be changed",
+	CodeUserNotFound:         "User not found",
+	CodeUserAlreadyExists:    "User already exists",
+	CodeEmailAlreadyExists:   "Email already exists",
+	CodePreconditionFailed:   "Precondition failed",
+	CodeConflict:             "Conflict",
+	CodeUnauthorized:         "Unauthorized",
+	CodeForbidden:            "Forbidden",
+	CodeRateLimited:          "Rate limit exceeded",
+	CodeInternal:             "Internal error",
+}
+
+// Title returns the human readable summary of the code.
+func (c ErrorCode) Title() string {
+	if title, ok := titles[c]; ok {
+		return title
+	}
+	return strings.ReplaceAll(string(c), "_", " ")
+}
+
+// Violation is an invalid field.
+type Violation struct {
+	// Field is the path of the field in the JSON document, ex: `id`.
+	Field string `json:"field"`
+	// Message explains why the value is invalid.
+	Message string `json:"message"`
+}
+
+// Problem is an error response, as defined by RFC 7807 (problem details for HTTP APIs).
+type Problem struct {
+	// Type is a URI that identifies the problem type.
+	Type string `json:"type"`
+	// Title is a short, human readable summary of the problem type.
+	Title string `json:"title"`
+	// Status is the HTTP status code.
+	Status int `json:"status"`
+	// Detail is a human readable explanation of this occurrence of the problem.
+	Detail string `json:"detail,omitempty"`
+	// Code is the machine readable error code (extension member).
+	Code ErrorCode `json:"code"`
+	// Violations are the invalid fields, if any (extension member).
+	Violations []Violation `json:"violations,omitempty"`
+	// RequestID is the ID of the request, to find its logs (extension member).
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// NewProblem creates a new problem.
+func NewProblem(status int, code ErrorCode, detail string) *Problem {
+	return &Problem{
+		Type:   ProblemTypeBase + "#" + string(code),
+		Title:  code.Title(),
+		Status: status,
+		Detail: detail,
+		Code:   code,
+	}
+}
+
+// Error implements error.
+func (p *Problem) Error() string {
+	if p.Detail == "" {
+		return p.Title
+	}
+	return p.Title + ": " + p.Detail
+}
+
+// Write writes the problem as the response.
+// If the request ID is not set, it is taken from the response header (see RequestIDHeader).
+func (p *Problem) Write(w http.ResponseWriter) {
+	if p.RequestID == "" {
+		p.RequestID = w.Header().Get(RequestIDHeader)
+	}
+	b, err := json.Marshal(p)
+	if err != nil {
+		panic(err) // There should be no error here.
+	}
+	w.Header().Set("Content-Type", ProblemContentType)
+	w.WriteHeader(p.Status)
+	w.Write(b)
+}
+
+// ValidationError is returned when validation fails. It lists all the invalid fields.
+type ValidationError struct {
+	Violations []Violation
+}
+
+// Error implements error.
+func (e *ValidationError) Error() string {
+	msgs := make([]string, 0, len(e.Violations))
+	for _, v := range e.Violations {
+		msgs = append(msgs, v.Field+": "+v.Message)
+	}
+	return "invalid user: " + strings.Join(msgs, ", ")
+}
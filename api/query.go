@@ -0,0 +1,193 @@
+package api
+
+import (
+	"cmp"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Page sizes for listing users.
+const (
+	DefaultPageSize = 100
+	MaxPageSize     = 1000
+)
+
+// UserFilter selects users. Empty fields do not filter.
+type UserFilter struct {
+	AgeGTE, AgeGT, AgeLTE, AgeLT *int
+	NamePrefix                   string
+}
+
+// Match returns true if the user matches all the conditions of the filter.
+func (f UserFilter) Match(u User) bool {
+	switch {
+	case f.AgeGTE != nil && u.Age < *f.AgeGTE,
+		f.AgeGT != nil && u.Age <= *f.AgeGT,
+		f.AgeLTE != nil && u.Age > *f.AgeLTE,
+		f.AgeLT != nil && u.Age >= *f.AgeLT,
+		!strings.HasPrefix(u.Name, f.NamePrefix):
+		return false
+	}
+	return true
+}
+
+// Fields that users can be sorted by.
+const (
+	SortByID   = "id"
+	SortByName = "name"
+	SortByAge  = "age"
+)
+
+// UserSortField is a field to sort users by.
+type UserSortField struct {
+	Field string
+	Desc  bool
+}
+
+// UserSort is the sort order of users. The first field has the highest priority.
+// Users are always finally sorted by ID, so that the order is total and stable across pages.
+type UserSort []UserSortField
+
+// String returns the sort order in the format of the `sort` query parameter, ex: `-age,name`.
+func (s UserSort) String() string {
+	fields := make([]string, 0, len(s))
+	for _, f := range s {
+		if f.Desc {
+			fields = append(fields, "-"+f.Field)
+		} else {
+			fields = append(fields, f.Field)
+		}
+	}
+	return strings.Join(fields, ",")
+}
+
+// Compare returns a negative number if a sorts before b, a positive number if a sorts after b and zero if they are equal.
+func (s UserSort) Compare(a, b User) int {
+	for _, f := range s {
+		var c int
+		switch f.Field {
+		case SortByID:
+			c = strings.Compare(a.ID, b.ID)
+		case SortByName:
+			c = strings.Compare(a.Name, b.Name)
+		case SortByAge:
+			c = cmp.Compare(a.Age, b.Age)
+		}
+		if f.Desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return strings.Compare(a.ID, b.ID)
+}
+
+// IsDefault returns true if the sort order is by ascending ID.
+func (s UserSort) IsDefault() bool {
+	return len(s) == 0 || s[0] == UserSortField{Field: SortByID}
+}
+
+// ListUsersOptions are the options to list users.
+type ListUsersOptions struct {
+	Filter UserFilter
+	// Sort is the sort order. Empty means by ID.
+	Sort UserSort
+	// Limit is the maximum number of users to return. Zero means no limit.
+	Limit int
+	// After only lists users that sort after this user (the last user of the previous page). Nil means from the start.
+	// Only the fields used for sorting need to be set.
+	After *User
+}
+
+// Apply filters and sorts the users and returns the page selected by the options.
+// It is meant for databases that list users in memory. The given slice is modified.
+func (o ListUsersOptions) Apply(users []User) []User {
+	ret := users[:0]
+	for _, user := range users {
+		if !o.Filter.Match(user) {
+			continue
+		}
+		if o.After != nil && o.Sort.Compare(user, *o.After) <= 0 {
+			continue
+		}
+		ret = append(ret, user)
+	}
+	sort.Slice(ret, func(i, j int) bool { return o.Sort.Compare(ret[i], ret[j]) < 0 })
+	if o.Limit > 0 && len(ret) > o.Limit {
+		ret = ret[:o.Limit]
+	}
+	return ret
+}
+
+// ParseListUsersOptions parses the query parameters of the list users route. The parameters are:
+//   - `limit`: the maximum number of users to return (default DefaultPageSize, max MaxPageSize).
+//   - `age_gte`, `age_gt`, `age_lte`, `age_lt`: filter by age.
+//   - `name_prefix`: filter by the start of the name.
+//   - `sort`: comma separated fields to sort by, ex: `-age,name`. A `-` prefix sorts in descending order.
+//
+// The cursor (After) is not parsed, since it is opaque to clients.
+func ParseListUsersOptions(query url.Values) (ListUsersOptions, error) {
+	opts := ListUsersOptions{
+		Limit: DefaultPageSize,
+	}
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > MaxPageSize {
+			return ListUsersOptions{}, fmt.Errorf("limit must be between 1 and %d", MaxPageSize)
+		}
+		opts.Limit = limit
+	}
+
+	for _, p := range []struct {
+		Name  string
+		Value **int
+	}{
+		{Name: "age_gte", Value: &opts.Filter.AgeGTE},
+		{Name: "age_gt", Value: &opts.Filter.AgeGT},
+		{Name: "age_lte", Value: &opts.Filter.AgeLTE},
+		{Name: "age_lt", Value: &opts.Filter.AgeLT},
+	} {
+		v := query.Get(p.Name)
+		if v == "" {
+			continue
+		}
+		age, err := strconv.Atoi(v)
+		if err != nil {
+			return ListUsersOptions{}, fmt.Errorf("%s must be an integer", p.Name)
+		}
+		*p.Value = &age
+	}
+	opts.Filter.NamePrefix = query.Get("name_prefix")
+
+	if v := query.Get("sort"); v != "" {
+		seen := make(map[string]bool)
+		for _, field := range strings.Split(v, ",") {
+			f := UserSortField{
+				Field: strings.TrimPrefix(field, "-"),
+				Desc:  strings.HasPrefix(field, "-"),
+			}
+			switch f.Field {
+			case SortByID, SortByName, SortByAge:
+			default:
+				return ListUsersOptions{}, fmt.Errorf("cannot sort by %q, supported fields: id, name, age", f.Field)
+			}
+			if seen[f.Field] {
+				return ListUsersOptions{}, fmt.Errorf("cannot sort by %q more than once", f.Field)
+			}
+			seen[f.Field] = true
+			opts.Sort = append(opts.Sort, f)
+		}
+	}
+	return opts, nil
+}
+
+// ListUsersResponse is a page of users.
+type ListUsersResponse struct {
+	Users []User `json:"users"`
+	// NextPageToken is the `page_token` for the next page. It is empty on the last page.
+	NextPageToken string `json:"next_page_token,omitempty"`
+}
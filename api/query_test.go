@@ -0,0 +1,106 @@
+package api
+
+import (
+	"math"
+	"net/url"
+	"testing"
+
+	"github.com/smarty/assertions"
+)
+
+func TestParseListUsersOptions(t *testing.T) {
+	a := assertions.New(t)
+	age := func(i int) *int { return &i }
+
+	for _, test := range []struct {
+		Name     string
+		Query    string
+		Expected ListUsersOptions
+		Error    bool
+	}{
+		{
+			Name:     "Default",
+			Query:    "",
+			Expected: ListUsersOptions{Limit: DefaultPageSize},
+		},
+		{
+			Name:  "All",
+			Query: "limit=10&age_gte=18&age_lt=65&name_prefix=Al&sort=-age,name",
+			Expected: ListUsersOptions{
+				Limit: 10,
+				Filter: UserFilter{
+					AgeGTE:     age(18),
+					AgeLT:      age(65),
+					NamePrefix: "Al",
+				},
+				Sort: UserSort{
+					{Field: SortByAge, Desc: true},
+					{Field: SortByName},
+				},
+			},
+		},
+		{
+			Name:  "InvalidLimit",
+			Query: "limit=0",
+			Error: true,
+		},
+		{
+			Name:  "InvalidAge",
+			Query: "age_gt=old",
+			Error: true,
+		},
+		{
+			Name:  "InvalidSortField",
+			Query: "sort=email",
+			Error: true,
+		},
+		{
+			Name:  "DuplicateSortField",
+			Query: "sort=age,-age",
+			Error: true,
+		},
+	} {
+		t.Run(test.Name, func(t *testing.T) {
+			query, err := url.ParseQuery(test.Query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts, err := ParseListUsersOptions(query)
+			if test.Error {
+				a.So(err, assertions.ShouldNotBeNil)
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			a.So(opts, assertions.ShouldResemble, test.Expected)
+		})
+	}
+}
+
+func TestUserSort(t *testing.T) {
+	a := assertions.New(t)
+	sort := UserSort{
+		{Field: SortByAge, Desc: true},
+		{Field: SortByName},
+	}
+	a.So(sort.String(), assertions.ShouldEqual, "-age,name")
+
+	alice := User{ID: "alice", Name: "Alice", Age: 30}
+	bob := User{ID: "bob", Name: "Bob", Age: 30}
+	charlie := User{ID: "charlie", Name: "Charlie", Age: 40}
+	a.So(sort.Compare(charlie, alice), assertions.ShouldBeLessThan, 0)
+	a.So(sort.Compare(alice, bob), assertions.ShouldBeLessThan, 0)
+	a.So(sort.Compare(bob, alice), assertions.ShouldBeGreaterThan, 0)
+
+	// The ID breaks ties.
+	clone := User{ID: "alice2", Name: "Alice", Age: 30}
+	a.So(sort.Compare(alice, clone), assertions.ShouldBeLessThan, 0)
+	a.So(sort.Compare(alice, alice), assertions.ShouldEqual, 0)
+
+	// The ages do not overflow.
+	young := User{ID: "young", Age: math.MinInt}
+	old := User{ID: "old", Age: math.MaxInt}
+	a.So(UserSort{{Field: SortByAge}}.Compare(young, old), assertions.ShouldBeLessThan, 0)
+	a.So(UserSort{{Field: SortByAge}}.Compare(old, young), assertions.ShouldBeGreaterThan, 0)
+}
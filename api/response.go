@@ -5,6 +5,8 @@ import "encoding/json"
 // Response is a response message.
 type Response struct {
 	Message string `json:"message"`
+	// ID is the ID of the created resource, if any.
+	ID string `json:"id,omitempty"`
 }
 
 // NewJSONResponse creates a new JSON response.
@@ -18,3 +20,16 @@ func NewJSONResponse(message string) []byte {
 	}
 	return b
 }
+
+// NewCreatedResponse creates a new JSON response for a created resource, with its ID.
+func NewCreatedResponse(message, id string) []byte {
+	r := Response{
+		Message: message,
+		ID:      id,
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		panic(err) // There should be no error here.
+	}
+	return b
+}
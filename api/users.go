@@ -4,14 +4,39 @@ package api
 
 import (
 	"fmt"
+	"net/mail"
 	"regexp"
+	"sort"
+	"time"
+)
+
+// UserStatus is the status of a user.
+type UserStatus string
+
+// User statuses.
+const (
+	UserStatusActive    UserStatus = "active"
+	UserStatusSuspended UserStatus = "suspended"
 )
 
 // User is a user.
 type User struct {
+	// ID is generated by the server if it is empty when the user is created.
 	ID   string `json:"id"`
 	Name string `json:"name"`
 	Age  int    `json:"age"`
+	// Email is optional. If set, it is unique among users. It is case insensitive and stored in lowercase.
+	Email string `json:"email,omitempty"`
+	// Status is active by default.
+	Status UserStatus `json:"status"`
+	// Labels are free-form key-value pairs.
+	Labels map[string]string `json:"labels,omitempty"`
+	// CreatedAt and UpdatedAt are set by the server. The values sent by clients are ignored.
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Version is incremented by the server on every change. It is used as the ETag of the user.
+	// Clients cannot set it; use the `If-Match` header for conditional requests instead.
+	Version uint64 `json:"version"`
 	// Extend this message as required.
 }
 
@@ -21,12 +46,80 @@ type User struct {
 // It should be at least 3 characters and max 32.
 var userIDRegexp = regexp.MustCompile(`^[a-z0-9]{3,32}$`)
 
+// Label keys are up to 63 lowercase letters, numbers, `-`, `_` and `.`, and start and end with a letter or number.
+var labelKeyRegexp = regexp.MustCompile(`^[a-z0-9]([a-z0-9._-]{0,61}[a-z0-9])?$`)
+
+// Limits of the fields.
+const (
+	MaxEmailLength      = 254
+	MaxLabels           = 64
+	MaxLabelValueLength = 256
+)
+
 // Validate validates a user based on the conditions.
+// If the user is invalid, the error is a *ValidationError that lists the invalid fields.
 func (u *User) Validate() error {
+	var violations []Violation
 	if !userIDRegexp.MatchString(u.ID) {
-		return fmt.Errorf("invalid user ID: %s", u.ID)
+		violations = append(violations, Violation{
+			Field:   "id",
+			Message: fmt.Sprintf("must be 3 to 32 lowercase letters or digits, got %q", u.ID),
+		})
+	}
+
+	if u.Email != "" {
+		// Only plain addresses are allowed, not `Name <address>`.
+		addr, err := mail.ParseAddress(u.Email)
+		switch {
+		case err != nil || addr.Address != u.Email:
+			violations = append(violations, Violation{Field: "email", Message: "must be a valid email address"})
+		case len(u.Email) > MaxEmailLength:
+			violations = append(violations, Violation{Field: "email", Message: fmt.Sprintf("must be at most %d characters", MaxEmailLength)})
+		}
 	}
 
-	// Ex: Add a validation for ages (ex: 18 - 100).
+	switch u.Status {
+	case "", UserStatusActive, UserStatusSuspended:
+	default:
+		violations = append(violations, Violation{
+			Field:   "status",
+			Message: fmt.Sprintf("must be %s or %s, got %q", UserStatusActive, UserStatusSuspended, u.Status),
+		})
+	}
+
+	if len(u.Labels) > MaxLabels {
+		violations = append(violations, Violation{Field: "labels", Message: fmt.Sprintf("must have at most %d labels", MaxLabels)})
+	}
+	for _, k := range sortedKeys(u.Labels) {
+		if !labelKeyRegexp.MatchString(k) {
+			violations = append(violations, Violation{
+				Field:   "labels." + k,
+				Message: "key must be 1 to 63 lowercase letters, digits, '-', '_' or '.', and start and end with a letter or digit",
+			})
+		}
+		if len(u.Labels[k]) > MaxLabelValueLength {
+			violations = append(violations, Violation{
+				Field:   "labels." + k,
+				Message: fmt.Sprintf("value must be at most %d characters", MaxLabelValueLength),
+			})
+		}
+	}
+
+	// Business rules, such as the age range, are configurable (see pkg/validation).
+	if len(violations) > 0 {
+		return &ValidationError{
+			Violations: violations,
+		}
+	}
 	return nil
 }
+
+// sortedKeys returns the keys of the map in order, so that violations are reported in a stable order.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -1,6 +1,11 @@
 package api
 
-import "testing"
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
 
 func TestUsers(t *testing.T) {
 	// Test validation using range testing.
@@ -49,3 +54,68 @@ func TestUsers(t *testing.T) {
 		})
 	}
 }
+
+func TestUsersFields(t *testing.T) {
+	for _, test := range []struct {
+		Name       string
+		User       User
+		Violations []Violation
+	}{
+		{
+			Name: "Valid",
+			User: User{
+				ID:     "abc123",
+				Email:  "abc@example.com",
+				Status: UserStatusSuspended,
+				Labels: map[string]string{"team": "blue", "a.b_c-d": ""},
+			},
+		},
+		{
+			Name: "DisplayName",
+			User: User{ID: "abc123", Email: "Abc <abc@example.com>"},
+			Violations: []Violation{
+				{Field: "email", Message: "must be a valid email address"},
+			},
+		},
+		{
+			Name: "InvalidStatus",
+			User: User{ID: "abc123", Status: "deleted"},
+			Violations: []Violation{
+				{Field: "status", Message: `must be active or suspended, got "deleted"`},
+			},
+		},
+		{
+			// All violations are reported, in a stable order.
+			Name: "Several",
+			User: User{
+				ID:     "a",
+				Email:  "abc",
+				Labels: map[string]string{"Team": "blue", "-x": strings.Repeat("x", MaxLabelValueLength+1)},
+			},
+			Violations: []Violation{
+				{Field: "id", Message: `must be 3 to 32 lowercase letters or digits, got "a"`},
+				{Field: "email", Message: "must be a valid email address"},
+				{Field: "labels.-x", Message: "key must be 1 to 63 lowercase letters, digits, '-', '_' or '.', and start and end with a letter or digit"},
+				{Field: "labels.-x", Message: "value must be at most 256 characters"},
+				{Field: "labels.Team", Message: "key must be 1 to 63 lowercase letters, digits, '-', '_' or '.', and start and end with a letter or digit"},
+			},
+		},
+	} {
+		t.Run(test.Name, func(t *testing.T) {
+			err := test.User.Validate()
+			if test.Violations == nil {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			var verr *ValidationError
+			if !errors.As(err, &verr) {
+				t.Fatalf("expected a validation error, got %v", err)
+			}
+			if !reflect.DeepEqual(verr.Violations, test.Violations) {
+				t.Errorf("unexpected violations: %+v", verr.Violations)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kicodelibrary/go-http-server-2024/pkg/auth/apikey"
+	"github.com/spf13/pflag"
+)
+
+// keysUsage is the usage of the keys command.
+const keysUsage = `Usage: server keys <command> [flags]
+Manage the API keys of the /users routes.
+
+Commands:
+  mint      Create a new API key, which is printed once
+  revoke    Revoke an API key by ID
+  list      List the API keys
+`
+
+// keysCommand runs the `keys` command with the arguments after `keys`, and writes its output to stdout.
+func keysCommand(args []string, stdout io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(keysUsage)
+	}
+	command, args := args[0], args[1:]
+
+	var (
+		path     string
+		name     string
+		readOnly bool
+		roles    []string
+		ttl      time.Duration
+	)
+	flags := pflag.NewFlagSet("keys "+command, pflag.ContinueOnError)
+	flags.SetOutput(stdout)
+	flags.StringVar(&path, "file", "keys.json", "Path to the API keys file")
+	switch command {
+	case "mint":
+		flags.StringVar(&name, "name", "", "Name of the key, ex: the client that uses it")
+		flags.BoolVar(&readOnly, "read-only", false, "Restrict the key to GET requests")
+		flags.StringSliceVar(&roles, "role", nil, "Role of the key in the authorization policy (repeatable)")
+		flags.DurationVar(&ttl, "ttl", 0, "Lifetime of the key (0 for no expiry)")
+	case "revoke", "list":
+	default:
+		return fmt.Errorf("unknown keys command %q\n\n%s", command, keysUsage)
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	keys, err := apikey.Open(path)
+	if err != nil {
+		return err
+	}
+	switch command {
+	case "mint":
+		key, secret, err := keys.Mint(apikey.MintOptions{Name: name, ReadOnly: readOnly, Roles: roles, TTL: ttl})
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "Created API key %s. Store it now, it cannot be shown again:\n%s\n", key.ID, secret)
+	case "revoke":
+		if flags.NArg() != 1 {
+			return errors.New("usage: server keys revoke [--file keys.json] <id>")
+		}
+		if err := keys.Revoke(flags.Arg(0)); err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "Revoked API key %s\n", flags.Arg(0))
+	case "list":
+		list, err := keys.List()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tREAD-ONLY\tROLES\tCREATED\tEXPIRES\tREVOKED")
+		for _, k := range list {
+			roles := "-"
+			if len(k.Roles) > 0 {
+				roles = strings.Join(k.Roles, ",")
+			}
+			fmt.Fprintf(w, "%s\t%s\t%t\t%s\t%s\t%s\t%s\n", k.ID, k.Name, k.ReadOnly, roles, k.CreatedAt.Format(time.RFC3339), formatTime(k.ExpiresAt), formatTime(k.RevokedAt))
+		}
+		return w.Flush()
+	}
+	return nil
+}
+
+// formatTime formats an optional time, with `-` if it is not set.
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/smarty/assertions"
+)
+
+func TestKeysCommand(t *testing.T) {
+	a := assertions.New(t)
+	path := filepath.Join(t.TempDir(), "keys.json")
+
+	// Mint a key.
+	var out bytes.Buffer
+	if err := keysCommand([]string{"mint", "--file", path, "--name", "ci", "--read-only", "--role", "reader", "--role", "auditor"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	a.So(lines, assertions.ShouldHaveLength, 2)
+	secret := lines[1]
+	a.So(secret, assertions.ShouldStartWith, "uk_")
+	id := strings.Split(secret, "_")[1]
+
+	// Revoke it.
+	out.Reset()
+	a.So(keysCommand([]string{"revoke", "--file", path, id}, &out), assertions.ShouldBeNil)
+	a.So(keysCommand([]string{"revoke", "--file", path, "unknown"}, &out), assertions.ShouldNotBeNil)
+	a.So(keysCommand([]string{"revoke", "--file", path}, &out), assertions.ShouldNotBeNil)
+
+	// List the keys, without the secret.
+	out.Reset()
+	if err := keysCommand([]string{"list", "--file", path}, &out); err != nil {
+		t.Fatal(err)
+	}
+	lines = strings.Split(strings.TrimSpace(out.String()), "\n")
+	a.So(lines, assertions.ShouldHaveLength, 2)
+	a.So(lines[1], assertions.ShouldStartWith, id)
+	a.So(lines[1], assertions.ShouldContainSubstring, "ci")
+	a.So(lines[1], assertions.ShouldContainSubstring, "reader,auditor")
+	a.So(out.String(), assertions.ShouldNotContainSubstring, secret)
+
+	// Unknown commands fail.
+	a.So(keysCommand(nil, &out), assertions.ShouldNotBeNil)
+	a.So(keysCommand([]string{"rotate"}, &out), assertions.ShouldNotBeNil)
+}
@@ -1,15 +1,39 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/kicodelibrary/go-http-server-2024/pkg/auth"
+	"github.com/kicodelibrary/go-http-server-2024/pkg/auth/apikey"
+	"github.com/kicodelibrary/go-http-server-2024/pkg/auth/jwt"
+	"github.com/kicodelibrary/go-http-server-2024/pkg/auth/mtls"
+	"github.com/kicodelibrary/go-http-server-2024/pkg/auth/rbac"
 	"github.com/kicodelibrary/go-http-server-2024/pkg/database"
+	"github.com/kicodelibrary/go-http-server-2024/pkg/ids"
+	"github.com/kicodelibrary/go-http-server-2024/pkg/logging"
+	"github.com/kicodelibrary/go-http-server-2024/pkg/metrics"
+	"github.com/kicodelibrary/go-http-server-2024/pkg/server/accesslog"
+	"github.com/kicodelibrary/go-http-server-2024/pkg/server/health"
+	"github.com/kicodelibrary/go-http-server-2024/pkg/server/ratelimit"
+	"github.com/kicodelibrary/go-http-server-2024/pkg/server/requestid"
+	"github.com/kicodelibrary/go-http-server-2024/pkg/server/route"
+	"github.com/kicodelibrary/go-http-server-2024/pkg/server/tlsconfig"
 	"github.com/kicodelibrary/go-http-server-2024/pkg/server/users"
+	"github.com/kicodelibrary/go-http-server-2024/pkg/validation"
 	"github.com/spf13/pflag"
 )
 
@@ -18,14 +42,120 @@ type Config struct {
 	Port, Host string
 	Timeout    time.Duration
 	Database   database.Config
+	// ValidationRules is the path to the validation rules of users. Empty means the default rules.
+	ValidationRules string
+	// IDFormat is the format of the IDs generated for users created without an ID (see ids.Format).
+	IDFormat string
+	// ClientIDs allows clients to choose the IDs of the users they create.
+	ClientIDs bool
+	// MaxBodySize is the maximum size of the request bodies of the /users routes, in bytes.
+	MaxBodySize int64
+	// ShutdownDelay is the time between the readiness route failing and the server closing its listener.
+	ShutdownDelay time.Duration
+	// ShutdownGracePeriod is the maximum time to wait for the requests in flight during the shutdown.
+	ShutdownGracePeriod time.Duration
+	// HealthTimeout is the maximum duration of each health check.
+	HealthTimeout time.Duration
+	// LogFormat is the format of the logs: text or json.
+	LogFormat string
+	// LogLevel is the minimum level of the logs: debug, info, warn or error.
+	LogLevel string
+	// AccessLogFormat is the format of the access log (see accesslog.Format). Empty or `none` disables it.
+	AccessLogFormat string
+	// AccessLogFile is the path of the access log. Empty means the standard output.
+	AccessLogFile string
+	// AccessLogMaxSize is the size in megabytes at which the access log file is rotated. Zero disables the rotation.
+	AccessLogMaxSize int64
+	// AccessLogMaxBackups is the number of rotated access log files that are kept.
+	AccessLogMaxBackups int
+	// AccessLogSample2xx is the fraction of the requests with a 2xx status that are logged.
+	AccessLogSample2xx float64
+	// APIKeysFile is the path of the API keys file (see the keys command). Empty disables the API keys.
+	// The /users routes are authenticated if there are API keys or JWTs.
+	APIKeysFile string
+	// JWKSFile is the path of the JSON Web Key Set that verifies the bearer JWTs. Empty disables the JWTs.
+	JWKSFile string
+	// JWTIssuer and JWTAudience are the required issuer and audience of the JWTs. Empty accepts any value.
+	JWTIssuer, JWTAudience string
+	// JWTClockSkew is the tolerance of the checks of the expiry of the JWTs.
+	JWTClockSkew time.Duration
+	// PolicyFile is the path of the role-based authorization policy (see rbac.Policy). Empty allows all the
+	// authenticated requests.
+	PolicyFile string
+	// RateLimitRead and RateLimitWrite are the limits of the read and the write requests of each client to the /users
+	// routes. A zero rate disables the limit.
+	RateLimitRead, RateLimitWrite ratelimit.Limit
+	// RateLimitIP is the limit of the read and the write requests of each IP address to the /users routes, before the
+	// authentication, so that it also limits the requests with invalid credentials. A zero rate disables the limit.
+	RateLimitIP ratelimit.Limit
+	// RateLimitIdleTimeout is the time after which the rate limit of an idle client is forgotten.
+	RateLimitIdleTimeout time.Duration
+	// RateLimitMaxClients is the maximum number of clients whose rate limits are tracked.
+	RateLimitMaxClients int
+	// TLS is the TLS configuration. The server serves cleartext HTTP if it has no certificate.
+	TLS tlsconfig.Config
 }
 
+// errShuttingDown fails the readiness check during the shutdown.
+var errShuttingDown = errors.New("the server is shutting down")
+
 var (
 	config = &Config{} // This holds the configuration.
 	flags  = pflag.NewFlagSet("server", pflag.ExitOnError)
 )
 
 func main() {
+	// The `keys` command manages the API keys, instead of running the server.
+	if len(os.Args) > 1 && os.Args[1] == "keys" {
+		if err := keysCommand(os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Parse the flags.
+	// This is important to actually read the values into config.
+	// Args[0] is always the name of the command.
+	if err := flags.Parse(os.Args[1:]); err != nil {
+		log.Fatalf("could not parse flags: %v", err)
+	}
+
+	// Create the logger. The standard logger (log.Printf) also writes to it.
+	logger, err := logging.New(os.Stderr, config.LogFormat, config.LogLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.SetDefault(logger)
+
+	// Stop on SIGINT (Ctrl+C) and SIGTERM (ex: sent by Kubernetes before it kills the container).
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	address := net.JoinHostPort(config.Host, config.Port)
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		logger.Error("could not listen", "address", address, "error", err)
+		os.Exit(1)
+	}
+	logger.Info("Start server", "address", address, "tls", config.TLS.Enabled())
+
+	// Run the server.
+	if err := run(ctx, stop, config, logger, listener); err != nil {
+		logger.Error("Server failed", "error", err)
+		os.Exit(1)
+	}
+}
+
+// run serves the requests on the listener until the context is done, and then shuts down gracefully:
+//
+//  1. The readiness route (`/readyz`, see the health package) fails, so that load balancers stop sending new requests.
+//  2. After the readiness delay, the server stops accepting connections and waits for the requests in flight,
+//     up to the grace period. The requests that are still running after the grace period are aborted.
+//  3. The database is closed.
+//
+// stop is called when the shutdown starts, so that a second signal kills the process right away.
+func run(ctx context.Context, stop func(), config *Config, logger *slog.Logger, listener net.Listener) error {
 	// Define the root router.
 	root := mux.NewRouter()
 
@@ -36,30 +166,212 @@ func main() {
 		fmt.Fprintln(w, "Hello World!")
 	}).Methods("GET")
 
+	// Log the requests.
+	var accessLogger *accesslog.Logger
+	if config.AccessLogFormat != "" && config.AccessLogFormat != "none" {
+		var w io.Writer = os.Stdout
+		if config.AccessLogFile != "" {
+			f, err := accesslog.OpenRotatingFile(config.AccessLogFile, config.AccessLogMaxSize<<20, config.AccessLogMaxBackups)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+		var err error
+		accessLogger, err = accesslog.New(w, accesslog.Format(config.AccessLogFormat), accesslog.WithSampling(config.AccessLogSample2xx))
+		if err != nil {
+			return err
+		}
+	}
+
+	// Record and expose the metrics of the routes.
+	m := metrics.New()
+	m.AddRoutes(root)
+
+	// Handle the health routes. The server is not ready during the shutdown.
+	registry := health.NewRegistry(health.WithTimeout(config.HealthTimeout))
+	registry.AddRoutes(root)
+	var shuttingDown atomic.Bool
+	registry.AddReadiness("shutdown", func(ctx context.Context) error {
+		if shuttingDown.Load() {
+			return errShuttingDown
+		}
+		return nil
+	})
+
 	// Handle the `/users` routes.
 	usersDB, err := config.Database.NewUsers()
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	if pinger, ok := usersDB.(database.Pinger); ok {
+		registry.AddReadiness("database", pinger.Ping)
+	}
+	// The database is closed last, after the requests that use it are done.
+	defer func() {
+		if err := usersDB.Close(); err != nil {
+			logger.Error("could not close database", "error", err)
+		}
+	}()
+	// inFlight tracks the running handlers. The server does not wait for them once the grace period is over, so they
+	// are waited for here, before the database is closed by the deferred function above.
+	var inFlight sync.WaitGroup
+	defer inFlight.Wait()
+	usersDB, err = m.Users(ctx, usersDB)
+	if err != nil {
+		return err
+	}
+	rules := validation.Default()
+	if config.ValidationRules != "" {
+		rules, err = validation.Load(config.ValidationRules)
+		if err != nil {
+			return err
+		}
+	}
+	idGenerator, err := ids.NewGenerator(ids.Format(config.IDFormat), nil, nil)
+	if err != nil {
+		return err
+	}
+	opts := []users.Option{
+		users.WithRules(rules),
+		users.WithIDGenerator(idGenerator.New),
+		users.WithClientIDs(config.ClientIDs),
+		users.WithMaxBodySize(config.MaxBodySize),
+		users.WithLogger(logger),
 	}
-	h := users.New(usersDB)
+	if config.PolicyFile != "" {
+		if config.APIKeysFile == "" && config.JWKSFile == "" && config.TLS.ClientCAFile == "" {
+			return errors.New("the authorization policy requires API keys, JWTs or client certificates")
+		}
+		policy, err := rbac.Load(config.PolicyFile)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, users.WithAuthorizer(policy))
+	}
+	h := users.New(usersDB, opts...)
 
 	// Create a subrouter for the `/users` prefix.
 	sub := root.PathPrefix("/users").Subrouter()
+	rateLimitOpts := []ratelimit.Option{
+		ratelimit.WithIdleTimeout(config.RateLimitIdleTimeout),
+		ratelimit.WithMaxClients(config.RateLimitMaxClients),
+	}
+	// The IP addresses are limited first, so that guessing credentials is limited.
+	ipLimiter := ratelimit.New(config.RateLimitIP, config.RateLimitIP, append(rateLimitOpts, ratelimit.WithClient(ratelimit.IP))...)
+	sub.Use(ipLimiter.Middleware)
+	var authenticators []auth.Authenticator
+	if config.TLS.ClientCAFile != "" {
+		// The client certificates are verified during the TLS handshake.
+		authenticators = append(authenticators, mtls.Authenticator{})
+	}
+	if config.APIKeysFile != "" {
+		keys, err := apikey.Open(config.APIKeysFile)
+		if err != nil {
+			return err
+		}
+		authenticators = append(authenticators, keys)
+	}
+	if config.JWKSFile != "" {
+		tokens, err := jwt.New(config.JWKSFile,
+			jwt.WithIssuer(config.JWTIssuer),
+			jwt.WithAudience(config.JWTAudience),
+			jwt.WithClockSkew(config.JWTClockSkew),
+		)
+		if err != nil {
+			return err
+		}
+		authenticators = append(authenticators, tokens)
+	}
+	if len(authenticators) > 0 {
+		sub.Use(auth.Middleware(authenticators...))
+	}
+	// The rate limits are after the authentication, so that the clients are identified by their credentials.
+	limiter := ratelimit.New(config.RateLimitRead, config.RateLimitWrite, rateLimitOpts...)
+	sub.Use(limiter.Middleware)
 	h.AddRoutes(sub)
 
-	address := fmt.Sprintf("%s:%s", config.Host, config.Port)
+	// The access log and the metrics wrap the router rather than being its middlewares, so that they also see the
+	// requests that do not match a route (404 and 405). The router records the matched route for them.
+	root.Use(route.Record)
+	handler := m.Middleware(root)
+	if accessLogger != nil {
+		handler = accessLogger.Middleware(handler)
+	}
+	handler = route.Middleware(handler)
+
+	// The requests are aborted after the grace period, by canceling their base context.
+	requestsCtx, abortRequests := context.WithCancel(context.Background())
+	defer abortRequests()
 	server := &http.Server{
-		Addr:           address,
-		Handler:        root,
+		Handler:        track(&inFlight, requestid.Middleware(withTimeout(handler, config.Timeout))),
+		BaseContext:    func(net.Listener) context.Context { return requestsCtx },
+		ErrorLog:       slog.NewLogLogger(logger.Handler(), slog.LevelWarn),
 		ReadTimeout:    config.Timeout,
 		WriteTimeout:   config.Timeout,
 		MaxHeaderBytes: 1 << 20, // Restrict the max size of headers.
 	}
+	if config.TLS.Enabled() {
+		server.TLSConfig, err = config.TLS.TLSConfig(tlsconfig.WithLogger(logger))
+		if err != nil {
+			return err
+		}
+	} else if config.TLS.ClientCAFile != "" {
+		return errors.New("the client CAs require a TLS certificate")
+	}
 
-	log.Printf("Start server: %s\n", address)
+	// Serve in the background, until the server is shut down.
+	serveErr := make(chan error, 1)
+	go func() {
+		if server.TLSConfig != nil {
+			// The certificate comes from the TLS configuration, so that it is reloaded.
+			serveErr <- server.ServeTLS(listener, "", "")
+			return
+		}
+		serveErr <- server.Serve(listener)
+	}()
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+	stop()
 
-	// Run the server.
-	log.Fatal(server.ListenAndServe())
+	logger.Info("Shut down server", "grace_period", config.ShutdownGracePeriod.String())
+	shuttingDown.Store(true)
+	time.Sleep(config.ShutdownDelay)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.ShutdownGracePeriod)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		// The grace period is over: abort the remaining requests. Their handlers stop at the next check of their
+		// context, and are waited for before the database is closed.
+		abortRequests()
+		server.Close()
+		return fmt.Errorf("could not shut down gracefully: %w", err)
+	}
+	logger.Info("Server stopped")
+	return nil
+}
+
+// track counts the running handlers in the wait group.
+func track(wg *sync.WaitGroup, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wg.Add(1)
+		defer wg.Done()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withTimeout cancels the context of each request after the timeout.
+// The handlers pass this context to the database, so slow calls are aborted.
+func withTimeout(next http.Handler, timeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
 }
 
 // init gets called before main().
@@ -68,25 +380,73 @@ func init() {
 	flags.StringVarP(&config.Host, "host", "h", "localhost", "Hostname")
 	flags.StringVarP(&config.Port, "port", "p", "8080", "Port")
 	flags.DurationVarP(&config.Timeout, "timeout", "t", 10*time.Second, "Server timeouts")
+	flags.DurationVar(&config.ShutdownDelay, "shutdown.delay", 0, "Time between failing the readiness route and closing the listener during the shutdown (set to the readiness probe period behind a load balancer)")
+	flags.DurationVar(&config.ShutdownGracePeriod, "shutdown.grace-period", 30*time.Second, "Maximum time to wait for the requests in flight during the shutdown")
+
+	// Define the flags for TLS.
+	flags.StringVar(&config.TLS.CertFile, "tls.cert", "", "Path to the PEM certificate of the server, reloaded when it changes (default: cleartext HTTP)")
+	flags.StringVar(&config.TLS.KeyFile, "tls.key", "", "Path to the PEM private key of the certificate")
+	flags.StringVar(&config.TLS.MinVersion, "tls.min-version", "1.2", "Minimum version of TLS (supported values: 1.2, 1.3)")
+	flags.StringSliceVar(&config.TLS.CipherSuites, "tls.cipher-suites", nil, "Cipher suites of TLS 1.2, ex: TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 (default: the secure cipher suites of Go)")
+	flags.StringVar(&config.TLS.ClientCAFile, "tls.client-ca", "", "Path to the PEM bundle of the CAs of the client certificates, which authenticate the clients of the /users routes (default: no mutual TLS)")
+	flags.StringVar(&config.TLS.ClientAuth, "tls.client-auth", "", "Whether the clients must present a certificate when there are client CAs (supported values: require, optional; default: require)")
+
+	// Define the flags for the logs.
+	flags.StringVar(&config.LogFormat, "log.format", "text", "Format of the logs (supported values: text, json)")
+	flags.StringVar(&config.LogLevel, "log.level", "info", "Minimum level of the logs (supported values: debug, info, warn, error)")
+
+	// Define the flags for the access log.
+	flags.StringVar(&config.AccessLogFormat, "access-log.format", "combined", "Format of the access log (supported values: common, combined, json, none)")
+	flags.StringVar(&config.AccessLogFile, "access-log.file", "", "Path of the access log file (default: standard output)")
+	flags.Int64Var(&config.AccessLogMaxSize, "access-log.max-size", 100, "Size in megabytes at which the access log file is rotated (0 to disable)")
+	flags.IntVar(&config.AccessLogMaxBackups, "access-log.max-backups", 5, "Number of rotated access log files to keep")
+	flags.Float64Var(&config.AccessLogSample2xx, "access-log.sample-2xx", 1, "Fraction of the requests with a 2xx status to log, between 0 and 1 (other requests are always logged)")
+
+	// Define the flags for the health checks.
+	flags.DurationVar(&config.HealthTimeout, "health.timeout", 2*time.Second, "Maximum duration of each health check")
+
+	// Define the flags for the authentication.
+	flags.StringVar(&config.APIKeysFile, "auth.api-keys-file", "", "Path to the API keys file of the /users routes, managed with `server keys` (default: no API keys)")
+	flags.StringVar(&config.JWKSFile, "auth.jwks-file", "", "Path to the JSON Web Key Set file that verifies the bearer JWTs of the /users routes, reloaded when it changes (default: no JWTs)")
+	flags.StringVar(&config.JWTIssuer, "auth.jwt.issuer", "", "Required issuer (iss) of the JWTs (default: any issuer)")
+	flags.StringVar(&config.JWTAudience, "auth.jwt.audience", "", "Required audience (aud) of the JWTs (default: any audience)")
+	flags.DurationVar(&config.JWTClockSkew, "auth.jwt.clock-skew", time.Minute, "Tolerance of the checks of the expiry and the start of the JWTs")
+	flags.StringVar(&config.PolicyFile, "auth.policy-file", "", "Path to the JSON file that maps the roles to the permissions of the /users routes (default: all permissions)")
+
+	// Define the flags for the rate limits.
+	// The limits are disabled by default, so that existing deployments are not limited.
+	flags.Float64Var(&config.RateLimitRead.Rate, "rate-limit.read.rate", 0, "Read requests per second of each client to the /users routes, ex: 20 (0 to disable)")
+	flags.IntVar(&config.RateLimitRead.Burst, "rate-limit.read.burst", 40, "Read requests that each client can send at once")
+	flags.Float64Var(&config.RateLimitWrite.Rate, "rate-limit.write.rate", 0, "Write requests per second of each client to the /users routes, ex: 5 (0 to disable)")
+	flags.IntVar(&config.RateLimitWrite.Burst, "rate-limit.write.burst", 10, "Write requests that each client can send at once")
+	flags.Float64Var(&config.RateLimitIP.Rate, "rate-limit.ip.rate", 0, "Read and write requests per second of each IP address to the /users routes, including the requests with invalid credentials, ex: 50 (0 to disable)")
+	flags.IntVar(&config.RateLimitIP.Burst, "rate-limit.ip.burst", 100, "Requests that each IP address can send at once")
+	flags.DurationVar(&config.RateLimitIdleTimeout, "rate-limit.idle-timeout", 10*time.Minute, "Time after which the rate limit of an idle client is forgotten")
+	flags.IntVar(&config.RateLimitMaxClients, "rate-limit.max-clients", 100000, "Maximum number of clients whose rate limits are tracked (the least recently seen are forgotten)")
 
 	// Define the flags for the database.
-	flags.StringVar(&config.Database.Type, "database.type", "mock", "Database type (supported values: mock)")
+	flags.StringVar(&config.Database.Type, "database.type", "mock", "Database type (supported values: mock, sqlite, bolt, wal)")
+	flags.StringVar(&config.Database.SQLite.Path, "database.sqlite.path", "users.db", "Path to the SQLite database file")
+	flags.StringVar(&config.Database.Bolt.Path, "database.bolt.path", "users.bolt", "Path to the bbolt database file")
+	flags.StringVar(&config.Database.WAL.Dir, "database.wal.dir", "data", "Data directory of the write-ahead log")
+	flags.DurationVar(&config.Database.WAL.CompactInterval, "database.wal.compact-interval", 5*time.Minute, "Interval between write-ahead log compactions (0 to disable)")
+
+	// Define the flags for the validation.
+	flags.StringVar(&config.ValidationRules, "validation.rules", "", "Path to the JSON file of the validation rules of users (default: age between 18 and 100, names of at most 256 characters)")
+
+	// Define the flags for the user IDs.
+	flags.StringVar(&config.IDFormat, "users.id-format", "ulid", "Format of the IDs generated for users created without an ID (supported values: ulid, uuidv7)")
+	flags.BoolVar(&config.ClientIDs, "users.client-ids", true, "Allow clients to choose the IDs of the users they create")
+	flags.Int64Var(&config.MaxBodySize, "users.max-body-size", users.DefaultMaxBodySize, "Maximum size in bytes of the request bodies of the /users routes")
 
 	// Define the usage (help) function (when `--help` is used).
 	flags.Usage = func() {
 		usage := `Usage: server [flags]
+       server keys <mint|revoke|list> [flags]
 An HTTP Server to manage users.
 `
 		// Print this message at the top.
 		fmt.Fprintln(os.Stderr, usage)
 		fmt.Fprintln(os.Stderr, flags.FlagUsages())
 	}
-
-	// Parse the flags.
-	// This is important to actually read the values into config.
-	// Args[0] is always the name of the command.
-	if err := flags.Parse(os.Args[1:]); err != nil {
-		log.Fatalf("could not parse flags: %v", err)
-	}
-
 }
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kicodelibrary/go-http-server-2024/pkg/auth/apikey"
+	"github.com/kicodelibrary/go-http-server-2024/pkg/database"
+	"github.com/kicodelibrary/go-http-server-2024/pkg/database/bolt"
+	"github.com/kicodelibrary/go-http-server-2024/pkg/server/ratelimit"
+	"github.com/kicodelibrary/go-http-server-2024/pkg/server/tlsconfig/tlsconfigtest"
+	"github.com/kicodelibrary/go-http-server-2024/pkg/server/users"
+	"github.com/smarty/assertions"
+)
+
+// start runs the server in the background. It returns the base URL of the server, the function that starts the shutdown,
+// and the channel of the result of run.
+func start(t *testing.T, config *Config) (string, context.CancelFunc, <-chan error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	done := make(chan error, 1)
+	go func() {
+		done <- run(ctx, cancel, config, slog.Default(), listener)
+	}()
+	return "http://" + listener.Addr().String(), cancel, done
+}
+
+// testConfig returns the configuration of a server with a bbolt database, which is locked until it is closed.
+func testConfig(t *testing.T) *Config {
+	return &Config{
+		Timeout: 10 * time.Second,
+		Database: database.Config{
+			Type: "bolt",
+			Bolt: bolt.Config{Path: filepath.Join(t.TempDir(), "users.bolt")},
+		},
+		IDFormat:    "ulid",
+		ClientIDs:   true,
+		MaxBodySize: users.DefaultMaxBodySize,
+		// The requests that start before the shutdown are accepted during the delay.
+		ShutdownDelay:       500 * time.Millisecond,
+		ShutdownGracePeriod: 5 * time.Second,
+		HealthTimeout:       2 * time.Second,
+	}
+}
+
+// readyz returns the status code of the readiness route, or 0 if the server cannot be reached.
+func readyz(base string) int {
+	// Don't reuse connections, so that closed listeners are detected.
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	res, err := client.Get(base + "/readyz")
+	if err != nil {
+		return 0
+	}
+	res.Body.Close()
+	return res.StatusCode
+}
+
+// startCreate starts creating a user. The body is only sent up to the name, so that the request is in flight
+// until the rest is written to the returned writer.
+func startCreate(t *testing.T, base string) (*io.PipeWriter, <-chan *http.Response) {
+	body, w := io.Pipe()
+	req, err := http.NewRequest(http.MethodPost, base+"/users/", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	responses := make(chan *http.Response, 1)
+	go func() {
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			close(responses)
+			return
+		}
+		res.Body.Close()
+		responses <- res
+	}()
+	// This returns once the client sends the headers and starts sending the body.
+	// The JSON is padded with spaces, so that it is not held in the buffers of the client.
+	if _, err := w.Write([]byte(`{"id":"alice","name":"Alice",` + strings.Repeat(" ", 1<<15))); err != nil {
+		t.Fatal(err)
+	}
+	return w, responses
+}
+
+func TestShutdown(t *testing.T) {
+	a := assertions.New(t)
+	config := testConfig(t)
+	base, shutdown, done := start(t, config)
+
+	// Wait for the server to be ready.
+	for readyz(base) != http.StatusOK {
+		time.Sleep(10 * time.Millisecond)
+	}
+	w, responses := startCreate(t, base)
+
+	// The readiness route fails as soon as the shutdown starts, while the server still accepts connections.
+	shutdown()
+	deadline := time.Now().Add(config.ShutdownDelay)
+	for readyz(base) != http.StatusServiceUnavailable {
+		if time.Now().After(deadline) {
+			t.Fatal("the readiness route did not fail during the shutdown delay")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The request in flight completes.
+	time.Sleep(config.ShutdownDelay)
+	if _, err := w.Write([]byte(`"age":30}`)); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	res, ok := <-responses
+	if !a.So(ok, assertions.ShouldBeTrue) {
+		return
+	}
+	a.So(res.StatusCode, assertions.ShouldEqual, http.StatusCreated)
+
+	// The server stops cleanly, and no longer accepts connections.
+	a.So(<-done, assertions.ShouldBeNil)
+	a.So(readyz(base), assertions.ShouldEqual, 0)
+
+	// The database was closed, so it can be opened again, with the user.
+	users, err := bolt.NewUsers(config.Database.Bolt.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer users.Close()
+	user, err := users.Get(context.Background(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.So(user.Name, assertions.ShouldEqual, "Alice")
+}
+
+func TestShutdownGracePeriod(t *testing.T) {
+	a := assertions.New(t)
+	config := testConfig(t)
+	config.ShutdownGracePeriod = 100 * time.Millisecond
+	base, shutdown, done := start(t, config)
+
+	for readyz(base) != http.StatusOK {
+		time.Sleep(10 * time.Millisecond)
+	}
+	w, responses := startCreate(t, base)
+
+	// The request does not complete in time: it is aborted after the grace period.
+	shutdown()
+	err := <-done
+	a.So(errors.Is(err, context.DeadlineExceeded), assertions.ShouldBeTrue)
+	w.Close()
+	_, ok := <-responses
+	a.So(ok, assertions.ShouldBeFalse)
+
+	// The database is closed anyway.
+	users, err := bolt.NewUsers(config.Database.Bolt.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users.Close()
+}
+
+func TestTrack(t *testing.T) {
+	var inFlight sync.WaitGroup
+	entered, release := make(chan struct{}), make(chan struct{})
+	handler := track(&inFlight, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(entered)
+		<-release
+	}))
+	go handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	<-entered
+
+	// The wait only returns once the handler returned.
+	waited := make(chan struct{})
+	go func() {
+		inFlight.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+		t.Fatal("the wait returned while the handler is running")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case <-waited:
+	case <-time.After(time.Second):
+		t.Fatal("the wait did not return after the handler")
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	a := assertions.New(t)
+	config := testConfig(t)
+	config.APIKeysFile = filepath.Join(t.TempDir(), "keys.json")
+	keys, err := apikey.Open(config.APIKeysFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, secret, err := keys.Mint(apikey.MintOptions{Name: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, _, _ := start(t, config)
+	for readyz(base) != http.StatusOK {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The /users routes need an API key, the other routes don't.
+	for _, tc := range []struct {
+		Name string
+		Key  string
+		Code int
+	}{
+		{Name: "NoKey", Code: http.StatusUnauthorized},
+		{Name: "InvalidKey", Key: secret + "0", Code: http.StatusUnauthorized},
+		{Name: "Key", Key: secret, Code: http.StatusOK},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, base+"/users/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.Key != "" {
+				req.Header.Set(apikey.Header, tc.Key)
+			}
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			a.So(res.StatusCode, assertions.ShouldEqual, tc.Code)
+		})
+	}
+}
+
+func TestTLS(t *testing.T) {
+	a := assertions.New(t)
+	dir := t.TempDir()
+	ca := tlsconfigtest.NewCA(t, "ca")
+	config := testConfig(t)
+	config.TLS.CertFile, config.TLS.KeyFile = ca.Issue(t, dir, pkix.Name{CommonName: "server"}, "127.0.0.1")
+	config.TLS.ClientCAFile = ca.WriteFile(t, dir)
+	// The health routes can be called without a certificate.
+	config.TLS.ClientAuth = "optional"
+	base, _, _ := start(t, config)
+	base = strings.Replace(base, "http://", "https://", 1)
+
+	clientCertFile, clientKeyFile := ca.Issue(t, dir, pkix.Name{CommonName: "alice"})
+	clientCert, err := tls.LoadX509KeyPair(clientCertFile, clientKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// get returns the status code of the route, with the client certificates.
+	get := func(path string, certificates ...tls.Certificate) int {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: ca.Pool(), Certificates: certificates},
+			DisableKeepAlives: true,
+		}}
+		res, err := client.Get(base + path)
+		if err != nil {
+			return 0
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	for get("/readyz") != http.StatusOK {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The client certificate authenticates the requests to the /users routes.
+	a.So(get("/users/", clientCert), assertions.ShouldEqual, http.StatusOK)
+	a.So(get("/users/"), assertions.ShouldEqual, http.StatusUnauthorized)
+}
+
+func TestRateLimitInvalidCredentials(t *testing.T) {
+	a := assertions.New(t)
+	config := testConfig(t)
+	config.APIKeysFile = filepath.Join(t.TempDir(), "keys.json")
+	config.RateLimitIP = ratelimit.Limit{Rate: 0.01, Burst: 2}
+	base, _, _ := start(t, config)
+	for readyz(base) != http.StatusOK {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The requests with invalid keys are limited by IP address, before the authentication.
+	var codes []int
+	for i := 0; i < 3; i++ {
+		req, err := http.NewRequest(http.MethodGet, base+"/users/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(apikey.Header, "uk_0123456789abcdef_guess")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		codes = append(codes, res.StatusCode)
+	}
+	a.So(codes, assertions.ShouldResemble, []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests})
+}
@@ -0,0 +1,294 @@
+// Package apikey authenticates requests with API keys.
+//
+// An API key looks like `uk_<id>_<secret>`. It is sent in the X-API-Key header, or as a bearer token
+// (`Authorization: Bearer uk_...`). Only the SHA-256 hash of the secret is stored, in a JSON keys file:
+//
+//	{
+//		"keys": [
+//			{"id": "9f86d081884c7d65", "name": "ci", "hash": "...", "created_at": "2024-01-01T00:00:00Z"}
+//		]
+//	}
+//
+// The keys are minted and revoked with the `keys` command of the server. The server reloads the file when it changes.
+package apikey
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kicodelibrary/go-http-server-2024/pkg/auth"
+)
+
+// Header is the header of the API key.
+const Header = "X-API-Key"
+
+// prefix is the prefix of API keys, which tells them apart from other bearer tokens.
+const prefix = "uk_"
+
+// ErrKeyNotFound is returned when revoking a key that does not exist.
+var ErrKeyNotFound = errors.New("API key not found")
+
+// Key is a stored API key.
+type Key struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Hash is the hexadecimal SHA-256 hash of the secret.
+	Hash string `json:"hash"`
+	// ReadOnly restricts the key to the safe methods.
+	ReadOnly bool `json:"read_only,omitempty"`
+	// Roles are the roles of the clients of the key (see auth.Authorizer).
+	Roles     []string   `json:"roles,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// valid returns true if the key can be used at the time.
+func (k Key) valid(now time.Time) bool {
+	return k.RevokedAt == nil && (k.ExpiresAt == nil || now.Before(*k.ExpiresAt))
+}
+
+// keysFile is the content of the keys file.
+type keysFile struct {
+	Keys []Key `json:"keys"`
+}
+
+// hash returns the hash of a secret.
+func hash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// parse splits an API key into its ID and secret.
+func parse(key string) (id, secret string, ok bool) {
+	rest, ok := strings.CutPrefix(key, prefix)
+	if !ok {
+		return "", "", false
+	}
+	id, secret, ok = strings.Cut(rest, "_")
+	return id, secret, ok && id != "" && secret != ""
+}
+
+// randomHex returns n random bytes in hexadecimal.
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// File stores API keys in a JSON file. It is safe for concurrent use, and the file can be changed by other processes.
+type File struct {
+	path string
+	now  func() time.Time
+
+	mu      sync.Mutex
+	keys    map[string]Key
+	modTime time.Time
+	size    int64
+}
+
+// Open opens the keys file. A missing file has no keys.
+func Open(path string) (*File, error) {
+	f := &File{
+		path: path,
+		now:  time.Now,
+	}
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// reload reads the file again if it changed. The lock must be held.
+func (f *File) reload() error {
+	info, err := os.Stat(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		f.keys, f.modTime, f.size = nil, time.Time{}, 0
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not read keys file: %w", err)
+	}
+	if f.keys != nil && info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return nil
+	}
+	b, err := os.ReadFile(f.path)
+	if err != nil {
+		return fmt.Errorf("could not read keys file: %w", err)
+	}
+	var file keysFile
+	if err := json.Unmarshal(b, &file); err != nil {
+		return fmt.Errorf("could not decode keys file: %w", err)
+	}
+	f.keys = make(map[string]Key, len(file.Keys))
+	for _, k := range file.Keys {
+		f.keys[k.ID] = k
+	}
+	f.modTime, f.size = info.ModTime(), info.Size()
+	return nil
+}
+
+// Authenticate implements auth.Authenticator.
+func (f *File) Authenticate(r *http.Request) (*auth.Principal, error) {
+	key := r.Header.Get(Header)
+	if key == "" {
+		key = auth.BearerToken(r)
+	}
+	id, secret, ok := parse(key)
+	if !ok {
+		// Other bearer tokens are left to the other authenticators.
+		return nil, auth.ErrNoCredentials
+	}
+
+	f.mu.Lock()
+	if err := f.reload(); err != nil {
+		// The file may have been edited by hand: authenticate with the keys loaded before, until it is fixed.
+		// A key revoked in the invalid file is still accepted meanwhile, which the warning tells the operator.
+		slog.WarnContext(r.Context(), "could not reload API keys", "error", err)
+	}
+	stored, found := f.keys[id]
+	f.mu.Unlock()
+
+	// Compare in constant time, so that the hash cannot be guessed from the response time.
+	if !found || subtle.ConstantTimeCompare([]byte(hash(secret)), []byte(stored.Hash)) != 1 || !stored.valid(f.now()) {
+		return nil, auth.ErrInvalidCredentials
+	}
+	return &auth.Principal{
+		Subject:  stored.ID,
+		Method:   "api_key",
+		ReadOnly: stored.ReadOnly,
+		Roles:    stored.Roles,
+	}, nil
+}
+
+// List returns the keys, including the revoked and expired keys.
+func (f *File) List() ([]Key, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.read()
+}
+
+// read reads the keys in the order of the file. The lock must be held.
+func (f *File) read() ([]Key, error) {
+	b, err := os.ReadFile(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read keys file: %w", err)
+	}
+	var file keysFile
+	if err := json.Unmarshal(b, &file); err != nil {
+		return nil, fmt.Errorf("could not decode keys file: %w", err)
+	}
+	return file.Keys, nil
+}
+
+// write replaces the keys file atomically. The lock must be held.
+func (f *File) write(keys []Key) error {
+	b, err := json.MarshalIndent(keysFile{Keys: keys}, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("could not write keys file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(b, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not write keys file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("could not write keys file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), f.path); err != nil {
+		return fmt.Errorf("could not write keys file: %w", err)
+	}
+	return nil
+}
+
+// MintOptions are the options of a new key.
+type MintOptions struct {
+	// Name describes the key, ex: the client that uses it.
+	Name string
+	// ReadOnly restricts the key to the safe methods.
+	ReadOnly bool
+	// Roles are the roles of the clients of the key.
+	Roles []string
+	// TTL is the lifetime of the key. Zero means that the key does not expire.
+	TTL time.Duration
+}
+
+// Mint creates a new key and stores its hash. It returns the stored key and the API key,
+// which cannot be retrieved later.
+func (f *File) Mint(opts MintOptions) (Key, string, error) {
+	id, err := randomHex(8)
+	if err != nil {
+		return Key{}, "", err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return Key{}, "", err
+	}
+	now := f.now().UTC()
+	key := Key{
+		ID:        id,
+		Name:      opts.Name,
+		Hash:      hash(secret),
+		ReadOnly:  opts.ReadOnly,
+		Roles:     opts.Roles,
+		CreatedAt: now,
+	}
+	if opts.TTL > 0 {
+		expiresAt := now.Add(opts.TTL)
+		key.ExpiresAt = &expiresAt
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	keys, err := f.read()
+	if err != nil {
+		return Key{}, "", err
+	}
+	if err := f.write(append(keys, key)); err != nil {
+		return Key{}, "", err
+	}
+	return key, prefix + id + "_" + secret, nil
+}
+
+// Revoke revokes the key. Revoked keys are kept in the file, so that they can be audited.
+// It returns ErrKeyNotFound if there is no key with the ID.
+func (f *File) Revoke(id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	keys, err := f.read()
+	if err != nil {
+		return err
+	}
+	for i, k := range keys {
+		if k.ID != id {
+			continue
+		}
+		if k.RevokedAt == nil {
+			now := f.now().UTC()
+			keys[i].RevokedAt = &now
+		}
+		return f.write(keys)
+	}
+	return ErrKeyNotFound
+}
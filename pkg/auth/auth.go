@@ -0,0 +1,167 @@
+// Package auth authenticates the requests to the API.
+//
+// The credentials of a request are checked by Authenticators (ex: API keys, JWTs or client certificates, see the apikey,
+// jwt and mtls packages).
+// The identity of the client is a Principal, which is stored in the context of the request for the handlers.
+//
+// The permissions of the principal on the routes are checked by an Authorizer (ex: a role-based policy, see the rbac
+// package).
+//
+// Failures are returned as problem details (see api.Problem): 401 Unauthorized if the request has no valid credentials,
+// and 403 Forbidden if the credentials do not allow the request.
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/kicodelibrary/go-http-server-2024/api"
+)
+
+var (
+	// ErrNoCredentials is returned by an Authenticator when the request has no credentials that it supports,
+	// so that the next Authenticator is tried.
+	ErrNoCredentials = errors.New("no credentials")
+	// ErrInvalidCredentials is returned by an Authenticator when the credentials are not valid,
+	// ex: unknown, expired or revoked.
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// Principal is the authenticated client of a request.
+type Principal struct {
+	// Subject identifies the client, ex: the ID of the API key.
+	Subject string
+	// Method is the authentication method, ex: `api_key`.
+	Method string
+	// ReadOnly restricts the client to the safe methods (GET, HEAD and OPTIONS).
+	ReadOnly bool
+	// Roles are the roles of the client, which grant permissions (see Authorizer).
+	Roles []string
+	// Claims are the verified claims of a token, ex: `sub` and `email` (see the jwt package).
+	// They are nil for the other methods.
+	Claims map[string]any
+}
+
+// contextKey is the key of the principal in the context.
+type contextKey struct{}
+
+// NewContext returns a context with the principal.
+func NewContext(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, contextKey{}, principal)
+}
+
+// FromContext returns the principal of the context, or nil if the request is not authenticated.
+func FromContext(ctx context.Context) *Principal {
+	principal, _ := ctx.Value(contextKey{}).(*Principal)
+	return principal
+}
+
+// Authenticator authenticates requests with a kind of credentials.
+type Authenticator interface {
+	// Authenticate returns the principal of the request.
+	// It returns an error wrapping ErrNoCredentials if the request has no credentials of this kind,
+	// or ErrInvalidCredentials if they are not valid.
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// BearerToken returns the token of the `Authorization: Bearer <token>` header, or an empty string if there is none.
+func BearerToken(r *http.Request) string {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// Middleware authenticates the requests with the first authenticator that supports their credentials.
+// Requests without valid credentials are rejected with 401 Unauthorized, and write requests of read-only principals
+// with 403 Forbidden. It is a mux.MiddlewareFunc.
+func Middleware(authenticators ...Authenticator) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			principal, err := authenticate(r, authenticators)
+			if err != nil {
+				// The reason is not returned to the client, but it helps to debug the issuers of tokens.
+				slog.DebugContext(r.Context(), "authentication failed", "error", err)
+				w.Header().Set("WWW-Authenticate", `Bearer realm="users"`)
+				detail := "the request has no credentials"
+				if !errors.Is(err, ErrNoCredentials) {
+					detail = "the credentials are invalid"
+				}
+				api.NewProblem(http.StatusUnauthorized, api.CodeUnauthorized, detail).Write(w)
+				return
+			}
+			if principal.ReadOnly && !isSafe(r.Method) {
+				api.NewProblem(http.StatusForbidden, api.CodeForbidden, "the credentials are read-only").Write(w)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), principal)))
+		})
+	}
+}
+
+// authenticate tries the authenticators in order.
+func authenticate(r *http.Request, authenticators []Authenticator) (*Principal, error) {
+	for _, a := range authenticators {
+		principal, err := a.Authenticate(r)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return principal, nil
+	}
+	return nil, ErrNoCredentials
+}
+
+// Permission is a permission on the routes, ex: `users:read`.
+type Permission string
+
+// Authorizer decides whether principals have permissions.
+type Authorizer interface {
+	// Authorize returns true if the principal has the permission on the resource of the request.
+	// owner is the subject that owns the resource (ex: the ID of a user for the user itself), or empty if there is none,
+	// so that principals can be allowed to access their own resources only.
+	Authorize(principal *Principal, permission Permission, owner string) bool
+}
+
+// Require returns a middleware that only lets through the requests of the principals with the permission.
+// owner returns the owner of the resource of the request (see Authorizer). It may be nil.
+// It must run after Middleware: requests without a principal are rejected with 401 Unauthorized.
+func Require(authorizer Authorizer, permission Permission, owner func(r *http.Request) string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			principal := FromContext(r.Context())
+			if principal == nil {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="users"`)
+				api.NewProblem(http.StatusUnauthorized, api.CodeUnauthorized, "the request has no credentials").Write(w)
+				return
+			}
+			var resourceOwner string
+			if owner != nil {
+				resourceOwner = owner(r)
+			}
+			if !authorizer.Authorize(principal, permission, resourceOwner) {
+				detail := fmt.Sprintf("the credentials do not have the permission %s", permission)
+				api.NewProblem(http.StatusForbidden, api.CodeForbidden, detail).Write(w)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// isSafe returns true for the methods that do not change the resources.
+func isSafe(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,89 @@
+package auth_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kicodelibrary/go-http-server-2024/api"
+	. "github.com/kicodelibrary/go-http-server-2024/pkg/auth"
+	"github.com/smarty/assertions"
+)
+
+// tokens authenticates the bearer tokens of a map.
+type tokens map[string]*Principal
+
+// Authenticate implements Authenticator.
+func (t tokens) Authenticate(r *http.Request) (*Principal, error) {
+	token := BearerToken(r)
+	if token == "" {
+		return nil, ErrNoCredentials
+	}
+	principal, ok := t[token]
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+	return principal, nil
+}
+
+// noCredentials never finds credentials.
+type noCredentials struct{}
+
+// Authenticate implements Authenticator.
+func (noCredentials) Authenticate(r *http.Request) (*Principal, error) {
+	return nil, ErrNoCredentials
+}
+
+func TestMiddleware(t *testing.T) {
+	a := assertions.New(t)
+	alice := &Principal{Subject: "alice", Method: "test"}
+	reader := &Principal{Subject: "reader", Method: "test", ReadOnly: true}
+
+	var principal *Principal
+	h := Middleware(noCredentials{}, tokens{"alice": alice, "reader": reader})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal = FromContext(r.Context())
+	}))
+
+	for _, tc := range []struct {
+		Name          string
+		Method        string
+		Authorization string
+		Code          int
+		ErrorCode     api.ErrorCode
+		Principal     *Principal
+	}{
+		{Name: "Authenticated", Method: http.MethodPost, Authorization: "Bearer alice", Code: http.StatusOK, Principal: alice},
+		{Name: "Scheme", Method: http.MethodGet, Authorization: "bearer alice", Code: http.StatusOK, Principal: alice},
+		{Name: "NoCredentials", Method: http.MethodGet, Code: http.StatusUnauthorized, ErrorCode: api.CodeUnauthorized},
+		{Name: "Basic", Method: http.MethodGet, Authorization: "Basic YWxpY2U6", Code: http.StatusUnauthorized, ErrorCode: api.CodeUnauthorized},
+		{Name: "InvalidCredentials", Method: http.MethodGet, Authorization: "Bearer bob", Code: http.StatusUnauthorized, ErrorCode: api.CodeUnauthorized},
+		{Name: "ReadOnlyGet", Method: http.MethodGet, Authorization: "Bearer reader", Code: http.StatusOK, Principal: reader},
+		{Name: "ReadOnlyDelete", Method: http.MethodDelete, Authorization: "Bearer reader", Code: http.StatusForbidden, ErrorCode: api.CodeForbidden},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			principal = nil
+			req := httptest.NewRequest(tc.Method, "/users/", nil)
+			if tc.Authorization != "" {
+				req.Header.Set("Authorization", tc.Authorization)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			a.So(rec.Code, assertions.ShouldEqual, tc.Code)
+			a.So(principal, assertions.ShouldEqual, tc.Principal)
+			if tc.ErrorCode == "" {
+				return
+			}
+			a.So(rec.Header().Get("Content-Type"), assertions.ShouldEqual, api.ProblemContentType)
+			var p api.Problem
+			if err := json.Unmarshal(rec.Body.Bytes(), &p); err != nil {
+				t.Fatal(err)
+			}
+			a.So(p.Code, assertions.ShouldEqual, tc.ErrorCode)
+			if tc.Code == http.StatusUnauthorized {
+				a.So(rec.Header().Get("WWW-Authenticate"), assertions.ShouldStartWith, "Bearer")
+			}
+		})
+	}
+}
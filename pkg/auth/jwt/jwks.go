@@ -0,0 +1,181 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+)
+
+// minRSABits is the minimum size of RSA keys (RFC 7518, section 3.3).
+const minRSABits = 2048
+
+// jwk is a JSON Web Key (RFC 7517). Only the public parameters are read.
+type jwk struct {
+	KeyType string `json:"kty"`
+	ID      string `json:"kid"`
+	Use     string `json:"use"`
+	Alg     string `json:"alg"`
+	// N and E are the modulus and the exponent of RSA keys.
+	N string `json:"n"`
+	E string `json:"e"`
+	// Curve, X and Y are the curve and the coordinates of EC and OKP keys. OKP keys have no Y.
+	Curve string `json:"crv"`
+	X     string `json:"x"`
+	Y     string `json:"y"`
+}
+
+// key is a verification key.
+type key struct {
+	id string
+	// alg is the algorithm of the tokens that the key verifies.
+	alg    string
+	public crypto.PublicKey
+}
+
+// parseJWKS parses a JSON Web Key Set. The keys that are not used for signatures are ignored.
+func parseJWKS(b []byte) ([]key, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, fmt.Errorf("could not decode JWKS: %w", err)
+	}
+	keys := make([]key, 0, len(set.Keys))
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		parsed, err := k.parse()
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %d (kid %q) in JWKS: %w", i, k.ID, err)
+		}
+		keys = append(keys, parsed)
+	}
+	return keys, nil
+}
+
+// parse returns the verification key. The algorithm of the key must match its type, if it is set.
+func (k jwk) parse() (key, error) {
+	var (
+		alg    string
+		public crypto.PublicKey
+		err    error
+	)
+	switch k.KeyType {
+	case "RSA":
+		alg = AlgorithmRS256
+		public, err = k.rsa()
+	case "EC":
+		alg = AlgorithmES256
+		public, err = k.ecdsa()
+	case "OKP":
+		alg = AlgorithmEdDSA
+		public, err = k.ed25519()
+	default:
+		return key{}, fmt.Errorf("unsupported key type %q", k.KeyType)
+	}
+	if err != nil {
+		return key{}, err
+	}
+	if k.Alg != "" && k.Alg != alg {
+		return key{}, fmt.Errorf("unsupported algorithm %q for key type %s", k.Alg, k.KeyType)
+	}
+	return key{id: k.ID, alg: alg, public: public}, nil
+}
+
+// rsa returns the public key of an RSA JWK.
+func (k jwk) rsa() (*rsa.PublicKey, error) {
+	n, err := decodeBigInt(k.N)
+	if err != nil {
+		return nil, fmt.Errorf("invalid modulus: %w", err)
+	}
+	e, err := decodeBigInt(k.E)
+	if err != nil {
+		return nil, fmt.Errorf("invalid exponent: %w", err)
+	}
+	if n.BitLen() < minRSABits {
+		return nil, fmt.Errorf("RSA key of %d bits, must be at least %d bits", n.BitLen(), minRSABits)
+	}
+	if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 || e.Bit(0) == 0 {
+		return nil, errors.New("invalid exponent")
+	}
+	return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+}
+
+// ecdsa returns the public key of a P-256 JWK.
+func (k jwk) ecdsa() (*ecdsa.PublicKey, error) {
+	if k.Curve != "P-256" {
+		return nil, fmt.Errorf("unsupported curve %q", k.Curve)
+	}
+	x, err := decodeFixed(k.X, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid x: %w", err)
+	}
+	y, err := decodeFixed(k.Y, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid y: %w", err)
+	}
+	// Check that the point is on the curve, with the uncompressed encoding.
+	if _, err := ecdh.P256().NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil {
+		return nil, err
+	}
+	return &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(x),
+		Y:     new(big.Int).SetBytes(y),
+	}, nil
+}
+
+// ed25519 returns the public key of an Ed25519 JWK.
+func (k jwk) ed25519() (ed25519.PublicKey, error) {
+	if k.Curve != "Ed25519" {
+		return nil, fmt.Errorf("unsupported curve %q", k.Curve)
+	}
+	x, err := decodeFixed(k.X, ed25519.PublicKeySize)
+	if err != nil {
+		return nil, fmt.Errorf("invalid x: %w", err)
+	}
+	return ed25519.PublicKey(x), nil
+}
+
+// decodeBigInt decodes a base64url unsigned big-endian integer.
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("empty value")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// decodeFixed decodes base64url bytes of a fixed size.
+func decodeFixed(s string, size int) ([]byte, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != size {
+		return nil, fmt.Errorf("%d bytes, must be %d", len(b), size)
+	}
+	return b, nil
+}
+
+// loadJWKS loads a JWKS file.
+func loadJWKS(path string) ([]key, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read JWKS: %w", err)
+	}
+	return parseJWKS(b)
+}
@@ -0,0 +1,311 @@
+// Package jwt authenticates requests with JSON Web Tokens (RFC 7519) sent as bearer tokens.
+//
+// The tokens are issued by other services. They are verified with the public keys of a local JSON Web Key Set file
+// (RFC 7517), which the server reloads when it changes, so that the keys can be rotated without a restart.
+// The supported algorithms are RS256 (RSA of at least 2048 bits), ES256 (P-256) and EdDSA (Ed25519).
+//
+// The tokens must have a subject (`sub`) and an expiry (`exp`). The issuer (`iss`) and the audience (`aud`) are checked
+// if they are configured. The roles of the principal are the `roles` claim (see auth.Authorizer).
+// The verified claims are available to the handlers in the Principal (see auth.FromContext).
+package jwt
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kicodelibrary/go-http-server-2024/pkg/auth"
+)
+
+// Algorithms.
+const (
+	AlgorithmRS256 = "RS256"
+	AlgorithmES256 = "ES256"
+	AlgorithmEdDSA = "EdDSA"
+)
+
+// Authenticator authenticates requests with JWTs. It is safe for concurrent use.
+type Authenticator struct {
+	path     string
+	issuer   string
+	audience string
+	skew     time.Duration
+	now      func() time.Time
+
+	mu      sync.Mutex
+	keys    []key
+	modTime time.Time
+	size    int64
+}
+
+// Option configures the authenticator.
+type Option func(*Authenticator)
+
+// WithIssuer sets the required issuer (`iss`) of the tokens. The default accepts any issuer.
+func WithIssuer(issuer string) Option {
+	return func(a *Authenticator) {
+		a.issuer = issuer
+	}
+}
+
+// WithAudience sets the audience that the tokens must be intended for (`aud`). The default accepts any audience.
+func WithAudience(audience string) Option {
+	return func(a *Authenticator) {
+		a.audience = audience
+	}
+}
+
+// WithClockSkew sets the tolerance of the checks of the expiry (`exp`) and the start (`nbf`) of the tokens,
+// for the differences between the clocks of the issuer and the server. The default is 1 minute.
+func WithClockSkew(skew time.Duration) Option {
+	return func(a *Authenticator) {
+		a.skew = skew
+	}
+}
+
+// WithClock sets the function that returns the current time. The default is time.Now.
+func WithClock(now func() time.Time) Option {
+	return func(a *Authenticator) {
+		a.now = now
+	}
+}
+
+// New creates an authenticator that verifies the tokens with the keys of the JWKS file.
+func New(path string, opts ...Option) (*Authenticator, error) {
+	a := &Authenticator{
+		path: path,
+		skew: time.Minute,
+		now:  time.Now,
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	if err := a.reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// reload reads the JWKS file again if it changed. The lock must be held.
+func (a *Authenticator) reload() error {
+	info, err := os.Stat(a.path)
+	if err != nil {
+		return fmt.Errorf("could not read JWKS: %w", err)
+	}
+	if a.keys != nil && info.ModTime().Equal(a.modTime) && info.Size() == a.size {
+		return nil
+	}
+	keys, err := loadJWKS(a.path)
+	if err != nil {
+		return err
+	}
+	a.keys, a.modTime, a.size = keys, info.ModTime(), info.Size()
+	return nil
+}
+
+// currentKeys returns the keys of the JWKS file, reloaded if it changed.
+func (a *Authenticator) currentKeys(r *http.Request) []key {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.reload(); err != nil {
+		// The identity provider may have published a key that is not supported: keep verifying the tokens with the
+		// previous keys, which are the ones that signed the tokens in use, until the JWKS is fixed.
+		slog.WarnContext(r.Context(), "could not reload JWKS", "error", err)
+	}
+	return a.keys
+}
+
+// Authenticate implements auth.Authenticator.
+func (a *Authenticator) Authenticate(r *http.Request) (*auth.Principal, error) {
+	token := auth.BearerToken(r)
+	if strings.Count(token, ".") != 2 {
+		// Other bearer tokens (ex: API keys) are left to the other authenticators.
+		return nil, auth.ErrNoCredentials
+	}
+	claims, err := a.verify(token, a.currentKeys(r))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", auth.ErrInvalidCredentials, err)
+	}
+	subject, _ := claims["sub"].(string)
+	return &auth.Principal{
+		Subject: subject,
+		Method:  "jwt",
+		Roles:   stringsClaim(claims, "roles"),
+		Claims:  claims,
+	}, nil
+}
+
+// header is the JOSE header of a token.
+type header struct {
+	Alg  string   `json:"alg"`
+	Kid  string   `json:"kid"`
+	Crit []string `json:"crit"`
+}
+
+// verify verifies the signature and the claims of the token, and returns the claims.
+func (a *Authenticator) verify(token string, keys []key) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	var h header
+	if err := decodeJSON(parts[0], &h); err != nil {
+		return nil, fmt.Errorf("invalid header: %w", err)
+	}
+	switch h.Alg {
+	case AlgorithmRS256, AlgorithmES256, AlgorithmEdDSA:
+	default:
+		// This also rejects `none` and the HMAC algorithms, which would accept forged tokens.
+		return nil, fmt.Errorf("unsupported algorithm %q", h.Alg)
+	}
+	if len(h.Crit) > 0 {
+		return nil, fmt.Errorf("unsupported critical header parameters %q", h.Crit)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature: %w", err)
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	if !verifySignature(keys, h, signed, signature) {
+		return nil, errors.New("invalid signature")
+	}
+
+	var claims map[string]any
+	if err := decodeJSON(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("invalid claims: %w", err)
+	}
+	if err := a.validate(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// verifySignature returns true if a key with the algorithm and the ID of the header verifies the signature.
+// All the keys of the algorithm are tried if the header has no key ID.
+func verifySignature(keys []key, h header, signed, signature []byte) bool {
+	for _, k := range keys {
+		if k.alg != h.Alg || (h.Kid != "" && k.id != h.Kid) {
+			continue
+		}
+		if verifyKey(k.public, signed, signature) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyKey verifies the signature with the public key.
+func verifyKey(public crypto.PublicKey, signed, signature []byte) bool {
+	switch public := public.(type) {
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(signed)
+		return rsa.VerifyPKCS1v15(public, crypto.SHA256, digest[:], signature) == nil
+	case *ecdsa.PublicKey:
+		// The signature is the concatenation of r and s, of 32 bytes each (RFC 7518, section 3.4).
+		if len(signature) != 64 {
+			return false
+		}
+		digest := sha256.Sum256(signed)
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(public, digest[:], r, s)
+	case ed25519.PublicKey:
+		return ed25519.Verify(public, signed, signature)
+	default:
+		return false
+	}
+}
+
+// validate checks the registered claims.
+func (a *Authenticator) validate(claims map[string]any) error {
+	now := a.now()
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return errors.New("the token has no subject")
+	}
+	exp, ok, err := numericDate(claims, "exp")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("the token has no expiry")
+	}
+	if !now.Before(exp.Add(a.skew)) {
+		return fmt.Errorf("the token expired at %s", exp.Format(time.RFC3339))
+	}
+	nbf, ok, err := numericDate(claims, "nbf")
+	if err != nil {
+		return err
+	}
+	if ok && now.Add(a.skew).Before(nbf) {
+		return fmt.Errorf("the token is not valid before %s", nbf.Format(time.RFC3339))
+	}
+	if a.issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != a.issuer {
+			return fmt.Errorf("unexpected issuer %q", iss)
+		}
+	}
+	if a.audience != "" && !slices.Contains(stringsClaim(claims, "aud"), a.audience) {
+		return fmt.Errorf("the token is not intended for audience %q", a.audience)
+	}
+	return nil
+}
+
+// numericDate returns the time of a NumericDate claim (seconds since the epoch). It returns false if it is not set.
+func numericDate(claims map[string]any, name string) (time.Time, bool, error) {
+	v, ok := claims[name]
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	n, ok := v.(json.Number)
+	if !ok {
+		return time.Time{}, false, fmt.Errorf("invalid %s claim, must be a number", name)
+	}
+	seconds, err := n.Float64()
+	if err != nil || math.IsInf(seconds, 0) || math.IsNaN(seconds) {
+		return time.Time{}, false, fmt.Errorf("invalid %s claim, must be a number", name)
+	}
+	whole, frac := math.Modf(seconds)
+	return time.Unix(int64(whole), int64(frac*1e9)), true, nil
+}
+
+// stringsClaim returns a claim that is a string or an array of strings, ex: the audience (`aud`).
+func stringsClaim(claims map[string]any, name string) []string {
+	switch v := claims[name].(type) {
+	case string:
+		return []string{v}
+	case []any:
+		var values []string
+		for _, value := range v {
+			if s, ok := value.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	default:
+		return nil
+	}
+}
+
+// decodeJSON decodes a base64url JSON object. Numbers are kept as json.Number, so that large values are exact.
+func decodeJSON(s string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	return d.Decode(v)
+}
@@ -0,0 +1,249 @@
+package jwt_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kicodelibrary/go-http-server-2024/pkg/auth"
+	. "github.com/kicodelibrary/go-http-server-2024/pkg/auth/jwt"
+	"github.com/smarty/assertions"
+)
+
+// signer signs tokens with a private key.
+type signer struct {
+	kid string
+	alg string
+	key crypto.Signer
+}
+
+// jwk returns the public JWK of the key.
+func (s signer) jwk() map[string]string {
+	b64 := base64.RawURLEncoding.EncodeToString
+	switch public := s.key.Public().(type) {
+	case *rsa.PublicKey:
+		return map[string]string{"kty": "RSA", "kid": s.kid, "alg": s.alg, "n": b64(public.N.Bytes()), "e": b64(big.NewInt(int64(public.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		return map[string]string{"kty": "EC", "kid": s.kid, "crv": "P-256", "x": b64(public.X.FillBytes(make([]byte, 32))), "y": b64(public.Y.FillBytes(make([]byte, 32)))}
+	case ed25519.PublicKey:
+		return map[string]string{"kty": "OKP", "kid": s.kid, "crv": "Ed25519", "x": b64(public)}
+	}
+	panic("unsupported key")
+}
+
+// sign returns a token with the claims.
+func (s signer) sign(t *testing.T, claims map[string]any) string {
+	header, err := json.Marshal(map[string]string{"alg": s.alg, "typ": "JWT", "kid": s.kid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	var signature []byte
+	switch key := s.key.(type) {
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signed))
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signed))
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, key, digest[:])
+		if err == nil {
+			signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(key, []byte(signed))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// newSigners returns a signer of each algorithm.
+func newSigners(t *testing.T) []signer {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []signer{
+		{kid: "rsa", alg: AlgorithmRS256, key: rsaKey},
+		{kid: "ec", alg: AlgorithmES256, key: ecKey},
+		{kid: "ed", alg: AlgorithmEdDSA, key: edKey},
+	}
+}
+
+// writeJWKS writes the public keys of the signers.
+func writeJWKS(t *testing.T, path string, signers ...signer) {
+	keys := make([]map[string]string, len(signers))
+	for i, s := range signers {
+		keys[i] = s.jwk()
+	}
+	b, err := json.Marshal(map[string]any{"keys": keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// authenticate authenticates a request with the bearer token.
+func authenticate(a *Authenticator, token string) (*auth.Principal, error) {
+	req := httptest.NewRequest(http.MethodGet, "/users/", nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return a.Authenticate(req)
+}
+
+func TestAuthenticator(t *testing.T) {
+	a := assertions.New(t)
+	signers := newSigners(t)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, path, signers...)
+
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	authenticator, err := New(path,
+		WithIssuer("https://auth.example.com"),
+		WithAudience("users"),
+		WithClockSkew(30*time.Second),
+		WithClock(func() time.Time { return now }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// claims returns valid claims, with changes.
+	claims := func(changes map[string]any) map[string]any {
+		c := map[string]any{
+			"iss":   "https://auth.example.com",
+			"sub":   "alice",
+			"aud":   []string{"users", "orders"},
+			"exp":   now.Add(time.Hour).Unix(),
+			"email": "alice@example.com",
+			"roles": []string{"member"},
+		}
+		for k, v := range changes {
+			if v == nil {
+				delete(c, k)
+				continue
+			}
+			c[k] = v
+		}
+		return c
+	}
+
+	for _, s := range signers {
+		t.Run(s.alg, func(t *testing.T) {
+			principal, err := authenticate(authenticator, s.sign(t, claims(nil)))
+			if !a.So(err, assertions.ShouldBeNil) {
+				return
+			}
+			a.So(principal.Subject, assertions.ShouldEqual, "alice")
+			a.So(principal.Method, assertions.ShouldEqual, "jwt")
+			a.So(principal.Roles, assertions.ShouldResemble, []string{"member"})
+			a.So(principal.Claims["email"], assertions.ShouldEqual, "alice@example.com")
+		})
+	}
+
+	rs := signers[0]
+	valid := rs.sign(t, claims(nil))
+	for _, tc := range []struct {
+		Name  string
+		Token string
+		Valid bool
+	}{
+		{Name: "AudienceString", Token: rs.sign(t, claims(map[string]any{"aud": "users"})), Valid: true},
+		{Name: "ExpiredWithinSkew", Token: rs.sign(t, claims(map[string]any{"exp": now.Add(-10 * time.Second).Unix()})), Valid: true},
+		{Name: "Expired", Token: rs.sign(t, claims(map[string]any{"exp": now.Add(-time.Minute).Unix()}))},
+		{Name: "NoExpiry", Token: rs.sign(t, claims(map[string]any{"exp": nil}))},
+		{Name: "NotBeforeWithinSkew", Token: rs.sign(t, claims(map[string]any{"nbf": now.Add(10 * time.Second).Unix()})), Valid: true},
+		{Name: "NotBefore", Token: rs.sign(t, claims(map[string]any{"nbf": now.Add(time.Minute).Unix()}))},
+		{Name: "Issuer", Token: rs.sign(t, claims(map[string]any{"iss": "https://other.example.com"}))},
+		{Name: "Audience", Token: rs.sign(t, claims(map[string]any{"aud": "orders"}))},
+		{Name: "NoSubject", Token: rs.sign(t, claims(map[string]any{"sub": nil}))},
+		{Name: "UnknownKey", Token: signer{kid: "other", alg: rs.alg, key: rs.key}.sign(t, claims(nil))},
+		{Name: "WrongKey", Token: signer{kid: "rsa", alg: signers[1].alg, key: signers[1].key}.sign(t, claims(nil))},
+		{Name: "Signature", Token: valid[:len(valid)-4] + "AAAA"},
+		{Name: "None", Token: strings.Join(strings.Split(signer{kid: "rsa", alg: "none", key: rs.key}.sign(t, claims(nil)), ".")[:2], ".") + "."},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			_, err := authenticate(authenticator, tc.Token)
+			if tc.Valid {
+				a.So(err, assertions.ShouldBeNil)
+				return
+			}
+			a.So(errors.Is(err, auth.ErrInvalidCredentials), assertions.ShouldBeTrue)
+		})
+	}
+
+	// Other tokens are left to the other authenticators.
+	_, err = authenticate(authenticator, "")
+	a.So(errors.Is(err, auth.ErrNoCredentials), assertions.ShouldBeTrue)
+	_, err = authenticate(authenticator, "uk_0123456789abcdef_secret")
+	a.So(errors.Is(err, auth.ErrNoCredentials), assertions.ShouldBeTrue)
+}
+
+func TestAuthenticatorReload(t *testing.T) {
+	a := assertions.New(t)
+	signers := newSigners(t)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, path, signers[0])
+
+	authenticator, err := New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := map[string]any{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix()}
+	_, err = authenticate(authenticator, signers[0].sign(t, claims))
+	a.So(err, assertions.ShouldBeNil)
+	_, err = authenticate(authenticator, signers[2].sign(t, claims))
+	a.So(errors.Is(err, auth.ErrInvalidCredentials), assertions.ShouldBeTrue)
+
+	// Rotate the keys.
+	writeJWKS(t, path, signers[2])
+	_, err = authenticate(authenticator, signers[2].sign(t, claims))
+	a.So(err, assertions.ShouldBeNil)
+	_, err = authenticate(authenticator, signers[0].sign(t, claims))
+	a.So(errors.Is(err, auth.ErrInvalidCredentials), assertions.ShouldBeTrue)
+
+	// An invalid file keeps the keys.
+	if err := os.WriteFile(path, []byte(`{"keys": [{"kty": "oct"}]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = authenticate(authenticator, signers[2].sign(t, claims))
+	a.So(err, assertions.ShouldBeNil)
+
+	// Invalid files are rejected on creation.
+	_, err = New(path)
+	a.So(err, assertions.ShouldNotBeNil)
+	_, err = New(filepath.Join(t.TempDir(), "missing.json"))
+	a.So(err, assertions.ShouldNotBeNil)
+}
@@ -0,0 +1,33 @@
+// Package mtls authenticates requests with the client certificates of mutual TLS (see the tlsconfig package).
+//
+// The certificate is verified by the TLS handshake, with the client CAs of the server. The subject of the principal is
+// the common name (CN) of the certificate, and its roles are the organizational units (OU), ex: the certificate of
+// `CN=billing,OU=reader` authenticates the `billing` client with the `reader` role.
+package mtls
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/kicodelibrary/go-http-server-2024/pkg/auth"
+)
+
+// Authenticator authenticates requests with the verified client certificate of the connection.
+type Authenticator struct{}
+
+// Authenticate implements auth.Authenticator.
+func (Authenticator) Authenticate(r *http.Request) (*auth.Principal, error) {
+	// The chains are only set if the certificate was verified with the client CAs.
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, auth.ErrNoCredentials
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	if cert.Subject.CommonName == "" {
+		return nil, fmt.Errorf("%w: the client certificate has no common name", auth.ErrInvalidCredentials)
+	}
+	return &auth.Principal{
+		Subject: cert.Subject.CommonName,
+		Method:  "mtls",
+		Roles:   cert.Subject.OrganizationalUnit,
+	}, nil
+}
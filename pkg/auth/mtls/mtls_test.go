@@ -0,0 +1,81 @@
+package mtls_test
+
+import (
+	"crypto/tls"
+	"crypto/x509/pkix"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kicodelibrary/go-http-server-2024/pkg/auth"
+	. "github.com/kicodelibrary/go-http-server-2024/pkg/auth/mtls"
+	"github.com/kicodelibrary/go-http-server-2024/pkg/server/tlsconfig"
+	"github.com/kicodelibrary/go-http-server-2024/pkg/server/tlsconfig/tlsconfigtest"
+	"github.com/smarty/assertions"
+)
+
+func TestAuthenticator(t *testing.T) {
+	a := assertions.New(t)
+	dir := t.TempDir()
+	ca := tlsconfigtest.NewCA(t, "ca")
+	certFile, keyFile := ca.Issue(t, dir, pkix.Name{CommonName: "localhost"}, "127.0.0.1")
+	config, err := tlsconfig.Config{
+		CertFile:     certFile,
+		KeyFile:      keyFile,
+		ClientCAFile: ca.WriteFile(t, dir),
+		ClientAuth:   "optional",
+	}.TLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		principal *auth.Principal
+		authErr   error
+	)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, authErr = Authenticator{}.Authenticate(r)
+	}))
+	// Serve with the configuration as is: httptest.Server.StartTLS would set its own certificate.
+	server.Listener = tls.NewListener(server.Listener, config)
+	server.Start()
+	defer server.Close()
+	url := "https://" + server.Listener.Addr().String()
+
+	// get sends a request with the client certificate, if any.
+	get := func(certificates ...tls.Certificate) {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: ca.Pool(), Certificates: certificates},
+			DisableKeepAlives: true,
+		}}
+		res, err := client.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+
+	// The subject of the principal is the common name, and the roles are the organizational units.
+	clientCert, clientKey := ca.Issue(t, dir, pkix.Name{CommonName: "billing", OrganizationalUnit: []string{"reader", "auditor"}})
+	cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get(cert)
+	a.So(authErr, assertions.ShouldBeNil)
+	a.So(principal, assertions.ShouldResemble, &auth.Principal{Subject: "billing", Method: "mtls", Roles: []string{"reader", "auditor"}})
+
+	// Without a certificate, the other authenticators are tried.
+	get()
+	a.So(errors.Is(authErr, auth.ErrNoCredentials), assertions.ShouldBeTrue)
+
+	// Certificates without a common name are rejected.
+	clientCert, clientKey = ca.Issue(t, dir, pkix.Name{OrganizationalUnit: []string{"reader"}})
+	cert, err = tls.LoadX509KeyPair(clientCert, clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get(cert)
+	a.So(errors.Is(authErr, auth.ErrInvalidCredentials), assertions.ShouldBeTrue)
+}
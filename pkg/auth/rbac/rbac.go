@@ -0,0 +1,101 @@
+// Package rbac authorizes principals with their roles (role-based access control).
+//
+// A policy maps the roles to their permissions, and is loaded from a JSON file. For example:
+//
+//	{
+//		"roles": {
+//			"admin": ["users:read", "users:write", "users:delete"],
+//			"reader": ["users:read"],
+//			"member": ["users:read", "users:write:self"]
+//		}
+//	}
+//
+// The `:self` suffix limits a permission to the resources that the principal owns, ex: `users:write:self` allows
+// the principal to update the user whose ID is its subject, and no other user.
+package rbac
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/kicodelibrary/go-http-server-2024/pkg/auth"
+)
+
+// selfSuffix limits a permission to the own resources of the principal.
+const selfSuffix = ":self"
+
+// permissionFormat is the format of permissions, ex: `users:read`.
+var permissionFormat = regexp.MustCompile(`^[a-z][a-z0-9_-]*(:[a-z][a-z0-9_-]*)+$`)
+
+// scope is the extent of a permission.
+type scope int
+
+const (
+	// scopeSelf grants the permission on the own resources.
+	scopeSelf scope = iota + 1
+	// scopeAll grants the permission on all the resources.
+	scopeAll
+)
+
+// Policy maps roles to permissions. Create policies with Parse or Load.
+type Policy struct {
+	Roles map[string][]string `json:"roles"`
+
+	// grants are the scopes of the permissions by role.
+	grants map[string]map[auth.Permission]scope
+}
+
+// Load loads the policy from a JSON file.
+func Load(path string) (*Policy, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("rbac: could not read policy: %w", err)
+	}
+	return Parse(b)
+}
+
+// Parse parses a JSON policy and checks the permissions.
+func Parse(b []byte) (*Policy, error) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.DisallowUnknownFields() // Catch typos.
+	var p Policy
+	if err := d.Decode(&p); err != nil {
+		return nil, fmt.Errorf("rbac: could not decode policy: %w", err)
+	}
+	p.grants = make(map[string]map[auth.Permission]scope, len(p.Roles))
+	for role, permissions := range p.Roles {
+		grants := make(map[auth.Permission]scope, len(permissions))
+		for _, permission := range permissions {
+			s := scopeAll
+			if name, ok := strings.CutSuffix(permission, selfSuffix); ok {
+				permission, s = name, scopeSelf
+			}
+			if !permissionFormat.MatchString(permission) {
+				return nil, fmt.Errorf("rbac: invalid permission %q of role %q", permission, role)
+			}
+			grants[auth.Permission(permission)] = max(grants[auth.Permission(permission)], s)
+		}
+		p.grants[role] = grants
+	}
+	return &p, nil
+}
+
+// Authorize implements auth.Authorizer. The principal has the permission if one of its roles grants it,
+// or grants it on its own resources and the principal is the owner.
+func (p *Policy) Authorize(principal *auth.Principal, permission auth.Permission, owner string) bool {
+	for _, role := range principal.Roles {
+		switch p.grants[role][permission] {
+		case scopeAll:
+			return true
+		case scopeSelf:
+			if owner != "" && owner == principal.Subject {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,76 @@
+package rbac_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kicodelibrary/go-http-server-2024/pkg/auth"
+	. "github.com/kicodelibrary/go-http-server-2024/pkg/auth/rbac"
+	"github.com/smarty/assertions"
+)
+
+func TestParse(t *testing.T) {
+	for _, tc := range []struct {
+		Name  string
+		JSON  string
+		Valid bool
+	}{
+		{Name: "Empty", JSON: `{}`, Valid: true},
+		{Name: "Roles", JSON: `{"roles": {"admin": ["users:read", "users:write:self", "users:write"]}}`, Valid: true},
+		{Name: "UnknownField", JSON: `{"role": {}}`},
+		{Name: "InvalidPermission", JSON: `{"roles": {"admin": ["users"]}}`},
+		{Name: "Self", JSON: `{"roles": {"admin": [":self"]}}`},
+		{Name: "InvalidJSON", JSON: `{`},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			a := assertions.New(t)
+			_, err := Parse([]byte(tc.JSON))
+			a.So(err == nil, assertions.ShouldEqual, tc.Valid)
+		})
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	a := assertions.New(t)
+	path := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(path, []byte(`{"roles": {
+		"admin": ["users:read", "users:write", "users:delete", "users:write:self"],
+		"reader": ["users:read"],
+		"member": ["users:read", "users:write:self"]
+	}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	admin := &auth.Principal{Subject: "admin", Roles: []string{"admin"}}
+	reader := &auth.Principal{Subject: "reader", Roles: []string{"reader"}}
+	alice := &auth.Principal{Subject: "alice", Roles: []string{"unknown", "member"}}
+	anonymous := &auth.Principal{Subject: "anonymous"}
+	for _, tc := range []struct {
+		Principal  *auth.Principal
+		Permission auth.Permission
+		Owner      string
+		Allowed    bool
+	}{
+		{Principal: admin, Permission: "users:delete", Owner: "bob", Allowed: true},
+		{Principal: admin, Permission: "users:write", Owner: "bob", Allowed: true},
+		{Principal: admin, Permission: "users:write", Allowed: true},
+		{Principal: reader, Permission: "users:read", Allowed: true},
+		{Principal: reader, Permission: "users:write", Owner: "reader"},
+		{Principal: alice, Permission: "users:read", Allowed: true},
+		{Principal: alice, Permission: "users:write", Owner: "alice", Allowed: true},
+		{Principal: alice, Permission: "users:write", Owner: "bob"},
+		{Principal: alice, Permission: "users:write"},
+		{Principal: alice, Permission: "users:delete", Owner: "alice"},
+		{Principal: anonymous, Permission: "users:read"},
+	} {
+		a.So(policy.Authorize(tc.Principal, tc.Permission, tc.Owner), assertions.ShouldEqual, tc.Allowed)
+	}
+
+	_, err = Load(filepath.Join(t.TempDir(), "missing.json"))
+	a.So(err, assertions.ShouldNotBeNil)
+}
@@ -0,0 +1,290 @@
+// Package bolt provides an embedded bbolt key/value implementation of the database interfaces.
+package bolt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/kicodelibrary/go-http-server-2024/api"
+	dbErrors "github.com/kicodelibrary/go-http-server-2024/pkg/database/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Config holds the bbolt configuration.
+type Config struct {
+	Path string
+}
+
+// Buckets.
+var (
+	// usersBucket holds the users.
+	// Keys are user IDs and values are JSON encoded api.User messages.
+	usersBucket = []byte("users")
+	// emailsBucket indexes the users by email, to check that emails are unique.
+	// Keys are emails and values are user IDs.
+	emailsBucket = []byte("emails")
+)
+
+// Users stores users in a bbolt database.
+// bbolt does not support contexts, so the context is checked once a transaction has started,
+// since writers may wait for the single write transaction.
+type Users struct {
+	db *bolt.DB
+}
+
+// NewUsers opens the bbolt database at the given path and creates the buckets if required.
+// The database file is created if it does not exist.
+func NewUsers(path string) (*Users, error) {
+	if path == "" {
+		return nil, fmt.Errorf("bolt: no database path")
+	}
+	// bbolt holds an exclusive lock on the file. Don't block forever if another process has it.
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("bolt: could not open database: %w", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		users, err := tx.CreateBucketIfNotExists(usersBucket)
+		if err != nil {
+			return err
+		}
+		if tx.Bucket(emailsBucket) != nil {
+			return nil
+		}
+		// The index was added after the users bucket, so build it from the existing users.
+		emails, err := tx.CreateBucket(emailsBucket)
+		if err != nil {
+			return err
+		}
+		return users.ForEach(func(k, v []byte) error {
+			var user api.User
+			if err := json.Unmarshal(v, &user); err != nil {
+				return err
+			}
+			if user.Email == "" {
+				return nil
+			}
+			return emails.Put([]byte(user.Email), k)
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("bolt: could not create buckets: %w", err)
+	}
+	return &Users{
+		db: db,
+	}, nil
+}
+
+// List implements database.Users.
+// Keys are sorted by ID, so when sorting by ID the users are read starting from the cursor until the limit.
+// Otherwise, all users are read and sorted in memory.
+func (u *Users) List(ctx context.Context, opts api.ListUsersOptions) ([]api.User, error) {
+	inOrder := opts.Sort.IsDefault()
+	ret := []api.User{} // Initialize.
+	err := u.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(usersBucket).Cursor()
+		k, v := c.First()
+		if inOrder && opts.After != nil {
+			k, v = c.Seek([]byte(opts.After.ID))
+			if k != nil && string(k) == opts.After.ID {
+				k, v = c.Next() // The cursor is exclusive.
+			}
+		}
+		for ; k != nil; k, v = c.Next() {
+			if inOrder && opts.Limit > 0 && len(ret) == opts.Limit {
+				break
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			var user api.User
+			if err := json.Unmarshal(v, &user); err != nil {
+				return err
+			}
+			if inOrder && !opts.Filter.Match(user) {
+				continue
+			}
+			ret = append(ret, user)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !inOrder {
+		ret = opts.Apply(ret)
+	}
+	return ret, nil
+}
+
+// Create implements database.Users.
+func (u *Users) Create(ctx context.Context, user api.User) (api.User, error) {
+	if len(user.Labels) == 0 {
+		user.Labels = nil
+	}
+	user.Version = 1
+	v, err := json.Marshal(user)
+	if err != nil {
+		return api.User{}, err
+	}
+	err = u.db.Update(func(tx *bolt.Tx) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		b := tx.Bucket(usersBucket)
+		if b.Get([]byte(user.ID)) != nil {
+			return dbErrors.ErrUserAlreadyExists
+		}
+		if err := indexEmail(tx.Bucket(emailsBucket), user.ID, "", user.Email); err != nil {
+			return err
+		}
+		return b.Put([]byte(user.ID), v)
+	})
+	if err != nil {
+		return api.User{}, err
+	}
+	return user, nil
+}
+
+// Get implements database.Users.
+// If the user does not exist, this function returns errors.ErrUserNotFound.
+func (u *Users) Get(ctx context.Context, id string) (api.User, error) {
+	var user api.User
+	err := u.db.View(func(tx *bolt.Tx) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var err error
+		user, err = get(tx.Bucket(usersBucket), id)
+		return err
+	})
+	if err != nil {
+		return api.User{}, err
+	}
+	return user, nil
+}
+
+// Update implements database.Users.
+func (u *Users) Update(ctx context.Context, id string, user api.User) (api.User, error) {
+	err := u.db.Update(func(tx *bolt.Tx) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		b := tx.Bucket(usersBucket)
+		stored, err := get(b, id)
+		if err != nil {
+			return err
+		}
+		if user.Version != 0 && user.Version != stored.Version {
+			return dbErrors.ErrVersionMismatch
+		}
+		if err := indexEmail(tx.Bucket(emailsBucket), id, stored.Email, user.Email); err != nil {
+			return err
+		}
+		if len(user.Labels) == 0 {
+			user.Labels = nil
+		}
+		user.CreatedAt = stored.CreatedAt
+		user.Version = stored.Version + 1
+		v, err := json.Marshal(user)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(id), v) // This is a replacement.
+	})
+	if err != nil {
+		return api.User{}, err
+	}
+	return user, nil
+}
+
+// Delete implements database.Users.
+func (u *Users) Delete(ctx context.Context, id string, version uint64) error {
+	return u.db.Update(func(tx *bolt.Tx) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		b := tx.Bucket(usersBucket)
+		stored, err := get(b, id)
+		if err != nil {
+			return err
+		}
+		if version != 0 && version != stored.Version {
+			return dbErrors.ErrVersionMismatch
+		}
+		if err := indexEmail(tx.Bucket(emailsBucket), id, stored.Email, ""); err != nil {
+			return err
+		}
+		return b.Delete([]byte(id))
+	})
+}
+
+// Ping implements database.Pinger. It fails if the database is closed.
+func (u *Users) Ping(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return u.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(usersBucket) == nil {
+			return fmt.Errorf("bolt: no users bucket")
+		}
+		return nil
+	})
+}
+
+// Count implements database.Counter. The number of keys is read from the statistics of the bucket,
+// which does not decode the users.
+func (u *Users) Count(ctx context.Context) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	var n int
+	err := u.db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(usersBucket).Stats().KeyN
+		return nil
+	})
+	return n, err
+}
+
+// Close closes the database.
+func (u *Users) Close() error {
+	return u.db.Close()
+}
+
+// get decodes the user with the given ID from the bucket.
+// If the user does not exist, this function returns errors.ErrUserNotFound.
+func get(b *bolt.Bucket, id string) (api.User, error) {
+	v := b.Get([]byte(id))
+	if v == nil {
+		return api.User{}, dbErrors.ErrUserNotFound
+	}
+	// The value is only valid during the transaction, but json.Unmarshal copies it.
+	var user api.User
+	if err := json.Unmarshal(v, &user); err != nil {
+		return api.User{}, err
+	}
+	return user, nil
+}
+
+// indexEmail moves the user from the old email to the new email in the index.
+// If another user has the new email, this function returns errors.ErrEmailAlreadyExists.
+func indexEmail(b *bolt.Bucket, id, old, new string) error {
+	if old == new {
+		return nil
+	}
+	if new != "" {
+		if other := b.Get([]byte(new)); other != nil && string(other) != id {
+			return dbErrors.ErrEmailAlreadyExists
+		}
+		if err := b.Put([]byte(new), []byte(id)); err != nil {
+			return err
+		}
+	}
+	if old != "" {
+		return b.Delete([]byte(old))
+	}
+	return nil
+}
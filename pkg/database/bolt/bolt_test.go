@@ -0,0 +1,76 @@
+package bolt_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/kicodelibrary/go-http-server-2024/api"
+	"github.com/kicodelibrary/go-http-server-2024/pkg/database"
+	. "github.com/kicodelibrary/go-http-server-2024/pkg/database/bolt"
+	"github.com/kicodelibrary/go-http-server-2024/pkg/database/databasetest"
+	"github.com/smarty/assertions"
+)
+
+func TestUsers(t *testing.T) {
+	databasetest.RunUsersSuite(t, func(t *testing.T) database.Users {
+		users, err := NewUsers(filepath.Join(t.TempDir(), "users.bolt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			users.Close()
+		})
+		return users
+	})
+}
+
+func TestUsersPersistence(t *testing.T) {
+	a := assertions.New(t)
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "users.bolt")
+
+	users, err := NewUsers(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := api.User{
+		ID:   "alice",
+		Name: "Alice",
+		Age:  30,
+	}
+	alice, err = users.Create(ctx, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopen the database and check that the data persisted.
+	if err := users.Close(); err != nil {
+		t.Fatal(err)
+	}
+	users, err = NewUsers(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		users.Close()
+	})
+	list, err := users.List(ctx, api.ListUsersOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.So(list, assertions.ShouldResemble, []api.User{alice})
+}
+
+func TestUsersPingClosed(t *testing.T) {
+	a := assertions.New(t)
+	users, err := NewUsers(filepath.Join(t.TempDir(), "users.bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.So(users.Ping(context.Background()), assertions.ShouldBeNil)
+	if err := users.Close(); err != nil {
+		t.Fatal(err)
+	}
+	a.So(users.Ping(context.Background()), assertions.ShouldNotBeNil)
+}
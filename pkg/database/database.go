@@ -1,14 +1,22 @@
 package database
 
 import (
+	"context"
+
 	"github.com/kicodelibrary/go-http-server-2024/api"
+	"github.com/kicodelibrary/go-http-server-2024/pkg/database/bolt"
 	"github.com/kicodelibrary/go-http-server-2024/pkg/database/errors"
 	"github.com/kicodelibrary/go-http-server-2024/pkg/database/mock"
+	"github.com/kicodelibrary/go-http-server-2024/pkg/database/sqlite"
+	"github.com/kicodelibrary/go-http-server-2024/pkg/database/wal"
 )
 
 // Config holds the database configuration.
 type Config struct {
-	Type string
+	Type   string
+	SQLite sqlite.Config
+	Bolt   bolt.Config
+	WAL    wal.Config
 }
 
 // NewUsers generates an implementation from the configuration.
@@ -16,21 +24,72 @@ func (config Config) NewUsers() (Users, error) {
 	switch config.Type {
 	case "mock":
 		return mock.NewUsers(), nil
+	case "sqlite":
+		users, err := sqlite.NewUsers(config.SQLite.Path)
+		if err != nil {
+			return nil, err
+		}
+		return users, nil
+	case "bolt":
+		users, err := bolt.NewUsers(config.Bolt.Path)
+		if err != nil {
+			return nil, err
+		}
+		return users, nil
+	case "wal":
+		users, err := wal.NewUsers(config.WAL)
+		if err != nil {
+			return nil, err
+		}
+		return users, nil
 	default:
 		return nil, errors.ErrInvalidDatabaseType
 	}
 }
 
 // Users is the interface that wraps the basic user database operations.
+// Create, Update and Delete are atomic, so callers must not check for existence beforehand.
+// All operations stop early and return the context error when the context is cancelled or its deadline passes.
+//
+// The database manages the version of users: it is 1 on creation and incremented on every update.
+// Update and Delete compare and swap on the version, so that concurrent changes are not lost.
+//
+// Emails are unique: Create and Update return errors.ErrEmailAlreadyExists if another user has the same non-empty email.
+// The timestamps are set by the caller, except that Update keeps the creation time of the stored user.
+// Empty labels are stored as nil.
 type Users interface {
-	// List lists all users.
-	List() ([]api.User, error)
-	// Create creates a new user.
-	Create(user api.User) error
+	// List lists users with the given options (see api.ListUsersOptions).
+	List(ctx context.Context, opts api.ListUsersOptions) ([]api.User, error)
+	// Create creates a new user and returns the stored user. The version of the given user is ignored.
+	// If a user with the same ID exists, it returns errors.ErrUserAlreadyExists.
+	// This is checked before the email.
+	Create(ctx context.Context, user api.User) (api.User, error)
 	// Get gets a single user with the given ID.
-	Get(id string) (api.User, error)
-	// Update updates a user.
-	Update(id string, user api.User) error
-	// Delete deletes a user.
-	Delete(id string) error
+	// If the user does not exist, it returns errors.ErrUserNotFound.
+	Get(ctx context.Context, id string) (api.User, error)
+	// Update replaces an existing user and returns the stored user.
+	// If the version of the given user is not zero, the stored version must be equal, otherwise it returns errors.ErrVersionMismatch.
+	// If the user does not exist, it returns errors.ErrUserNotFound.
+	Update(ctx context.Context, id string, user api.User) (api.User, error)
+	// Delete deletes an existing user.
+	// If the version is not zero, the stored version must be equal, otherwise it returns errors.ErrVersionMismatch.
+	// If the user does not exist, it returns errors.ErrUserNotFound.
+	Delete(ctx context.Context, id string, version uint64) error
+	// Close releases the resources of the database, ex: flushes and closes files.
+	// It is called once, after all the other operations have returned.
+	Close() error
+}
+
+// Pinger is implemented by the databases that can check that they are usable, ex: that the connection is alive
+// or that the files are open. It is optional: use a type assertion on Users.
+type Pinger interface {
+	// Ping returns nil if the database can serve requests.
+	Ping(ctx context.Context) error
+}
+
+// Counter is implemented by the databases that can count the users without listing them.
+// It is optional: use a type assertion on Users.
+type Counter interface {
+	// Count returns the number of users.
+	Count(ctx context.Context) (int, error)
 }
@@ -0,0 +1,728 @@
+// Package databasetest provides a conformance test suite for implementations of the database interfaces.
+//
+// Each implementation should run the suite from its tests:
+//
+//	func TestUsers(t *testing.T) {
+//		databasetest.RunUsersSuite(t, func(t *testing.T) database.Users {
+//			return NewUsers()
+//		})
+//	}
+package databasetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kicodelibrary/go-http-server-2024/api"
+	"github.com/kicodelibrary/go-http-server-2024/pkg/database"
+	dbErrors "github.com/kicodelibrary/go-http-server-2024/pkg/database/errors"
+	"github.com/smarty/assertions"
+)
+
+// UsersFactory returns a new, empty users database.
+// Use t.Cleanup to release any resources held by the database.
+type UsersFactory func(t *testing.T) database.Users
+
+// Test users. They have the version of newly created users, so that they can be compared to stored users.
+var (
+	alice = api.User{
+		ID:      "alice",
+		Name:    "Alice",
+		Age:     30,
+		Version: 1,
+	}
+	bob = api.User{
+		ID:      "bob",
+		Name:    "Bob",
+		Age:     25,
+		Version: 1,
+	}
+	charlie = api.User{
+		ID:      "charlie",
+		Name:    "Charlie",
+		Age:     40,
+		Version: 1,
+	}
+)
+
+// RunUsersSuite runs the conformance tests for database.Users.
+// Each test gets a new database from the factory.
+func RunUsersSuite(t *testing.T, factory UsersFactory) {
+	for _, tc := range []struct {
+		Name string
+		Func func(t *testing.T, users database.Users)
+	}{
+		{Name: "Empty", Func: testEmpty},
+		{Name: "CRUD", Func: testCRUD},
+		{Name: "NotFound", Func: testNotFound},
+		{Name: "AlreadyExists", Func: testAlreadyExists},
+		{Name: "UpdateReplaces", Func: testUpdateReplaces},
+		{Name: "DeleteTwice", Func: testDeleteTwice},
+		{Name: "Versions", Func: testVersions},
+		{Name: "VersionMismatch", Func: testVersionMismatch},
+		{Name: "Fields", Func: testFields},
+		{Name: "EmailUnique", Func: testEmailUnique},
+		{Name: "List", Func: testList},
+		{Name: "ListPagination", Func: testListPagination},
+		{Name: "ListFilter", Func: testListFilter},
+		{Name: "ListNamePrefixUnicode", Func: testListNamePrefixUnicode},
+		{Name: "ListSort", Func: testListSort},
+		{Name: "Cancelled", Func: testCancelled},
+		{Name: "Ping", Func: testPing},
+		{Name: "Count", Func: testCount},
+		{Name: "Concurrent", Func: testConcurrent},
+		{Name: "ConcurrentCreate", Func: testConcurrentCreate},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			tc.Func(t, factory(t))
+		})
+	}
+}
+
+// list lists the users with the given options.
+func list(t *testing.T, users database.Users, opts api.ListUsersOptions) []api.User {
+	t.Helper()
+	ret, err := users.List(context.Background(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ret
+}
+
+// create creates the users and fails the test on error.
+func create(t *testing.T, users database.Users, list ...api.User) {
+	t.Helper()
+	for _, user := range list {
+		if _, err := users.Create(context.Background(), user); err != nil {
+			t.Fatalf("could not create user %s: %v", user.ID, err)
+		}
+	}
+}
+
+func testEmpty(t *testing.T, users database.Users) {
+	a := assertions.New(t)
+	ret, err := users.List(context.Background(), api.ListUsersOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An empty list must not be nil, so that it is marshaled as `[]`.
+	a.So(ret, assertions.ShouldNotBeNil)
+	a.So(ret, assertions.ShouldBeEmpty)
+}
+
+func testCRUD(t *testing.T, users database.Users) {
+	a := assertions.New(t)
+	ctx := context.Background()
+
+	create(t, users, alice)
+	user, err := users.Get(ctx, alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.So(user, assertions.ShouldResemble, alice)
+
+	updated := alice
+	updated.Name = "Alice Smith"
+	ret, err := users.Update(ctx, alice.ID, updated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updated.Version = 2
+	a.So(ret, assertions.ShouldResemble, updated)
+	user, err = users.Get(ctx, alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.So(user, assertions.ShouldResemble, updated)
+
+	if err := users.Delete(ctx, alice.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+	_, err = users.Get(ctx, alice.ID)
+	a.So(errors.Is(err, dbErrors.ErrUserNotFound), assertions.ShouldBeTrue)
+}
+
+func testNotFound(t *testing.T, users database.Users) {
+	a := assertions.New(t)
+	ctx := context.Background()
+
+	_, err := users.Get(ctx, alice.ID)
+	a.So(errors.Is(err, dbErrors.ErrUserNotFound), assertions.ShouldBeTrue)
+	_, err = users.Update(ctx, alice.ID, alice)
+	a.So(errors.Is(err, dbErrors.ErrUserNotFound), assertions.ShouldBeTrue)
+	err = users.Delete(ctx, alice.ID, 0)
+	a.So(errors.Is(err, dbErrors.ErrUserNotFound), assertions.ShouldBeTrue)
+
+	// A failed update must not create the user.
+	a.So(list(t, users, api.ListUsersOptions{}), assertions.ShouldBeEmpty)
+}
+
+func testAlreadyExists(t *testing.T, users database.Users) {
+	a := assertions.New(t)
+
+	create(t, users, alice)
+	duplicate := alice
+	duplicate.Name = "Someone Else"
+	_, err := users.Create(context.Background(), duplicate)
+	a.So(errors.Is(err, dbErrors.ErrUserAlreadyExists), assertions.ShouldBeTrue)
+
+	// The existing user is unchanged.
+	a.So(list(t, users, api.ListUsersOptions{}), assertions.ShouldResemble, []api.User{alice})
+}
+
+func testUpdateReplaces(t *testing.T, users database.Users) {
+	a := assertions.New(t)
+	ctx := context.Background()
+
+	create(t, users, alice, bob)
+
+	// Update replaces the whole user and does not touch other users.
+	replacement := api.User{
+		ID:   alice.ID,
+		Name: "A",
+	}
+	if _, err := users.Update(ctx, alice.ID, replacement); err != nil {
+		t.Fatal(err)
+	}
+	replacement.Version = 2
+	a.So(list(t, users, api.ListUsersOptions{}), assertions.ShouldResemble, []api.User{replacement, bob})
+}
+
+func testDeleteTwice(t *testing.T, users database.Users) {
+	a := assertions.New(t)
+	ctx := context.Background()
+
+	create(t, users, alice, bob)
+	if err := users.Delete(ctx, alice.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+	err := users.Delete(ctx, alice.ID, 0)
+	a.So(errors.Is(err, dbErrors.ErrUserNotFound), assertions.ShouldBeTrue)
+
+	// Deleting again has no other effect.
+	a.So(list(t, users, api.ListUsersOptions{}), assertions.ShouldResemble, []api.User{bob})
+}
+
+func testVersions(t *testing.T, users database.Users) {
+	a := assertions.New(t)
+	ctx := context.Background()
+
+	// The version given to Create is ignored.
+	user := alice
+	user.Version = 42
+	created, err := users.Create(ctx, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.So(created, assertions.ShouldResemble, alice)
+
+	// Each update increments the version, whether it is conditional or not.
+	for i, version := range []uint64{0, 2, 0, 4} {
+		user.Age++
+		user.Version = version
+		updated, err := users.Update(ctx, alice.ID, user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a.So(updated.Version, assertions.ShouldEqual, i+2)
+		a.So(updated.Age, assertions.ShouldEqual, user.Age)
+	}
+	got, err := users.Get(ctx, alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.So(got.Version, assertions.ShouldEqual, 5)
+
+	// A conditional delete succeeds with the current version.
+	a.So(users.Delete(ctx, alice.ID, 5), assertions.ShouldBeNil)
+}
+
+func testVersionMismatch(t *testing.T, users database.Users) {
+	a := assertions.New(t)
+	ctx := context.Background()
+
+	create(t, users, alice)
+	stale := alice
+	stale.Name = "Alice Smith"
+	stale.Version = 2
+	_, err := users.Update(ctx, alice.ID, stale)
+	a.So(errors.Is(err, dbErrors.ErrVersionMismatch), assertions.ShouldBeTrue)
+	err = users.Delete(ctx, alice.ID, 2)
+	a.So(errors.Is(err, dbErrors.ErrVersionMismatch), assertions.ShouldBeTrue)
+
+	// Nothing was changed.
+	a.So(list(t, users, api.ListUsersOptions{}), assertions.ShouldResemble, []api.User{alice})
+
+	// A missing user is reported as such, regardless of the version.
+	_, err = users.Update(ctx, bob.ID, bob)
+	a.So(errors.Is(err, dbErrors.ErrUserNotFound), assertions.ShouldBeTrue)
+	err = users.Delete(ctx, bob.ID, 1)
+	a.So(errors.Is(err, dbErrors.ErrUserNotFound), assertions.ShouldBeTrue)
+}
+
+func testFields(t *testing.T, users database.Users) {
+	a := assertions.New(t)
+	ctx := context.Background()
+
+	created := time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC)
+	user := api.User{
+		ID:        "alice",
+		Name:      "Alice",
+		Age:       30,
+		Email:     "alice@example.com",
+		Status:    api.UserStatusSuspended,
+		Labels:    map[string]string{"team": "blue", "tier": ""},
+		CreatedAt: created,
+		UpdatedAt: created,
+	}
+	stored, err := users.Create(ctx, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.Version = 1
+	a.So(stored, assertions.ShouldResemble, user)
+	got, err := users.Get(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.So(got, assertions.ShouldResemble, user)
+
+	// Update keeps the creation time, and empty labels are nil.
+	update := user
+	update.Status = api.UserStatusActive
+	update.Labels = map[string]string{}
+	update.CreatedAt = created.Add(time.Hour)
+	update.UpdatedAt = created.Add(2 * time.Hour)
+	stored, err = users.Update(ctx, user.ID, update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	update.Labels = nil
+	update.CreatedAt = created
+	update.Version = 2
+	a.So(stored, assertions.ShouldResemble, update)
+	a.So(list(t, users, api.ListUsersOptions{}), assertions.ShouldResemble, []api.User{update})
+}
+
+func testEmailUnique(t *testing.T, users database.Users) {
+	a := assertions.New(t)
+	ctx := context.Background()
+
+	// Users without email do not conflict.
+	create(t, users, alice, bob)
+
+	// withEmail returns an unconditional update of the user with the email.
+	withEmail := func(user api.User, email string) api.User {
+		user.Email = email
+		user.Version = 0
+		return user
+	}
+	if _, err := users.Update(ctx, alice.ID, withEmail(alice, "alice@example.com")); err != nil {
+		t.Fatal(err)
+	}
+	_, err := users.Create(ctx, withEmail(charlie, "alice@example.com"))
+	a.So(errors.Is(err, dbErrors.ErrEmailAlreadyExists), assertions.ShouldBeTrue)
+	_, err = users.Update(ctx, bob.ID, withEmail(bob, "alice@example.com"))
+	a.So(errors.Is(err, dbErrors.ErrEmailAlreadyExists), assertions.ShouldBeTrue)
+
+	// A user can keep its own email.
+	if _, err := users.Update(ctx, alice.ID, withEmail(alice, "alice@example.com")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The ID is checked before the email.
+	_, err = users.Create(ctx, withEmail(alice, "alice@example.com"))
+	a.So(errors.Is(err, dbErrors.ErrUserAlreadyExists), assertions.ShouldBeTrue)
+
+	// Changing the email frees the old one.
+	if _, err := users.Update(ctx, alice.ID, withEmail(alice, "alice@example.org")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := users.Update(ctx, bob.ID, withEmail(bob, "alice@example.com")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Deleting the user frees the email.
+	if err := users.Delete(ctx, alice.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := users.Create(ctx, withEmail(charlie, "alice@example.org")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testList(t *testing.T, users database.Users) {
+	a := assertions.New(t)
+
+	// Users are listed in ID order, regardless of the order of creation.
+	create(t, users, charlie, alice, bob)
+	a.So(list(t, users, api.ListUsersOptions{}), assertions.ShouldResemble, []api.User{alice, bob, charlie})
+}
+
+func testListPagination(t *testing.T, users database.Users) {
+	a := assertions.New(t)
+
+	create(t, users, charlie, alice, bob)
+	for _, tc := range []struct {
+		Name     string
+		Options  api.ListUsersOptions
+		Expected []api.User
+	}{
+		{
+			Name:     "Limit",
+			Options:  api.ListUsersOptions{Limit: 2},
+			Expected: []api.User{alice, bob},
+		},
+		{
+			Name:     "LimitAboveCount",
+			Options:  api.ListUsersOptions{Limit: 10},
+			Expected: []api.User{alice, bob, charlie},
+		},
+		{
+			Name:     "After",
+			Options:  api.ListUsersOptions{After: &alice},
+			Expected: []api.User{bob, charlie},
+		},
+		{
+			Name:     "AfterAndLimit",
+			Options:  api.ListUsersOptions{After: &alice, Limit: 1},
+			Expected: []api.User{bob},
+		},
+		{
+			// The cursor does not need to exist, for ex: if it was deleted since the previous page.
+			Name:     "AfterMissing",
+			Options:  api.ListUsersOptions{After: &api.User{ID: "b"}},
+			Expected: []api.User{bob, charlie},
+		},
+		{
+			Name:     "AfterLast",
+			Options:  api.ListUsersOptions{After: &charlie},
+			Expected: []api.User{},
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			a.So(list(t, users, tc.Options), assertions.ShouldResemble, tc.Expected)
+		})
+	}
+}
+
+// intPtr returns a pointer to the integer.
+func intPtr(i int) *int {
+	return &i
+}
+
+func testListFilter(t *testing.T, users database.Users) {
+	a := assertions.New(t)
+
+	alex := api.User{
+		ID:      "alex",
+		Name:    "Alex",
+		Age:     18,
+		Version: 1,
+	}
+	lowercase := api.User{
+		ID:      "lower",
+		Name:    "alfred",
+		Age:     30,
+		Version: 1,
+	}
+	create(t, users, alice, bob, charlie, alex, lowercase)
+	for _, tc := range []struct {
+		Name     string
+		Filter   api.UserFilter
+		Expected []api.User
+	}{
+		{
+			Name:     "None",
+			Expected: []api.User{alex, alice, bob, charlie, lowercase},
+		},
+		{
+			Name:     "AgeGTE",
+			Filter:   api.UserFilter{AgeGTE: intPtr(30)},
+			Expected: []api.User{alice, charlie, lowercase},
+		},
+		{
+			Name:     "AgeGT",
+			Filter:   api.UserFilter{AgeGT: intPtr(30)},
+			Expected: []api.User{charlie},
+		},
+		{
+			Name:     "AgeLTE",
+			Filter:   api.UserFilter{AgeLTE: intPtr(25)},
+			Expected: []api.User{alex, bob},
+		},
+		{
+			Name:     "AgeRange",
+			Filter:   api.UserFilter{AgeGTE: intPtr(25), AgeLT: intPtr(40)},
+			Expected: []api.User{alice, bob, lowercase},
+		},
+		{
+			// The prefix is case sensitive.
+			Name:     "NamePrefix",
+			Filter:   api.UserFilter{NamePrefix: "Al"},
+			Expected: []api.User{alex, alice},
+		},
+		{
+			Name:     "NamePrefixAndAge",
+			Filter:   api.UserFilter{NamePrefix: "Al", AgeGTE: intPtr(20)},
+			Expected: []api.User{alice},
+		},
+		{
+			Name:     "NoMatch",
+			Filter:   api.UserFilter{NamePrefix: "Zed"},
+			Expected: []api.User{},
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			a.So(list(t, users, api.ListUsersOptions{Filter: tc.Filter}), assertions.ShouldResemble, tc.Expected)
+		})
+	}
+}
+
+// testListNamePrefixUnicode tests that the name prefix matches bytes, like strings.HasPrefix, even if it ends in the
+// middle of a multi-byte character.
+func testListNamePrefixUnicode(t *testing.T, users database.Users) {
+	a := assertions.New(t)
+
+	zoe := api.User{ID: "zoe", Name: "Zoe", Age: 30, Version: 1}
+	zoeAcute := api.User{ID: "zoe-acute", Name: "Zoé", Age: 30, Version: 1}
+	zoeDiaeresis := api.User{ID: "zoe-diaeresis", Name: "Zoë", Age: 30, Version: 1}
+	zoelle := api.User{ID: "zoelle", Name: "Zoëlle", Age: 30, Version: 1}
+	create(t, users, zoe, zoeAcute, zoeDiaeresis, zoelle)
+	for _, tc := range []struct {
+		Name     string
+		Prefix   string
+		Expected []api.User
+	}{
+		{Name: "Rune", Prefix: "Zoë", Expected: []api.User{zoeDiaeresis, zoelle}},
+		{Name: "PartialRune", Prefix: "Zo\xc3", Expected: []api.User{zoeAcute, zoeDiaeresis, zoelle}},
+		{Name: "InvalidUTF8", Prefix: "Zo\xff", Expected: []api.User{}},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			a.So(list(t, users, api.ListUsersOptions{Filter: api.UserFilter{NamePrefix: tc.Prefix}}), assertions.ShouldResemble, tc.Expected)
+		})
+	}
+}
+
+func testListSort(t *testing.T, users database.Users) {
+	a := assertions.New(t)
+
+	// Dave and Alice have the same age, so the ID breaks ties.
+	dave := api.User{
+		ID:      "dave",
+		Name:    "Dave",
+		Age:     30,
+		Version: 1,
+	}
+	create(t, users, alice, bob, charlie, dave)
+	for _, tc := range []struct {
+		Name     string
+		Sort     api.UserSort
+		Expected []api.User
+	}{
+		{
+			Name:     "ID",
+			Sort:     api.UserSort{{Field: api.SortByID}},
+			Expected: []api.User{alice, bob, charlie, dave},
+		},
+		{
+			Name:     "IDDesc",
+			Sort:     api.UserSort{{Field: api.SortByID, Desc: true}},
+			Expected: []api.User{dave, charlie, bob, alice},
+		},
+		{
+			Name:     "Age",
+			Sort:     api.UserSort{{Field: api.SortByAge}},
+			Expected: []api.User{bob, alice, dave, charlie},
+		},
+		{
+			Name:     "AgeDescName",
+			Sort:     api.UserSort{{Field: api.SortByAge, Desc: true}, {Field: api.SortByName}},
+			Expected: []api.User{charlie, alice, dave, bob},
+		},
+		{
+			Name:     "AgeNameDesc",
+			Sort:     api.UserSort{{Field: api.SortByAge}, {Field: api.SortByName, Desc: true}},
+			Expected: []api.User{bob, dave, alice, charlie},
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			a.So(list(t, users, api.ListUsersOptions{Sort: tc.Sort}), assertions.ShouldResemble, tc.Expected)
+
+			// Paginating one user at a time gives the same order.
+			var (
+				paged []api.User
+				after *api.User
+			)
+			for i := 0; i <= len(tc.Expected); i++ {
+				page := list(t, users, api.ListUsersOptions{Sort: tc.Sort, Limit: 1, After: after})
+				if len(page) == 0 {
+					break
+				}
+				paged = append(paged, page[0])
+				after = &page[0]
+			}
+			a.So(paged, assertions.ShouldResemble, tc.Expected)
+		})
+	}
+}
+
+func testCancelled(t *testing.T, users database.Users) {
+	a := assertions.New(t)
+	create(t, users, alice)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := users.List(ctx, api.ListUsersOptions{})
+	a.So(errors.Is(err, context.Canceled), assertions.ShouldBeTrue)
+	_, err = users.Get(ctx, alice.ID)
+	a.So(errors.Is(err, context.Canceled), assertions.ShouldBeTrue)
+	_, err = users.Create(ctx, bob)
+	a.So(errors.Is(err, context.Canceled), assertions.ShouldBeTrue)
+	updated := alice
+	updated.Age++
+	_, err = users.Update(ctx, alice.ID, updated)
+	a.So(errors.Is(err, context.Canceled), assertions.ShouldBeTrue)
+	err = users.Delete(ctx, alice.ID, 0)
+	a.So(errors.Is(err, context.Canceled), assertions.ShouldBeTrue)
+
+	// Nothing was changed.
+	a.So(list(t, users, api.ListUsersOptions{}), assertions.ShouldResemble, []api.User{alice})
+}
+
+// testPing tests the optional database.Pinger interface.
+func testPing(t *testing.T, users database.Users) {
+	a := assertions.New(t)
+	pinger, ok := users.(database.Pinger)
+	if !ok {
+		t.Skip("the database does not implement database.Pinger")
+	}
+	a.So(pinger.Ping(context.Background()), assertions.ShouldBeNil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	a.So(errors.Is(pinger.Ping(ctx), context.Canceled), assertions.ShouldBeTrue)
+}
+
+// testCount tests the optional database.Counter interface.
+func testCount(t *testing.T, users database.Users) {
+	a := assertions.New(t)
+	ctx := context.Background()
+	counter, ok := users.(database.Counter)
+	if !ok {
+		t.Skip("the database does not implement database.Counter")
+	}
+	n, err := counter.Count(ctx)
+	a.So(err, assertions.ShouldBeNil)
+	a.So(n, assertions.ShouldEqual, 0)
+
+	for _, user := range []api.User{alice, bob, charlie} {
+		if _, err := users.Create(ctx, user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := users.Delete(ctx, bob.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+	n, err = counter.Count(ctx)
+	a.So(err, assertions.ShouldBeNil)
+	a.So(n, assertions.ShouldEqual, 2)
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = counter.Count(cancelled)
+	a.So(errors.Is(err, context.Canceled), assertions.ShouldBeTrue)
+}
+
+func testConcurrent(t *testing.T, users database.Users) {
+	a := assertions.New(t)
+	ctx := context.Background()
+
+	const (
+		workers = 8
+		rounds  = 20
+	)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < rounds; j++ {
+				user := api.User{
+					ID:   fmt.Sprintf("user%dx%d", i, j),
+					Name: "User",
+					Age:  j,
+				}
+				user, err := users.Create(ctx, user)
+				if err != nil {
+					t.Errorf("could not create user: %v", err)
+					return
+				}
+				user.Age++
+				if user, err = users.Update(ctx, user.ID, user); err != nil {
+					t.Errorf("could not update user: %v", err)
+					return
+				}
+				if _, err := users.List(ctx, api.ListUsersOptions{}); err != nil {
+					t.Errorf("could not list users: %v", err)
+					return
+				}
+				got, err := users.Get(ctx, user.ID)
+				if err != nil {
+					t.Errorf("could not get user: %v", err)
+					return
+				}
+				if !reflect.DeepEqual(got, user) {
+					t.Errorf("unexpected user: %+v", got)
+				}
+				// Keep every other user.
+				if j%2 == 0 {
+					continue
+				}
+				if err := users.Delete(ctx, user.ID, user.Version); err != nil {
+					t.Errorf("could not delete user: %v", err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	a.So(list(t, users, api.ListUsersOptions{}), assertions.ShouldHaveLength, workers*rounds/2)
+}
+
+func testConcurrentCreate(t *testing.T, users database.Users) {
+	a := assertions.New(t)
+	ctx := context.Background()
+
+	const workers = 16
+	var (
+		wg      sync.WaitGroup
+		created atomic.Int32
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := users.Create(ctx, alice)
+			switch {
+			case err == nil:
+				created.Add(1)
+			case errors.Is(err, dbErrors.ErrUserAlreadyExists):
+			default:
+				t.Errorf("could not create user: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Exactly one creation succeeds.
+	a.So(created.Load(), assertions.ShouldEqual, 1)
+	a.So(list(t, users, api.ListUsersOptions{}), assertions.ShouldResemble, []api.User{alice})
+}
@@ -4,5 +4,8 @@ import "errors"
 
 var (
 	ErrUserNotFound        = errors.New("user not found")
+	ErrUserAlreadyExists   = errors.New("user already exists")
+	ErrEmailAlreadyExists  = errors.New("email already exists")
+	ErrVersionMismatch     = errors.New("user version mismatch")
 	ErrInvalidDatabaseType = errors.New("invalid database type")
 )
@@ -2,12 +2,18 @@
 package mock
 
 import (
+	"context"
+	"maps"
+	"sync"
+
 	"github.com/kicodelibrary/go-http-server-2024/api"
 	"github.com/kicodelibrary/go-http-server-2024/pkg/database/errors"
 )
 
 // Users mocks users.
+// It is safe for concurrent use.
 type Users struct {
+	mu    sync.RWMutex
 	users map[string]api.User
 }
 
@@ -19,39 +25,132 @@ func NewUsers() *Users {
 }
 
 // List implements database.Users.
-func (u Users) List() ([]api.User, error) {
+func (u *Users) List(ctx context.Context, opts api.ListUsersOptions) ([]api.User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	u.mu.RLock()
+	defer u.mu.RUnlock()
 	ret := []api.User{} // Initialize.
 	for _, user := range u.users {
-		ret = append(ret, user)
+		ret = append(ret, clone(user))
 	}
-	return ret, nil
+	return opts.Apply(ret), nil
 }
 
 // Create implements database.Users.
-func (u Users) Create(user api.User) error {
+func (u *Users) Create(ctx context.Context, user api.User) (api.User, error) {
+	if err := ctx.Err(); err != nil {
+		return api.User{}, err
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if _, ok := u.users[user.ID]; ok {
+		return api.User{}, errors.ErrUserAlreadyExists
+	}
+	if u.emailTaken(user.ID, user.Email) {
+		return api.User{}, errors.ErrEmailAlreadyExists
+	}
+	user = clone(user)
+	user.Version = 1
 	u.users[user.ID] = user
-	return nil
+	return clone(user), nil
 }
 
 // Get implements database.Users.
 // If user exists, there is no error.
-// If user does not exists this function returns database.ErrUserNotFound.
-func (u Users) Get(id string) (api.User, error) {
+// If user does not exists this function returns errors.ErrUserNotFound.
+func (u *Users) Get(ctx context.Context, id string) (api.User, error) {
+	if err := ctx.Err(); err != nil {
+		return api.User{}, err
+	}
+	u.mu.RLock()
+	defer u.mu.RUnlock()
 	user, ok := u.users[id]
 	if !ok {
 		return api.User{}, errors.ErrUserNotFound
 	}
-	return user, nil
+	return clone(user), nil
 }
 
 // Update implements database.Users.
-func (u Users) Update(id string, user api.User) error {
+func (u *Users) Update(ctx context.Context, id string, user api.User) (api.User, error) {
+	if err := ctx.Err(); err != nil {
+		return api.User{}, err
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	stored, ok := u.users[id]
+	if !ok {
+		return api.User{}, errors.ErrUserNotFound
+	}
+	if user.Version != 0 && user.Version != stored.Version {
+		return api.User{}, errors.ErrVersionMismatch
+	}
+	if u.emailTaken(id, user.Email) {
+		return api.User{}, errors.ErrEmailAlreadyExists
+	}
+	user = clone(user)
+	user.CreatedAt = stored.CreatedAt
+	user.Version = stored.Version + 1
 	u.users[id] = user // This is a replacement.
-	return nil
+	return clone(user), nil
 }
 
 // Delete implements database.Users.
-func (u Users) Delete(id string) error {
+func (u *Users) Delete(ctx context.Context, id string, version uint64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	stored, ok := u.users[id]
+	if !ok {
+		return errors.ErrUserNotFound
+	}
+	if version != 0 && version != stored.Version {
+		return errors.ErrVersionMismatch
+	}
 	delete(u.users, id)
 	return nil
 }
+
+// Count implements database.Counter.
+func (u *Users) Count(ctx context.Context) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return len(u.users), nil
+}
+
+// Close implements database.Users. There is nothing to close in memory.
+func (u *Users) Close() error {
+	return nil
+}
+
+// emailTaken returns true if a user other than id has the email.
+// The lock must be held.
+func (u *Users) emailTaken(id, email string) bool {
+	if email == "" {
+		return false
+	}
+	for otherID, other := range u.users {
+		if otherID != id && other.Email == email {
+			return true
+		}
+	}
+	return false
+}
+
+// clone returns a copy of the user that does not share the labels, so that callers cannot modify stored users.
+// Empty labels are nil.
+func clone(user api.User) api.User {
+	if len(user.Labels) == 0 {
+		user.Labels = nil
+	} else {
+		user.Labels = maps.Clone(user.Labels)
+	}
+	return user
+}
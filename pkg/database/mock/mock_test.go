@@ -0,0 +1,15 @@
+package mock_test
+
+import (
+	"testing"
+
+	"github.com/kicodelibrary/go-http-server-2024/pkg/database"
+	"github.com/kicodelibrary/go-http-server-2024/pkg/database/databasetest"
+	. "github.com/kicodelibrary/go-http-server-2024/pkg/database/mock"
+)
+
+func TestUsers(t *testing.T) {
+	databasetest.RunUsersSuite(t, func(t *testing.T) database.Users {
+		return NewUsers()
+	})
+}
@@ -0,0 +1,448 @@
+// Package sqlite provides a SQLite implementation of the database interfaces.
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/kicodelibrary/go-http-server-2024/api"
+	dbErrors "github.com/kicodelibrary/go-http-server-2024/pkg/database/errors"
+	"github.com/mattn/go-sqlite3" // This also registers the `sqlite3` driver.
+)
+
+// Config holds the SQLite configuration.
+type Config struct {
+	Path string
+}
+
+// migrations are the schema changes that are applied on startup, in order.
+// The number of applied migrations is stored in the `user_version` pragma of the database.
+// Never edit a migration that has been released; append a new one instead.
+var migrations = []string{
+	`CREATE TABLE users (
+		id   TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		age  INTEGER NOT NULL
+	)`,
+	// Indexes for filtering and sorting. The ID makes the order total, see List.
+	`CREATE INDEX users_age ON users (age, id);
+	CREATE INDEX users_name ON users (name, id)`,
+	// The version for optimistic concurrency control.
+	`ALTER TABLE users ADD COLUMN version INTEGER NOT NULL DEFAULT 1`,
+	// Email, status, labels (JSON) and timestamps (RFC 3339, UTC). Empty emails are not unique.
+	`ALTER TABLE users ADD COLUMN email TEXT NOT NULL DEFAULT '';
+	ALTER TABLE users ADD COLUMN status TEXT NOT NULL DEFAULT 'active';
+	ALTER TABLE users ADD COLUMN labels TEXT NOT NULL DEFAULT 'null';
+	ALTER TABLE users ADD COLUMN created_at TEXT NOT NULL DEFAULT '';
+	ALTER TABLE users ADD COLUMN updated_at TEXT NOT NULL DEFAULT '';
+	CREATE UNIQUE INDEX users_email ON users (email) WHERE email != ''`,
+}
+
+// userColumns are the columns of a user, in the order of scanUser and userValues.
+const userColumns = `id, name, age, email, status, labels, created_at, updated_at, version`
+
+// Users stores users in a SQLite database.
+type Users struct {
+	db *sql.DB
+}
+
+// NewUsers opens the SQLite database at the given path and creates the schema if required.
+// The database file is created if it does not exist.
+func NewUsers(path string) (*Users, error) {
+	if path == "" {
+		return nil, fmt.Errorf("sqlite: no database path")
+	}
+	// Enable the write-ahead log so that readers do not block the writer,
+	// and wait on locks instead of failing immediately.
+	// Transactions take the write lock immediately, so that reads in write transactions are not stale.
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?_journal_mode=WAL&_busy_timeout=5000&_foreign_keys=on&_txlock=immediate", path))
+	if err != nil {
+		return nil, fmt.Errorf("sqlite: could not open database: %w", err)
+	}
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Users{
+		db: db,
+	}, nil
+}
+
+// migrate applies the migrations that have not been applied yet.
+func migrate(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return fmt.Errorf("sqlite: could not read schema version: %w", err)
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("sqlite: schema version %d is newer than supported version %d", version, len(migrations))
+	}
+	for i := version; i < len(migrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("sqlite: could not begin migration: %w", err)
+		}
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("sqlite: could not apply migration %d: %w", i+1, err)
+		}
+		// Pragmas do not support placeholders.
+		if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, i+1)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("sqlite: could not set schema version: %w", err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("sqlite: could not commit migration %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// columns maps the sort fields to columns.
+var columns = map[string]string{
+	api.SortByID:   "id",
+	api.SortByName: "name",
+	api.SortByAge:  "age",
+}
+
+// List implements database.Users.
+// The filter, sort order and cursor are translated to SQL so that the indexes can be used.
+func (u *Users) List(ctx context.Context, opts api.ListUsersOptions) ([]api.User, error) {
+	var (
+		where []string
+		args  []any
+	)
+
+	// Filter.
+	f := opts.Filter
+	for _, c := range []struct {
+		Op    string
+		Value *int
+	}{
+		{Op: ">=", Value: f.AgeGTE},
+		{Op: ">", Value: f.AgeGT},
+		{Op: "<=", Value: f.AgeLTE},
+		{Op: "<", Value: f.AgeLT},
+	} {
+		if c.Value != nil {
+			where = append(where, "age "+c.Op+" ?")
+			args = append(args, *c.Value)
+		}
+	}
+	if f.NamePrefix != "" {
+		// LIKE is case insensitive, so use a range instead, which uses the index. The names are compared byte by byte,
+		// and all names with the prefix sort between the prefix and its upper bound.
+		where = append(where, "name >= ?")
+		args = append(args, f.NamePrefix)
+		if upper, ok := prefixUpperBound(f.NamePrefix); ok {
+			where = append(where, "name < ?")
+			args = append(args, upper)
+		}
+		// The range is exact, but check the prefix too, like strings.HasPrefix. The blobs make substr count bytes
+		// rather than characters. This only filters the rows of the range, which are read from the index.
+		where = append(where, "substr(CAST(name AS BLOB), 1, ?) = CAST(? AS BLOB)")
+		args = append(args, len(f.NamePrefix), f.NamePrefix)
+	}
+
+	// Sort by the fields and then by ID, like api.UserSort.Compare.
+	sort := opts.Sort
+	if !sortsByID(sort) {
+		sort = append(sort[:len(sort):len(sort)], api.UserSortField{Field: api.SortByID})
+	}
+	var orderBy []string
+	for _, s := range sort {
+		if s.Desc {
+			orderBy = append(orderBy, columns[s.Field]+" DESC")
+		} else {
+			orderBy = append(orderBy, columns[s.Field])
+		}
+	}
+
+	// Continue after the cursor (keyset pagination).
+	// For the order (a, b), this is `(a > ?) OR (a = ? AND b > ?)`, with `<` for descending fields.
+	if opts.After != nil {
+		var or []string
+		for i, s := range sort {
+			var and []string
+			for _, prev := range sort[:i] {
+				and = append(and, columns[prev.Field]+" = ?")
+				args = append(args, sortValue(*opts.After, prev.Field))
+			}
+			op := ">"
+			if s.Desc {
+				op = "<"
+			}
+			and = append(and, columns[s.Field]+" "+op+" ?")
+			args = append(args, sortValue(*opts.After, s.Field))
+			or = append(or, "("+strings.Join(and, " AND ")+")")
+		}
+		where = append(where, "("+strings.Join(or, " OR ")+")")
+	}
+
+	query := `SELECT ` + userColumns + ` FROM users`
+	if len(where) > 0 {
+		query += ` WHERE ` + strings.Join(where, " AND ")
+	}
+	query += ` ORDER BY ` + strings.Join(orderBy, ", ") + ` LIMIT ?`
+	limit := -1 // No limit.
+	if opts.Limit > 0 {
+		limit = opts.Limit
+	}
+	args = append(args, limit)
+
+	rows, err := u.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ret := []api.User{} // Initialize.
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, user)
+	}
+	return ret, rows.Err()
+}
+
+// Create implements database.Users.
+func (u *Users) Create(ctx context.Context, user api.User) (api.User, error) {
+	if len(user.Labels) == 0 {
+		user.Labels = nil
+	}
+	user.Version = 1
+	values, err := userValues(user)
+	if err != nil {
+		return api.User{}, err
+	}
+	_, err = u.db.ExecContext(ctx, `INSERT INTO users (`+userColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`, values...)
+	err = constraintError(err)
+	if errors.Is(err, dbErrors.ErrEmailAlreadyExists) {
+		// SQLite may check the email index first, but the ID takes precedence.
+		if _, getErr := u.Get(ctx, user.ID); getErr == nil {
+			return api.User{}, dbErrors.ErrUserAlreadyExists
+		}
+	}
+	if err != nil {
+		return api.User{}, err
+	}
+	return user, nil
+}
+
+// Get implements database.Users.
+// If the user does not exist, this function returns errors.ErrUserNotFound.
+func (u *Users) Get(ctx context.Context, id string) (api.User, error) {
+	return get(ctx, u.db, id)
+}
+
+// Update implements database.Users.
+func (u *Users) Update(ctx context.Context, id string, user api.User) (api.User, error) {
+	var stored api.User
+	err := u.inTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		stored, err = get(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		if user.Version != 0 && user.Version != stored.Version {
+			return dbErrors.ErrVersionMismatch
+		}
+		if len(user.Labels) == 0 {
+			user.Labels = nil
+		}
+		user.ID = id
+		user.CreatedAt = stored.CreatedAt
+		user.Version = stored.Version + 1
+		values, err := userValues(user)
+		if err != nil {
+			return err
+		}
+		// The ID is the first column and the WHERE argument.
+		_, err = tx.ExecContext(ctx, `UPDATE users SET (`+userColumns+`) = (?, ?, ?, ?, ?, ?, ?, ?, ?) WHERE id = ?`, append(values, id)...)
+		return constraintError(err)
+	})
+	if err != nil {
+		return api.User{}, err
+	}
+	return user, nil
+}
+
+// Delete implements database.Users.
+func (u *Users) Delete(ctx context.Context, id string, version uint64) error {
+	return u.inTx(ctx, func(tx *sql.Tx) error {
+		stored, err := get(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		if version != 0 && version != stored.Version {
+			return dbErrors.ErrVersionMismatch
+		}
+		_, err = tx.ExecContext(ctx, `DELETE FROM users WHERE id = ?`, id)
+		return err
+	})
+}
+
+// Ping implements database.Pinger.
+func (u *Users) Ping(ctx context.Context) error {
+	return u.db.PingContext(ctx)
+}
+
+// Count implements database.Counter.
+func (u *Users) Count(ctx context.Context) (int, error) {
+	var n int
+	if err := u.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM users`).Scan(&n); err != nil {
+		return 0, fmt.Errorf("sqlite: could not count users: %w", err)
+	}
+	return n, nil
+}
+
+// Close closes the database.
+func (u *Users) Close() error {
+	return u.db.Close()
+}
+
+// prefixUpperBound returns the smallest string that is greater than all the strings with the prefix: the prefix
+// without its trailing 0xff bytes, with its last byte incremented. It returns false if there is no upper bound,
+// when all the bytes are 0xff. The prefix and the bound may not be valid UTF-8, which SQLite compares as bytes.
+func prefixUpperBound(prefix string) (string, bool) {
+	upper := []byte(prefix)
+	for len(upper) > 0 && upper[len(upper)-1] == 0xff {
+		upper = upper[:len(upper)-1]
+	}
+	if len(upper) == 0 {
+		return "", false
+	}
+	upper[len(upper)-1]++
+	return string(upper), true
+}
+
+// sortsByID returns true if the sort order contains the ID, which makes the order total.
+func sortsByID(sort api.UserSort) bool {
+	for _, s := range sort {
+		if s.Field == api.SortByID {
+			return true
+		}
+	}
+	return false
+}
+
+// sortValue returns the value of the sort field of the user.
+func sortValue(user api.User, field string) any {
+	switch field {
+	case api.SortByName:
+		return user.Name
+	case api.SortByAge:
+		return user.Age
+	default:
+		return user.ID
+	}
+}
+
+// scanner is implemented by sql.Row and sql.Rows.
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+// scanUser scans the userColumns of a row.
+func scanUser(s scanner) (api.User, error) {
+	var (
+		user                         api.User
+		labels, createdAt, updatedAt string
+	)
+	if err := s.Scan(&user.ID, &user.Name, &user.Age, &user.Email, &user.Status, &labels, &createdAt, &updatedAt, &user.Version); err != nil {
+		return api.User{}, err
+	}
+	if err := json.Unmarshal([]byte(labels), &user.Labels); err != nil {
+		return api.User{}, fmt.Errorf("sqlite: could not decode labels of user %s: %w", user.ID, err)
+	}
+	for _, t := range []struct {
+		Value string
+		Time  *time.Time
+	}{
+		{Value: createdAt, Time: &user.CreatedAt},
+		{Value: updatedAt, Time: &user.UpdatedAt},
+	} {
+		if t.Value == "" {
+			continue // Users created before the timestamps were added.
+		}
+		var err error
+		if *t.Time, err = time.Parse(time.RFC3339Nano, t.Value); err != nil {
+			return api.User{}, fmt.Errorf("sqlite: could not parse timestamp of user %s: %w", user.ID, err)
+		}
+	}
+	return user, nil
+}
+
+// userValues returns the values of the userColumns of the user.
+func userValues(user api.User) ([]any, error) {
+	labels, err := json.Marshal(user.Labels)
+	if err != nil {
+		return nil, err
+	}
+	return []any{
+		user.ID,
+		user.Name,
+		user.Age,
+		user.Email,
+		user.Status,
+		string(labels),
+		user.CreatedAt.UTC().Format(time.RFC3339Nano),
+		user.UpdatedAt.UTC().Format(time.RFC3339Nano),
+		user.Version,
+	}, nil
+}
+
+// constraintError translates the constraint violations of writes to the database errors.
+// Other errors, including nil, are returned as is.
+func constraintError(err error) error {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		switch sqliteErr.ExtendedCode {
+		case sqlite3.ErrConstraintPrimaryKey:
+			return dbErrors.ErrUserAlreadyExists
+		case sqlite3.ErrConstraintUnique:
+			// The only other unique index is on the email.
+			return dbErrors.ErrEmailAlreadyExists
+		}
+	}
+	return err
+}
+
+// queryer is implemented by sql.DB and sql.Tx.
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// get gets the user with the given ID.
+// If the user does not exist, this function returns errors.ErrUserNotFound.
+func get(ctx context.Context, q queryer, id string) (api.User, error) {
+	user, err := scanUser(q.QueryRowContext(ctx, `SELECT `+userColumns+` FROM users WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return api.User{}, dbErrors.ErrUserNotFound
+	}
+	if err != nil {
+		return api.User{}, err
+	}
+	return user, nil
+}
+
+// inTx runs the function in a write transaction, and commits if it returns no error.
+// The transaction is started immediately (BEGIN IMMEDIATE, see NewUsers), so the check of the version and the write are atomic.
+func (u *Users) inTx(ctx context.Context, f func(tx *sql.Tx) error) error {
+	tx, err := u.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,123 @@
+package sqlite_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/kicodelibrary/go-http-server-2024/api"
+	"github.com/kicodelibrary/go-http-server-2024/pkg/database"
+	"github.com/kicodelibrary/go-http-server-2024/pkg/database/databasetest"
+	. "github.com/kicodelibrary/go-http-server-2024/pkg/database/sqlite"
+	"github.com/smarty/assertions"
+)
+
+func TestUsers(t *testing.T) {
+	databasetest.RunUsersSuite(t, func(t *testing.T) database.Users {
+		users, err := NewUsers(filepath.Join(t.TempDir(), "users.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			users.Close()
+		})
+		return users
+	})
+}
+
+func TestUsersPersistence(t *testing.T) {
+	a := assertions.New(t)
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "users.db")
+
+	users, err := NewUsers(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := api.User{
+		ID:   "alice",
+		Name: "Alice",
+		Age:  30,
+	}
+	alice, err = users.Create(ctx, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopen the database and check that the data persisted.
+	if err := users.Close(); err != nil {
+		t.Fatal(err)
+	}
+	users, err = NewUsers(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		users.Close()
+	})
+	list, err := users.List(ctx, api.ListUsersOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.So(list, assertions.ShouldResemble, []api.User{alice})
+}
+
+func TestUsersPingClosed(t *testing.T) {
+	a := assertions.New(t)
+	users, err := NewUsers(filepath.Join(t.TempDir(), "users.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.So(users.Ping(context.Background()), assertions.ShouldBeNil)
+	if err := users.Close(); err != nil {
+		t.Fatal(err)
+	}
+	a.So(users.Ping(context.Background()), assertions.ShouldNotBeNil)
+}
+
+// The names are stored as they are, so the prefix must also work with bytes that are not valid UTF-8,
+// including 0xff bytes, which cannot be incremented to get the upper bound of the range of the prefix.
+func TestUsersNamePrefixInvalidUTF8(t *testing.T) {
+	a := assertions.New(t)
+	ctx := context.Background()
+	users, err := NewUsers(filepath.Join(t.TempDir(), "users.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		users.Close()
+	})
+	var created []api.User
+	for _, user := range []api.User{
+		{ID: "alice", Name: "Alice", Age: 30},
+		{ID: "ff", Name: "\xff", Age: 30},
+		{ID: "fffe", Name: "\xff\xfe", Age: 30},
+		{ID: "ffff", Name: "\xff\xff\x01", Age: 30},
+		{ID: "zff", Name: "z\xff\x01", Age: 30},
+		{ID: "zz", Name: "zz", Age: 30},
+	} {
+		user, err := users.Create(ctx, user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		created = append(created, user)
+	}
+	alice, ff, fffe, ffff, zff, zz := created[0], created[1], created[2], created[3], created[4], created[5]
+	for _, tc := range []struct {
+		Name     string
+		Prefix   string
+		Expected []api.User
+	}{
+		{Name: "FF", Prefix: "\xff", Expected: []api.User{ff, fffe, ffff}},
+		{Name: "FFFF", Prefix: "\xff\xff", Expected: []api.User{ffff}},
+		{Name: "TrailingFF", Prefix: "z\xff", Expected: []api.User{zff}},
+		{Name: "Valid", Prefix: "z", Expected: []api.User{zff, zz}},
+		{Name: "ValidRange", Prefix: "Al", Expected: []api.User{alice}},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			list, err := users.List(ctx, api.ListUsersOptions{Filter: api.UserFilter{NamePrefix: tc.Prefix}})
+			a.So(err, assertions.ShouldBeNil)
+			a.So(list, assertions.ShouldResemble, tc.Expected)
+		})
+	}
+}
@@ -0,0 +1,526 @@
+// Package wal provides an in-memory implementation of the database interfaces that is
+// made durable by an append-only write-ahead log and periodic snapshots.
+//
+// The data directory contains two files:
+//   - `snapshot.json` holds the full set of users at the time of the last compaction.
+//   - `users.log` holds the changes since the last compaction.
+//
+// On startup, the snapshot is loaded and the log is replayed on top of it.
+package wal
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/kicodelibrary/go-http-server-2024/api"
+	dbErrors "github.com/kicodelibrary/go-http-server-2024/pkg/database/errors"
+)
+
+// Config holds the write-ahead log configuration.
+type Config struct {
+	Dir string
+	// CompactInterval is the interval between automatic compactions. Zero disables them.
+	CompactInterval time.Duration
+}
+
+const (
+	snapshotFile = "snapshot.json"
+	logFile      = "users.log"
+
+	// headerSize is the size of the record header: the payload length and the CRC32 checksum of the payload.
+	headerSize = 8
+	// maxRecordSize protects against allocating huge buffers when the length of a record is corrupted.
+	maxRecordSize = 1 << 20
+)
+
+// Operations stored in the log.
+const (
+	opPut    = "put"
+	opDelete = "delete"
+)
+
+// record is a single change in the log.
+type record struct {
+	Op   string    `json:"op"`
+	ID   string    `json:"id"`
+	User *api.User `json:"user,omitempty"`
+}
+
+// Users stores users in memory and logs every change to disk.
+// The context is checked once the lock is acquired, since writers may wait behind a slow sync.
+type Users struct {
+	dir string
+
+	mu    sync.Mutex
+	users map[string]api.User
+	// emails indexes the IDs of the users by email, to check that emails are unique.
+	emails map[string]string
+	log    *os.File
+
+	stop chan struct{}
+	done chan struct{}
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// NewUsers opens the write-ahead log in the given directory, and replays it.
+// The directory is created if it does not exist.
+func NewUsers(config Config) (*Users, error) {
+	if config.Dir == "" {
+		return nil, fmt.Errorf("wal: no data directory")
+	}
+	if err := os.MkdirAll(config.Dir, 0o700); err != nil {
+		return nil, fmt.Errorf("wal: could not create data directory: %w", err)
+	}
+	u := &Users{
+		dir:    config.Dir,
+		users:  make(map[string]api.User),
+		emails: make(map[string]string),
+	}
+	if err := u.loadSnapshot(); err != nil {
+		return nil, err
+	}
+	if err := u.replay(); err != nil {
+		return nil, err
+	}
+	if config.CompactInterval > 0 {
+		u.stop = make(chan struct{})
+		u.done = make(chan struct{})
+		go u.compactLoop(config.CompactInterval)
+	}
+	return u, nil
+}
+
+// loadSnapshot loads the users from the snapshot, if there is one.
+func (u *Users) loadSnapshot() error {
+	b, err := os.ReadFile(filepath.Join(u.dir, snapshotFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("wal: could not read snapshot: %w", err)
+	}
+	var users []api.User
+	if err := json.Unmarshal(b, &users); err != nil {
+		return fmt.Errorf("wal: could not decode snapshot: %w", err)
+	}
+	for _, user := range users {
+		u.apply(record{Op: opPut, ID: user.ID, User: &user})
+	}
+	return nil
+}
+
+// replay applies the records in the log and opens it for appending.
+// A torn or corrupted record at the end of the log (ex: after a crash) is truncated. A corrupted record that is followed
+// by other records is not the result of a crash: replay fails, rather than losing the records after it.
+func (u *Users) replay() error {
+	f, err := os.OpenFile(filepath.Join(u.dir, logFile), os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("wal: could not open log: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("wal: could not stat log: %w", err)
+	}
+
+	var (
+		r      = bufio.NewReader(f)
+		offset int64 // The end of the last valid record.
+	)
+	for {
+		rec, n, err := readRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			tail, tailErr := isTail(f, offset, n, info.Size())
+			if tailErr != nil {
+				f.Close()
+				return fmt.Errorf("wal: could not read log: %w", tailErr)
+			}
+			if !tail {
+				f.Close()
+				return fmt.Errorf("wal: corrupted record at offset %d of %s: %w", offset, f.Name(), err)
+			}
+			slog.Warn("truncating torn record of write-ahead log", "offset", offset, "error", err)
+			break
+		}
+		u.apply(rec)
+		offset += n
+	}
+
+	// Drop anything after the last valid record and append from there.
+	if err := f.Truncate(offset); err != nil {
+		f.Close()
+		return fmt.Errorf("wal: could not truncate log: %w", err)
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return fmt.Errorf("wal: could not seek log: %w", err)
+	}
+	u.log = f
+	return nil
+}
+
+// readRecord reads a single record and returns its size. It returns io.EOF only if the log ends cleanly before the record.
+// With other errors, the size is the size in the header of the record, or 0 if it is unknown or invalid.
+func readRecord(r io.Reader) (record, int64, error) {
+	var header [headerSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return record{}, headerSize, fmt.Errorf("torn record header")
+		}
+		return record{}, 0, err
+	}
+	size := binary.BigEndian.Uint32(header[0:4])
+	sum := binary.BigEndian.Uint32(header[4:8])
+	if size > maxRecordSize {
+		return record{}, 0, fmt.Errorf("invalid record size %d", size)
+	}
+	n := int64(headerSize + size)
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return record{}, n, fmt.Errorf("torn record payload")
+	}
+	if crc32.ChecksumIEEE(payload) != sum {
+		return record{}, n, fmt.Errorf("record checksum mismatch")
+	}
+	var rec record
+	if err := json.Unmarshal(payload, &rec); err != nil {
+		return record{}, n, fmt.Errorf("could not decode record: %w", err)
+	}
+	return rec, n, nil
+}
+
+// isTail returns true if the invalid record of size n at the offset is the last record of the log, which is the case
+// after a crash in the middle of an append. The size is 0 if it is unknown. The file system may also extend the file
+// with zeros that were never written (ex: ext4 after a power failure), which counts as the tail too.
+func isTail(f *os.File, offset, n, size int64) (bool, error) {
+	if n > 0 && offset+n >= size {
+		return true, nil
+	}
+	buf := make([]byte, 32*1024)
+	for off := offset; off < size; {
+		read, err := f.ReadAt(buf, off)
+		for _, b := range buf[:read] {
+			if b != 0 {
+				return false, nil
+			}
+		}
+		off += int64(read)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// apply applies a record to the in-memory users and the email index.
+func (u *Users) apply(rec record) {
+	if stored, ok := u.users[rec.ID]; ok && stored.Email != "" {
+		delete(u.emails, stored.Email)
+	}
+	switch rec.Op {
+	case opPut:
+		if rec.User != nil {
+			u.users[rec.ID] = clone(*rec.User)
+			if rec.User.Email != "" {
+				u.emails[rec.User.Email] = rec.ID
+			}
+		}
+	case opDelete:
+		delete(u.users, rec.ID)
+	}
+}
+
+// emailTaken returns true if a user other than id has the email.
+// The caller must hold the lock.
+func (u *Users) emailTaken(id, email string) bool {
+	if email == "" {
+		return false
+	}
+	other, ok := u.emails[email]
+	return ok && other != id
+}
+
+// append durably writes the record to the log and then applies it.
+// If the record cannot be written, the log is truncated back to its previous end, so that a partial record is not
+// followed by the next records, which replay would reject as corruption.
+// The caller must hold the lock.
+func (u *Users) append(rec record) error {
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	// Replay rejects the larger records, so they must not be written.
+	if len(payload) > maxRecordSize {
+		return fmt.Errorf("wal: record of %d bytes exceeds the maximum of %d bytes", len(payload), maxRecordSize)
+	}
+	buf := make([]byte, headerSize+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(payload))
+	copy(buf[headerSize:], payload)
+	offset, err := u.log.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fmt.Errorf("wal: could not seek log: %w", err)
+	}
+	if _, err := u.log.Write(buf); err != nil {
+		return errors.Join(fmt.Errorf("wal: could not write record: %w", err), u.rollback(offset))
+	}
+	if err := u.log.Sync(); err != nil {
+		return errors.Join(fmt.Errorf("wal: could not sync log: %w", err), u.rollback(offset))
+	}
+	u.apply(rec)
+	return nil
+}
+
+// rollback truncates the log back to the offset, and appends from there.
+// The caller must hold the lock.
+func (u *Users) rollback(offset int64) error {
+	if err := u.log.Truncate(offset); err != nil {
+		return fmt.Errorf("wal: could not truncate log: %w", err)
+	}
+	if _, err := u.log.Seek(offset, io.SeekStart); err != nil {
+		return fmt.Errorf("wal: could not seek log: %w", err)
+	}
+	return nil
+}
+
+// List implements database.Users.
+func (u *Users) List(ctx context.Context, opts api.ListUsersOptions) ([]api.User, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	ret := []api.User{} // Initialize.
+	for _, user := range u.users {
+		ret = append(ret, clone(user))
+	}
+	return opts.Apply(ret), nil
+}
+
+// Create implements database.Users.
+func (u *Users) Create(ctx context.Context, user api.User) (api.User, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return api.User{}, err
+	}
+	if _, ok := u.users[user.ID]; ok {
+		return api.User{}, dbErrors.ErrUserAlreadyExists
+	}
+	if u.emailTaken(user.ID, user.Email) {
+		return api.User{}, dbErrors.ErrEmailAlreadyExists
+	}
+	user = clone(user)
+	user.Version = 1
+	if err := u.append(record{Op: opPut, ID: user.ID, User: &user}); err != nil {
+		return api.User{}, err
+	}
+	return user, nil
+}
+
+// Get implements database.Users.
+// If the user does not exist, this function returns errors.ErrUserNotFound.
+func (u *Users) Get(ctx context.Context, id string) (api.User, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return api.User{}, err
+	}
+	user, ok := u.users[id]
+	if !ok {
+		return api.User{}, dbErrors.ErrUserNotFound
+	}
+	return clone(user), nil
+}
+
+// Update implements database.Users.
+func (u *Users) Update(ctx context.Context, id string, user api.User) (api.User, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return api.User{}, err
+	}
+	stored, ok := u.users[id]
+	if !ok {
+		return api.User{}, dbErrors.ErrUserNotFound
+	}
+	if user.Version != 0 && user.Version != stored.Version {
+		return api.User{}, dbErrors.ErrVersionMismatch
+	}
+	if u.emailTaken(id, user.Email) {
+		return api.User{}, dbErrors.ErrEmailAlreadyExists
+	}
+	user = clone(user)
+	user.CreatedAt = stored.CreatedAt
+	user.Version = stored.Version + 1
+	if err := u.append(record{Op: opPut, ID: id, User: &user}); err != nil { // This is a replacement.
+		return api.User{}, err
+	}
+	return user, nil
+}
+
+// Delete implements database.Users.
+func (u *Users) Delete(ctx context.Context, id string, version uint64) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	stored, ok := u.users[id]
+	if !ok {
+		return dbErrors.ErrUserNotFound
+	}
+	if version != 0 && version != stored.Version {
+		return dbErrors.ErrVersionMismatch
+	}
+	return u.append(record{Op: opDelete, ID: id})
+}
+
+// Compact writes a snapshot of all users and truncates the log.
+// The snapshot is written to a temporary file and renamed, so a crash leaves either the old or the new snapshot.
+// Replaying a log on top of a newer snapshot is harmless since all records are idempotent.
+func (u *Users) Compact() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	users := make([]api.User, 0, len(u.users))
+	for _, user := range u.users {
+		users = append(users, user)
+	}
+	b, err := json.Marshal(users)
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(u.dir, snapshotFile+".tmp")
+	if err := writeFileSync(tmp, b); err != nil {
+		return fmt.Errorf("wal: could not write snapshot: %w", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(u.dir, snapshotFile)); err != nil {
+		return fmt.Errorf("wal: could not rename snapshot: %w", err)
+	}
+	if err := syncDir(u.dir); err != nil {
+		return fmt.Errorf("wal: could not sync data directory: %w", err)
+	}
+
+	// The snapshot now holds everything in the log.
+	if err := u.log.Truncate(0); err != nil {
+		return fmt.Errorf("wal: could not truncate log: %w", err)
+	}
+	if _, err := u.log.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("wal: could not seek log: %w", err)
+	}
+	return u.log.Sync()
+}
+
+// compactLoop compacts the log at every interval until Close is called.
+func (u *Users) compactLoop(interval time.Duration) {
+	defer close(u.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := u.Compact(); err != nil {
+				slog.Error("could not compact write-ahead log", "error", err)
+			}
+		case <-u.stop:
+			return
+		}
+	}
+}
+
+// Ping implements database.Pinger. It fails if the log is closed or cannot be accessed.
+func (u *Users) Ping(ctx context.Context) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if _, err := u.log.Stat(); err != nil {
+		return fmt.Errorf("wal: could not access log: %w", err)
+	}
+	return nil
+}
+
+// Count implements database.Counter.
+func (u *Users) Count(ctx context.Context) (int, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return len(u.users), nil
+}
+
+// Close stops automatic compaction and closes the log. It can be called several times.
+func (u *Users) Close() error {
+	u.closeOnce.Do(func() {
+		if u.stop != nil {
+			close(u.stop)
+			<-u.done
+		}
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		u.closeErr = u.log.Close()
+	})
+	return u.closeErr
+}
+
+// clone returns a copy of the user that does not share the labels, so that callers cannot modify stored users.
+// Empty labels are nil, like after a round trip through the log.
+func clone(user api.User) api.User {
+	if len(user.Labels) == 0 {
+		user.Labels = nil
+	} else {
+		user.Labels = maps.Clone(user.Labels)
+	}
+	return user
+}
+
+// writeFileSync writes the file and syncs it to disk.
+func writeFileSync(name string, b []byte) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syncDir syncs the directory so that renames within it are durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
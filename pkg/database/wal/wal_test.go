@@ -0,0 +1,314 @@
+package wal_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kicodelibrary/go-http-server-2024/api"
+	"github.com/kicodelibrary/go-http-server-2024/pkg/database"
+	"github.com/kicodelibrary/go-http-server-2024/pkg/database/databasetest"
+	. "github.com/kicodelibrary/go-http-server-2024/pkg/database/wal"
+	"github.com/smarty/assertions"
+)
+
+// list lists all users.
+func list(t *testing.T, users *Users) []api.User {
+	t.Helper()
+	ret, err := users.List(context.Background(), api.ListUsersOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ret
+}
+
+func TestUsers(t *testing.T) {
+	databasetest.RunUsersSuite(t, func(t *testing.T) database.Users {
+		users, err := NewUsers(Config{
+			Dir: t.TempDir(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			users.Close()
+		})
+		return users
+	})
+}
+
+func TestUsersCompact(t *testing.T) {
+	a := assertions.New(t)
+	ctx := context.Background()
+	config := Config{
+		Dir: t.TempDir(),
+	}
+
+	users, err := NewUsers(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := api.User{
+		ID:   "alice",
+		Name: "Alice",
+		Age:  30,
+	}
+	bob := api.User{
+		ID:   "bob",
+		Name: "Bob",
+		Age:  25,
+	}
+	for _, user := range []*api.User{&alice, &bob} {
+		if *user, err = users.Create(ctx, *user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	alice.Name = "Alice Smith"
+	if alice, err = users.Update(ctx, alice.ID, alice); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.Delete(ctx, bob.ID, bob.Version); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopen and replay the log.
+	if err := users.Close(); err != nil {
+		t.Fatal(err)
+	}
+	users, err = NewUsers(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.So(list(t, users), assertions.ShouldResemble, []api.User{alice})
+
+	// Compact, then write more changes on top of the snapshot.
+	if err := users.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(config.Dir, "users.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.So(info.Size(), assertions.ShouldEqual, 0)
+	if bob, err = users.Create(ctx, bob); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	users, err = NewUsers(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		users.Close()
+	})
+	a.So(list(t, users), assertions.ShouldResemble, []api.User{alice, bob})
+}
+
+func TestUsersTornRecord(t *testing.T) {
+	a := assertions.New(t)
+	ctx := context.Background()
+	config := Config{
+		Dir: t.TempDir(),
+	}
+
+	users, err := NewUsers(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := api.User{
+		ID:   "alice",
+		Name: "Alice",
+		Age:  30,
+	}
+	if alice, err = users.Create(ctx, alice); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a crash in the middle of writing a record.
+	path := filepath.Join(config.Dir, "users.log")
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte{0, 0, 0, 42, 1, 2, 3, 4, '{', '"'}); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	// The torn record is dropped and the log remains usable.
+	users, err = NewUsers(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.So(list(t, users), assertions.ShouldResemble, []api.User{alice})
+	bob := api.User{
+		ID:   "bob",
+		Name: "Bob",
+		Age:  25,
+	}
+	if bob, err = users.Create(ctx, bob); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	users, err = NewUsers(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		users.Close()
+	})
+	a.So(list(t, users), assertions.ShouldResemble, []api.User{alice, bob})
+}
+
+func TestUsersCorruptedRecord(t *testing.T) {
+	a := assertions.New(t)
+	ctx := context.Background()
+	config := Config{
+		Dir: t.TempDir(),
+	}
+
+	users, err := NewUsers(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range []api.User{{ID: "alice", Name: "Alice", Age: 30}, {ID: "bob", Name: "Bob", Age: 25}} {
+		if _, err := users.Create(ctx, user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := users.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Corrupt the payload of the first record, which is followed by the second one.
+	path := filepath.Join(config.Dir, "users.log")
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[10] ^= 0xff
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The log is not truncated, so that it can be repaired.
+	_, err = NewUsers(config)
+	a.So(err, assertions.ShouldNotBeNil)
+	a.So(err.Error(), assertions.ShouldContainSubstring, "corrupted record at offset 0")
+	after, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.So(after, assertions.ShouldResemble, b)
+}
+
+func TestUsersZeroTail(t *testing.T) {
+	a := assertions.New(t)
+	ctx := context.Background()
+	config := Config{
+		Dir: t.TempDir(),
+	}
+
+	users, err := NewUsers(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := users.Create(ctx, api.User{ID: "alice", Name: "Alice", Age: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := users.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a file system that extended the log with zeros that were never written.
+	path := filepath.Join(config.Dir, "users.log")
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(make([]byte, 4096)); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	users, err = NewUsers(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		users.Close()
+	})
+	a.So(list(t, users), assertions.ShouldResemble, []api.User{alice})
+}
+
+func TestUsersRecordTooLarge(t *testing.T) {
+	a := assertions.New(t)
+	ctx := context.Background()
+	config := Config{
+		Dir: t.TempDir(),
+	}
+
+	users, err := NewUsers(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := users.Create(ctx, api.User{ID: "alice", Name: "Alice", Age: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = users.Create(ctx, api.User{ID: "bob", Name: strings.Repeat("b", 2<<20), Age: 25})
+	a.So(err, assertions.ShouldNotBeNil)
+	a.So(list(t, users), assertions.ShouldResemble, []api.User{alice})
+	if err := users.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing was written, so the log can be replayed.
+	users, err = NewUsers(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		users.Close()
+	})
+	a.So(list(t, users), assertions.ShouldResemble, []api.User{alice})
+}
+
+func TestUsersCloseTwice(t *testing.T) {
+	a := assertions.New(t)
+	users, err := NewUsers(Config{
+		Dir:             t.TempDir(),
+		CompactInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.So(users.Close(), assertions.ShouldBeNil)
+	a.So(users.Close(), assertions.ShouldBeNil)
+}
+
+func TestUsersPingClosed(t *testing.T) {
+	a := assertions.New(t)
+	users, err := NewUsers(Config{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.So(users.Ping(context.Background()), assertions.ShouldBeNil)
+	if err := users.Close(); err != nil {
+		t.Fatal(err)
+	}
+	a.So(users.Ping(context.Background()), assertions.ShouldNotBeNil)
+}
@@ -0,0 +1,137 @@
+// Package ids generates sortable user IDs.
+//
+// Two formats are supported, both made of a 48-bit millisecond timestamp followed by random bits:
+//   - ULID (https://github.com/ulid/spec), in lowercase, ex: `01hq3k5v7x9d2c4b6n8m0p1r3s`.
+//   - UUIDv7 (RFC 9562), in hexadecimal without hyphens, ex: `018db3a4e5f67c3d9a1b2c3d4e5f6a7b`.
+//
+// Both match the format of user IDs (see api.User.Validate), and sort in the order they were generated,
+// as strings or as bytes.
+package ids
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Format is the format of the generated IDs.
+type Format string
+
+// Formats.
+const (
+	FormatULID   Format = "ulid"
+	FormatUUIDv7 Format = "uuidv7"
+)
+
+// randomBits returns the number of random bits after the timestamp. UUIDv7 reserves 6 bits for the version and the variant.
+func (f Format) randomBits() int {
+	if f == FormatUUIDv7 {
+		return 74
+	}
+	return 80
+}
+
+// Generator generates IDs. It is safe for concurrent use.
+//
+// IDs generated in the same millisecond increment the random bits of the previous ID (like the monotonic ULIDs),
+// so that they are also sorted. This also protects against a clock that goes backwards.
+type Generator struct {
+	format  Format
+	now     func() time.Time
+	entropy io.Reader
+
+	mu sync.Mutex
+	// ms is the timestamp of the last ID.
+	ms uint64
+	// hi and lo are the random bits of the last ID: the bits above 64, and the low 64 bits.
+	hi, lo uint64
+}
+
+// NewGenerator creates a new generator of IDs in the format.
+// The timestamps come from now, and the random bits from entropy. Use time.Now and crypto/rand.Reader if they are nil.
+func NewGenerator(format Format, now func() time.Time, entropy io.Reader) (*Generator, error) {
+	switch format {
+	case FormatULID, FormatUUIDv7:
+	default:
+		return nil, fmt.Errorf("unknown ID format %q, must be %s or %s", format, FormatULID, FormatUUIDv7)
+	}
+	if now == nil {
+		now = time.Now
+	}
+	if entropy == nil {
+		entropy = rand.Reader
+	}
+	return &Generator{
+		format:  format,
+		now:     now,
+		entropy: entropy,
+	}, nil
+}
+
+// New generates a new ID.
+func (g *Generator) New() (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ms := uint64(g.now().UnixMilli())
+	hiMax := uint64(1)<<(g.format.randomBits()-64) - 1
+	if ms <= g.ms && g.ms != 0 {
+		// Same millisecond (or the clock went backwards): increment the previous ID.
+		g.lo++
+		if g.lo == 0 {
+			g.hi++
+		}
+		if g.hi <= hiMax {
+			return g.encode(), nil
+		}
+		// The random bits overflowed, which is very unlikely: continue in the next millisecond.
+		ms = g.ms + 1
+	}
+	var b [10]byte
+	if _, err := io.ReadFull(g.entropy, b[:]); err != nil {
+		return "", fmt.Errorf("could not read random bits: %w", err)
+	}
+	g.ms = ms
+	g.hi = uint64(binary.BigEndian.Uint16(b[:2])) & hiMax
+	g.lo = binary.BigEndian.Uint64(b[2:])
+	return g.encode(), nil
+}
+
+// encode encodes the last ID.
+func (g *Generator) encode() string {
+	var b [16]byte
+	// The timestamp is the first 48 bits.
+	binary.BigEndian.PutUint64(b[:8], g.ms<<16)
+	if g.format == FormatUUIDv7 {
+		// The 74 random bits are split around the version (4 bits) and the variant (2 bits).
+		randA := g.hi<<2 | g.lo>>62
+		randB := g.lo & (1<<62 - 1)
+		binary.BigEndian.PutUint16(b[6:8], 0x7000|uint16(randA))
+		binary.BigEndian.PutUint64(b[8:], 0x8000000000000000|randB)
+		return hex.EncodeToString(b[:])
+	}
+	binary.BigEndian.PutUint16(b[6:8], uint16(g.hi))
+	binary.BigEndian.PutUint64(b[8:], g.lo)
+	return encodeULID(b)
+}
+
+// crockford is the Crockford's base32 alphabet used by ULIDs, in lowercase.
+const crockford = "0123456789abcdefghjkmnpqrstvwxyz"
+
+// encodeULID encodes the 128 bits of a ULID as 26 characters of 5 bits, from the most significant bits.
+// The first character only has 3 bits.
+func encodeULID(b [16]byte) string {
+	hi := binary.BigEndian.Uint64(b[:8])
+	lo := binary.BigEndian.Uint64(b[8:])
+	var s [26]byte
+	for i := len(s) - 1; i >= 0; i-- {
+		s[i] = crockford[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(s[:])
+}
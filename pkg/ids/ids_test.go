@@ -0,0 +1,130 @@
+package ids_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"regexp"
+	"slices"
+	"testing"
+	"time"
+
+	. "github.com/kicodelibrary/go-http-server-2024/pkg/ids"
+	"github.com/smarty/assertions"
+)
+
+// userIDRegexp is the format of user IDs (see api.User.Validate).
+var userIDRegexp = regexp.MustCompile(`^[a-z0-9]{3,32}$`)
+
+func TestGenerator(t *testing.T) {
+	a := assertions.New(t)
+
+	for _, tc := range []struct {
+		Name     string
+		Format   Format
+		Time     time.Time
+		Entropy  string
+		Expected string
+	}{
+		{
+			// The timestamp of the example of the ULID specification.
+			Name:     "ULID",
+			Format:   FormatULID,
+			Time:     time.UnixMilli(1469918176385),
+			Entropy:  "00000000000000000000",
+			Expected: "01aryz6s410000000000000000",
+		},
+		{
+			Name:     "ULIDMax",
+			Format:   FormatULID,
+			Time:     time.UnixMilli(1<<48 - 1),
+			Entropy:  "ffffffffffffffffffff",
+			Expected: "7zzzzzzzzzzzzzzzzzzzzzzzzz",
+		},
+		{
+			// The example of RFC 9562, appendix A.6.
+			Name:     "UUIDv7",
+			Format:   FormatUUIDv7,
+			Time:     time.UnixMilli(0x017F22E279B0),
+			Entropy:  "0330d8c4dc0c0c07398f",
+			Expected: "017f22e279b07cc398c4dc0c0c07398f",
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			entropy, err := hex.DecodeString(tc.Entropy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			g, err := NewGenerator(tc.Format, func() time.Time { return tc.Time }, bytes.NewReader(entropy))
+			if err != nil {
+				t.Fatal(err)
+			}
+			id, err := g.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			a.So(id, assertions.ShouldEqual, tc.Expected)
+		})
+	}
+
+	_, err := NewGenerator("uuidv4", nil, nil)
+	a.So(err, assertions.ShouldNotBeNil)
+}
+
+func TestGeneratorSorted(t *testing.T) {
+	for _, format := range []Format{FormatULID, FormatUUIDv7} {
+		t.Run(string(format), func(t *testing.T) {
+			a := assertions.New(t)
+
+			// The clock advances every 10 IDs, and goes backwards once.
+			now := time.UnixMilli(1700000000000)
+			var n int
+			clock := func() time.Time {
+				n++
+				switch {
+				case n == 50:
+					return now.Add(-time.Second)
+				case n%10 == 0:
+					now = now.Add(time.Millisecond)
+				}
+				return now
+			}
+			g, err := NewGenerator(format, clock, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []string
+			for i := 0; i < 100; i++ {
+				id, err := g.New()
+				if err != nil {
+					t.Fatal(err)
+				}
+				a.So(userIDRegexp.MatchString(id), assertions.ShouldBeTrue)
+				ids = append(ids, id)
+			}
+			a.So(slices.IsSorted(ids), assertions.ShouldBeTrue)
+			a.So(len(slices.Compact(slices.Clone(ids))), assertions.ShouldEqual, len(ids))
+		})
+	}
+}
+
+func TestGeneratorOverflow(t *testing.T) {
+	a := assertions.New(t)
+
+	// The random bits are all set: the next ID of the same millisecond continues in the next millisecond.
+	ms := time.UnixMilli(1700000000000)
+	entropy := bytes.Repeat([]byte{0xff}, 20)
+	g, err := NewGenerator(FormatULID, func() time.Time { return ms }, bytes.NewReader(entropy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := g.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := g.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.So(second, assertions.ShouldBeGreaterThan, first)
+	a.So(second[:10], assertions.ShouldNotEqual, first[:10])
+}
@@ -0,0 +1,65 @@
+// Package logging creates the structured logger of the server, based on log/slog.
+//
+// The records that are logged with a context (ex: logger.ErrorContext(r.Context(), ...)) have the ID of the request
+// (see the requestid package), so that all the logs of a request can be found.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+
+	"github.com/kicodelibrary/go-http-server-2024/pkg/server/requestid"
+)
+
+// Formats of the logs.
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// New creates a logger that writes records of the level and above to w, in the format.
+// The level is a slog level name, ex: `debug`, `info`, `warn` or `error`.
+func New(w io.Writer, format, level string) (*slog.Logger, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q: %w", level, err)
+	}
+	opts := &slog.HandlerOptions{
+		Level: l,
+	}
+	var h slog.Handler
+	switch format {
+	case FormatText:
+		h = slog.NewTextHandler(w, opts)
+	case FormatJSON:
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("invalid log format %q, must be %s or %s", format, FormatText, FormatJSON)
+	}
+	return slog.New(contextHandler{h}), nil
+}
+
+// contextHandler adds the request ID of the context to the records.
+type contextHandler struct {
+	slog.Handler
+}
+
+// Handle implements slog.Handler.
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := requestid.FromContext(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+// WithAttrs implements slog.Handler.
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+// WithGroup implements slog.Handler.
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,57 @@
+package logging_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	. "github.com/kicodelibrary/go-http-server-2024/pkg/logging"
+	"github.com/kicodelibrary/go-http-server-2024/pkg/server/requestid"
+	"github.com/smarty/assertions"
+)
+
+func TestNew(t *testing.T) {
+	a := assertions.New(t)
+
+	var buf bytes.Buffer
+	logger, err := New(&buf, FormatJSON, "warn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := requestid.NewContext(context.Background(), "abc123")
+	logger.InfoContext(ctx, "ignored")
+	logger.With("component", "test").ErrorContext(ctx, "could not do it", "error", "boom")
+	logger.Warn("no request")
+
+	// The records below the level are dropped, and the records logged with a request have its ID.
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if !a.So(lines, assertions.ShouldHaveLength, 2) {
+		return
+	}
+	var record map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatal(err)
+	}
+	a.So(record["level"], assertions.ShouldEqual, "ERROR")
+	a.So(record["msg"], assertions.ShouldEqual, "could not do it")
+	a.So(record["component"], assertions.ShouldEqual, "test")
+	a.So(record["error"], assertions.ShouldEqual, "boom")
+	a.So(record["request_id"], assertions.ShouldEqual, "abc123")
+	a.So(lines[1], assertions.ShouldNotContainSubstring, "request_id")
+
+	// Text format.
+	buf.Reset()
+	logger, err = New(&buf, FormatText, "DEBUG")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.DebugContext(ctx, "hello")
+	a.So(buf.String(), assertions.ShouldContainSubstring, `level=DEBUG msg=hello request_id=abc123`)
+
+	_, err = New(&buf, "xml", "info")
+	a.So(err, assertions.ShouldNotBeNil)
+	_, err = New(&buf, FormatText, "verbose")
+	a.So(err, assertions.ShouldNotBeNil)
+}
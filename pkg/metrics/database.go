@@ -0,0 +1,130 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/kicodelibrary/go-http-server-2024/api"
+	"github.com/kicodelibrary/go-http-server-2024/pkg/database"
+	dbErrors "github.com/kicodelibrary/go-http-server-2024/pkg/database/errors"
+)
+
+// users records the metrics of the operations of the database it wraps.
+type users struct {
+	database.Users
+	m *Metrics
+}
+
+// countPageSize is the number of users listed at once to count the users of the databases that are not Counters.
+const countPageSize = 1000
+
+// Users wraps the database to record the duration and the errors of its operations, and the number of users.
+// The number of users is counted once here, and then updated on every creation and deletion.
+// The wrapper does not implement the optional interfaces, such as database.Pinger: use the wrapped database.
+func (m *Metrics) Users(ctx context.Context, u database.Users) (database.Users, error) {
+	n, err := count(ctx, u)
+	if err != nil {
+		return nil, fmt.Errorf("could not count users: %w", err)
+	}
+	m.users.Set(float64(n))
+	return &users{
+		Users: u,
+		m:     m,
+	}, nil
+}
+
+// count returns the number of users. The databases that are not Counters are listed by pages,
+// so that the users are not all loaded in memory.
+func count(ctx context.Context, u database.Users) (int, error) {
+	if counter, ok := u.(database.Counter); ok {
+		return counter.Count(ctx)
+	}
+	var n int
+	opts := api.ListUsersOptions{Limit: countPageSize}
+	for {
+		page, err := u.List(ctx, opts)
+		if err != nil {
+			return 0, err
+		}
+		n += len(page)
+		if len(page) < countPageSize {
+			return n, nil
+		}
+		opts.After = &page[len(page)-1]
+	}
+}
+
+// errorLabel returns the label of the error of an operation.
+// The expected errors are distinguished, since they are caused by the clients and not by the database.
+func errorLabel(err error) string {
+	switch {
+	case errors.Is(err, dbErrors.ErrUserNotFound):
+		return "user_not_found"
+	case errors.Is(err, dbErrors.ErrUserAlreadyExists):
+		return "user_already_exists"
+	case errors.Is(err, dbErrors.ErrEmailAlreadyExists):
+		return "email_already_exists"
+	case errors.Is(err, dbErrors.ErrVersionMismatch):
+		return "version_mismatch"
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return "cancelled"
+	default:
+		return "internal"
+	}
+}
+
+// observe records an operation that started at start.
+func (u *users) observe(operation string, start time.Time, err error) {
+	u.m.operationDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		u.m.operationErrors.WithLabelValues(operation, errorLabel(err)).Inc()
+	}
+}
+
+// List implements database.Users.
+func (u *users) List(ctx context.Context, opts api.ListUsersOptions) ([]api.User, error) {
+	start := time.Now()
+	list, err := u.Users.List(ctx, opts)
+	u.observe("list", start, err)
+	return list, err
+}
+
+// Create implements database.Users.
+func (u *users) Create(ctx context.Context, user api.User) (api.User, error) {
+	start := time.Now()
+	created, err := u.Users.Create(ctx, user)
+	u.observe("create", start, err)
+	if err == nil {
+		u.m.users.Inc()
+	}
+	return created, err
+}
+
+// Get implements database.Users.
+func (u *users) Get(ctx context.Context, id string) (api.User, error) {
+	start := time.Now()
+	user, err := u.Users.Get(ctx, id)
+	u.observe("get", start, err)
+	return user, err
+}
+
+// Update implements database.Users.
+func (u *users) Update(ctx context.Context, id string, user api.User) (api.User, error) {
+	start := time.Now()
+	updated, err := u.Users.Update(ctx, id, user)
+	u.observe("update", start, err)
+	return updated, err
+}
+
+// Delete implements database.Users.
+func (u *users) Delete(ctx context.Context, id string, version uint64) error {
+	start := time.Now()
+	err := u.Users.Delete(ctx, id, version)
+	u.observe("delete", start, err)
+	if err == nil {
+		u.m.users.Dec()
+	}
+	return err
+}
@@ -0,0 +1,125 @@
+// Package metrics exposes Prometheus metrics of the server, on the `/metrics` route.
+//
+// The HTTP metrics are labeled by the route template of gorilla/mux (ex: `/users/{id}`) rather than by the path,
+// so that the number of series does not grow with the number of users.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/kicodelibrary/go-http-server-2024/pkg/server/route"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics holds the metrics of the server, in their own registry.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	requests         *prometheus.CounterVec
+	requestDuration  *prometheus.HistogramVec
+	requestsInFlight prometheus.Gauge
+
+	operationDuration *prometheus.HistogramVec
+	operationErrors   *prometheus.CounterVec
+	users             prometheus.Gauge
+}
+
+// New creates and registers the metrics, with the metrics of the Go runtime and of the process.
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "Number of HTTP requests, by route template, method and status code.",
+		}, []string{"route", "method", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "Duration of HTTP requests, by route template, method and status code.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"route", "method", "status"}),
+		requestsInFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "http_requests_in_flight",
+			Help: "Number of HTTP requests being served.",
+		}),
+		operationDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "database_operation_duration_seconds",
+			Help:    "Duration of database operations, by operation.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"operation"}),
+		operationErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "database_operation_errors_total",
+			Help: "Number of failed database operations, by operation and error.",
+		}, []string{"operation", "error"}),
+		users: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "users",
+			Help: "Number of users in the database.",
+		}),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requests,
+		m.requestDuration,
+		m.requestsInFlight,
+		m.operationDuration,
+		m.operationErrors,
+		m.users,
+	)
+	return m
+}
+
+// AddRoutes adds the `/metrics` route to the router.
+func (m *Metrics) AddRoutes(r *mux.Router) {
+	r.Handle("/metrics", promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})).Methods("GET")
+}
+
+// Middleware records the metrics of the requests. It wraps the root router, so that the requests that do not match
+// a route are recorded too, with the `unknown` route. The route is only known if the router uses route.Record,
+// inside route.Middleware.
+func (m *Metrics) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.requestsInFlight.Inc()
+		defer m.requestsInFlight.Dec()
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		template := route.Template(r)
+		if template == "" {
+			template = "unknown"
+		}
+		labels := prometheus.Labels{
+			"route":  template,
+			"method": r.Method,
+			"status": strconv.Itoa(rec.status),
+		}
+		m.requests.With(labels).Inc()
+		m.requestDuration.With(labels).Observe(time.Since(start).Seconds())
+	})
+}
+
+// statusRecorder records the status code of the response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (r *statusRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap returns the original response writer, for http.ResponseController.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,144 @@
+package metrics_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/kicodelibrary/go-http-server-2024/api"
+	"github.com/kicodelibrary/go-http-server-2024/pkg/database"
+	"github.com/kicodelibrary/go-http-server-2024/pkg/database/databasetest"
+	"github.com/kicodelibrary/go-http-server-2024/pkg/database/mock"
+	. "github.com/kicodelibrary/go-http-server-2024/pkg/metrics"
+	"github.com/kicodelibrary/go-http-server-2024/pkg/server/route"
+	"github.com/smarty/assertions"
+)
+
+// scrape returns the metrics in the text format.
+func scrape(t *testing.T, router http.Handler) string {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, "/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", rec.Code)
+	}
+	body, err := io.ReadAll(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestMiddleware(t *testing.T) {
+	a := assertions.New(t)
+	m := New()
+	router := mux.NewRouter()
+	router.Use(route.Record)
+	handler := route.Middleware(m.Middleware(router))
+	m.AddRoutes(router)
+	sub := router.PathPrefix("/users").Subrouter()
+	sub.HandleFunc("/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if mux.Vars(r)["id"] == "missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("ok"))
+	}).Methods("GET")
+
+	for _, path := range []string{"/users/alice", "/users/bob", "/users/missing", "/other"} {
+		req, err := http.NewRequest(http.MethodGet, path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// The requests are labeled by route template, not by path.
+	metrics := scrape(t, handler)
+	a.So(metrics, assertions.ShouldContainSubstring, `http_requests_total{method="GET",route="/users/{id}",status="200"} 2`)
+	a.So(metrics, assertions.ShouldContainSubstring, `http_requests_total{method="GET",route="/users/{id}",status="404"} 1`)
+	// The requests that do not match a route are recorded too.
+	a.So(metrics, assertions.ShouldContainSubstring, `http_requests_total{method="GET",route="unknown",status="404"} 1`)
+	a.So(metrics, assertions.ShouldContainSubstring, `http_request_duration_seconds_count{method="GET",route="/users/{id}",status="200"} 2`)
+	a.So(metrics, assertions.ShouldNotContainSubstring, "alice")
+	// The scrape is in flight.
+	a.So(metrics, assertions.ShouldContainSubstring, "http_requests_in_flight 1")
+	a.So(metrics, assertions.ShouldContainSubstring, "go_goroutines")
+}
+
+func TestUsers(t *testing.T) {
+	databasetest.RunUsersSuite(t, func(t *testing.T) database.Users {
+		users, err := New().Users(context.Background(), mock.NewUsers())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return users
+	})
+}
+
+func TestUsersMetrics(t *testing.T) {
+	a := assertions.New(t)
+	ctx := context.Background()
+	m := New()
+	router := mux.NewRouter()
+	m.AddRoutes(router)
+
+	// The existing users are counted.
+	db := mock.NewUsers()
+	if _, err := db.Create(ctx, api.User{ID: "alice", Name: "Alice", Age: 30}); err != nil {
+		t.Fatal(err)
+	}
+	users, err := m.Users(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.So(scrape(t, router), assertions.ShouldContainSubstring, "\nusers 1\n")
+
+	// The count is updated by the successful operations only.
+	if _, err := users.Create(ctx, api.User{ID: "bob", Name: "Bob", Age: 30}); err != nil {
+		t.Fatal(err)
+	}
+	users.Create(ctx, api.User{ID: "bob", Name: "Bob", Age: 30})
+	if err := users.Delete(ctx, "alice", 0); err != nil {
+		t.Fatal(err)
+	}
+	users.Delete(ctx, "alice", 0)
+	users.Get(ctx, "alice")
+
+	metrics := scrape(t, router)
+	a.So(metrics, assertions.ShouldContainSubstring, "\nusers 1\n")
+	a.So(metrics, assertions.ShouldContainSubstring, `database_operation_duration_seconds_count{operation="create"} 2`)
+	a.So(metrics, assertions.ShouldContainSubstring, `database_operation_errors_total{error="user_already_exists",operation="create"} 1`)
+	a.So(metrics, assertions.ShouldContainSubstring, `database_operation_errors_total{error="user_not_found",operation="delete"} 1`)
+	a.So(metrics, assertions.ShouldContainSubstring, `database_operation_errors_total{error="user_not_found",operation="get"} 1`)
+	a.So(strings.Contains(metrics, `operation="update"`), assertions.ShouldBeFalse)
+}
+
+func TestUsersCountPages(t *testing.T) {
+	a := assertions.New(t)
+	ctx := context.Background()
+	m := New()
+	router := mux.NewRouter()
+	m.AddRoutes(router)
+
+	// Hide database.Counter, so that the users are counted by listing several pages.
+	db := mock.NewUsers()
+	for i := 0; i < 2500; i++ {
+		if _, err := db.Create(ctx, api.User{ID: fmt.Sprintf("user%04d", i), Name: "User", Age: 30}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := m.Users(ctx, struct{ database.Users }{db}); err != nil {
+		t.Fatal(err)
+	}
+	a.So(scrape(t, router), assertions.ShouldContainSubstring, "\nusers 2500\n")
+}
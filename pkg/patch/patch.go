@@ -0,0 +1,415 @@
+// Package patch applies patches to JSON documents.
+// It supports JSON Merge Patch (RFC 7396) and JSON Patch (RFC 6902).
+package patch
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Media types of the patch formats.
+const (
+	MergePatchType = "application/merge-patch+json"
+	JSONPatchType  = "application/json-patch+json"
+)
+
+var (
+	ErrInvalidPatch   = errors.New("invalid patch")
+	ErrPathNotFound   = errors.New("path not found")
+	ErrTestFailed     = errors.New("test operation failed")
+	ErrInvalidPointer = errors.New("invalid JSON pointer")
+)
+
+// decode decodes JSON, keeping numbers as json.Number so that they are not changed by the patch.
+func decode(b []byte) (any, error) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var v any
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	if d.More() {
+		return nil, fmt.Errorf("unexpected data after the JSON value")
+	}
+	return v, nil
+}
+
+// MergePatch applies a JSON Merge Patch (RFC 7396) to the document.
+func MergePatch(doc, patch []byte) ([]byte, error) {
+	target, err := decode(doc)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode document: %w", err)
+	}
+	p, err := decode(patch)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+	}
+	return json.Marshal(mergePatch(target, p))
+}
+
+// mergePatch implements the MergePatch function of RFC 7396, section 2.
+func mergePatch(target, patch any) any {
+	p, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]any)
+	if !ok {
+		t = make(map[string]any)
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+			continue
+		}
+		t[k] = mergePatch(t[k], v)
+	}
+	return t
+}
+
+// operation is a JSON Patch operation.
+type operation struct {
+	Op    string           `json:"op"`
+	Path  *string          `json:"path"`
+	From  *string          `json:"from"`
+	Value *json.RawMessage `json:"value"`
+}
+
+// JSONPatch applies a JSON Patch (RFC 6902) to the document.
+// The operations are applied in order. If any operation fails, an error is returned and no changes are made.
+func JSONPatch(doc, patch []byte) ([]byte, error) {
+	root, err := decode(doc)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode document: %w", err)
+	}
+	var ops []operation
+	if err := json.Unmarshal(patch, &ops); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+	}
+	for i, op := range ops {
+		root, err = apply(root, op)
+		if err != nil {
+			return nil, fmt.Errorf("operation %d (%s): %w", i, op.Op, err)
+		}
+	}
+	return json.Marshal(root)
+}
+
+// apply applies the operation to the document and returns the new document.
+func apply(root any, op operation) (any, error) {
+	if op.Path == nil {
+		return nil, fmt.Errorf("%w: missing path", ErrInvalidPatch)
+	}
+	path, err := parsePointer(*op.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	// value returns the decoded value of the operation.
+	value := func() (any, error) {
+		if op.Value == nil {
+			return nil, fmt.Errorf("%w: missing value", ErrInvalidPatch)
+		}
+		return decode(*op.Value)
+	}
+	// from returns the parsed `from` pointer of the operation.
+	from := func() ([]string, error) {
+		if op.From == nil {
+			return nil, fmt.Errorf("%w: missing from", ErrInvalidPatch)
+		}
+		return parsePointer(*op.From)
+	}
+
+	switch op.Op {
+	case "add":
+		v, err := value()
+		if err != nil {
+			return nil, err
+		}
+		return add(root, path, v)
+	case "remove":
+		return remove(root, path)
+	case "replace":
+		v, err := value()
+		if err != nil {
+			return nil, err
+		}
+		return replace(root, path, v)
+	case "move":
+		src, err := from()
+		if err != nil {
+			return nil, err
+		}
+		if isPrefix(src, path) && len(src) < len(path) {
+			return nil, fmt.Errorf("%w: cannot move a value into one of its children", ErrInvalidPatch)
+		}
+		v, err := get(root, src)
+		if err != nil {
+			return nil, err
+		}
+		if root, err = remove(root, src); err != nil {
+			return nil, err
+		}
+		return add(root, path, v)
+	case "copy":
+		src, err := from()
+		if err != nil {
+			return nil, err
+		}
+		v, err := get(root, src)
+		if err != nil {
+			return nil, err
+		}
+		return add(root, path, deepCopy(v))
+	case "test":
+		v, err := value()
+		if err != nil {
+			return nil, err
+		}
+		actual, err := get(root, path)
+		if err != nil {
+			return nil, err
+		}
+		if !equal(actual, v) {
+			return nil, ErrTestFailed
+		}
+		return root, nil
+	default:
+		return nil, fmt.Errorf("%w: unknown operation %q", ErrInvalidPatch, op.Op)
+	}
+}
+
+// parsePointer parses a JSON pointer (RFC 6901) into reference tokens.
+func parsePointer(s string) ([]string, error) {
+	if s == "" {
+		return nil, nil // The whole document.
+	}
+	if !strings.HasPrefix(s, "/") {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidPointer, s)
+	}
+	tokens := strings.Split(s[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(t)
+	}
+	return tokens, nil
+}
+
+// isPrefix returns true if the tokens of a are a prefix of the tokens of b.
+func isPrefix(a, b []string) bool {
+	if len(a) > len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// index parses an array index. The index must be less than max.
+func index(token string, max int) (int, error) {
+	// Leading zeros are not allowed.
+	if token == "" || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("%w: invalid array index %q", ErrInvalidPointer, token)
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 {
+		return 0, fmt.Errorf("%w: invalid array index %q", ErrInvalidPointer, token)
+	}
+	if i >= max {
+		return 0, fmt.Errorf("%w: array index %d out of range", ErrPathNotFound, i)
+	}
+	return i, nil
+}
+
+// get returns the value at the path.
+func get(node any, path []string) (any, error) {
+	for _, token := range path {
+		switch n := node.(type) {
+		case map[string]any:
+			v, ok := n[token]
+			if !ok {
+				return nil, fmt.Errorf("%w: %q", ErrPathNotFound, token)
+			}
+			node = v
+		case []any:
+			i, err := index(token, len(n))
+			if err != nil {
+				return nil, err
+			}
+			node = n[i]
+		default:
+			return nil, fmt.Errorf("%w: %q", ErrPathNotFound, token)
+		}
+	}
+	return node, nil
+}
+
+// update walks to the parent of the last token of the path, and replaces it with the result of fn.
+// It returns the new node, since changing the length of an array creates a new slice.
+func update(node any, path []string, fn func(parent any, token string) (any, error)) (any, error) {
+	if len(path) == 1 {
+		return fn(node, path[0])
+	}
+	child, err := get(node, path[:1])
+	if err != nil {
+		return nil, err
+	}
+	child, err = update(child, path[1:], fn)
+	if err != nil {
+		return nil, err
+	}
+	switch n := node.(type) {
+	case map[string]any:
+		n[path[0]] = child
+	case []any:
+		i, _ := index(path[0], len(n)) // This was checked by get.
+		n[i] = child
+	}
+	return node, nil
+}
+
+// add implements the `add` operation.
+func add(root any, path []string, value any) (any, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return update(root, path, func(parent any, token string) (any, error) {
+		switch p := parent.(type) {
+		case map[string]any:
+			p[token] = value
+			return p, nil
+		case []any:
+			if token == "-" {
+				return append(p, value), nil
+			}
+			// Inserting at the end of the array is allowed.
+			i, err := index(token, len(p)+1)
+			if err != nil {
+				return nil, err
+			}
+			p = append(p, nil)
+			copy(p[i+1:], p[i:])
+			p[i] = value
+			return p, nil
+		default:
+			return nil, fmt.Errorf("%w: %q", ErrPathNotFound, token)
+		}
+	})
+}
+
+// remove implements the `remove` operation.
+func remove(root any, path []string) (any, error) {
+	if len(path) == 0 {
+		return nil, fmt.Errorf("%w: cannot remove the whole document", ErrInvalidPatch)
+	}
+	return update(root, path, func(parent any, token string) (any, error) {
+		switch p := parent.(type) {
+		case map[string]any:
+			if _, ok := p[token]; !ok {
+				return nil, fmt.Errorf("%w: %q", ErrPathNotFound, token)
+			}
+			delete(p, token)
+			return p, nil
+		case []any:
+			i, err := index(token, len(p))
+			if err != nil {
+				return nil, err
+			}
+			return append(p[:i:i], p[i+1:]...), nil
+		default:
+			return nil, fmt.Errorf("%w: %q", ErrPathNotFound, token)
+		}
+	})
+}
+
+// replace implements the `replace` operation.
+func replace(root any, path []string, value any) (any, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return update(root, path, func(parent any, token string) (any, error) {
+		switch p := parent.(type) {
+		case map[string]any:
+			if _, ok := p[token]; !ok {
+				return nil, fmt.Errorf("%w: %q", ErrPathNotFound, token)
+			}
+			p[token] = value
+			return p, nil
+		case []any:
+			i, err := index(token, len(p))
+			if err != nil {
+				return nil, err
+			}
+			p[i] = value
+			return p, nil
+		default:
+			return nil, fmt.Errorf("%w: %q", ErrPathNotFound, token)
+		}
+	})
+}
+
+// deepCopy copies objects and arrays, so that copied values are not shared.
+func deepCopy(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		c := make(map[string]any, len(v))
+		for k, e := range v {
+			c[k] = deepCopy(e)
+		}
+		return c
+	case []any:
+		c := make([]any, len(v))
+		for i, e := range v {
+			c[i] = deepCopy(e)
+		}
+		return c
+	default:
+		return v
+	}
+}
+
+// equal compares JSON values as defined by the `test` operation.
+// Numbers are equal if their values are equal, regardless of their representation.
+func equal(a, b any) bool {
+	switch a := a.(type) {
+	case map[string]any:
+		b, ok := b.(map[string]any)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for k, v := range a {
+			w, ok := b[k]
+			if !ok || !equal(v, w) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		b, ok := b.([]any)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !equal(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	case json.Number:
+		b, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		x, errA := a.Float64()
+		y, errB := b.Float64()
+		return errA == nil && errB == nil && x == y
+	default:
+		return a == b
+	}
+}
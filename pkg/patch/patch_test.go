@@ -0,0 +1,181 @@
+package patch
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/smarty/assertions"
+)
+
+func TestMergePatch(t *testing.T) {
+	a := assertions.New(t)
+
+	// Test cases from RFC 7396, appendix A.
+	for _, test := range []struct {
+		Name     string
+		Doc      string
+		Patch    string
+		Expected string
+	}{
+		{Name: "Replace", Doc: `{"a":"b"}`, Patch: `{"a":"c"}`, Expected: `{"a":"c"}`},
+		{Name: "Add", Doc: `{"a":"b"}`, Patch: `{"b":"c"}`, Expected: `{"a":"b","b":"c"}`},
+		{Name: "Remove", Doc: `{"a":"b"}`, Patch: `{"a":null}`, Expected: `{}`},
+		{Name: "RemoveOne", Doc: `{"a":"b","b":"c"}`, Patch: `{"a":null}`, Expected: `{"b":"c"}`},
+		{Name: "ReplaceArray", Doc: `{"a":["b"]}`, Patch: `{"a":"c"}`, Expected: `{"a":"c"}`},
+		{Name: "ReplaceWithArray", Doc: `{"a":"c"}`, Patch: `{"a":["b"]}`, Expected: `{"a":["b"]}`},
+		{Name: "Nested", Doc: `{"a":{"b":"c"}}`, Patch: `{"a":{"b":"d","c":null}}`, Expected: `{"a":{"b":"d"}}`},
+		{Name: "ArrayOfObjects", Doc: `{"a":[{"b":"c"}]}`, Patch: `{"a":[1]}`, Expected: `{"a":[1]}`},
+		{Name: "Arrays", Doc: `["a","b"]`, Patch: `["c","d"]`, Expected: `["c","d"]`},
+		{Name: "ObjectToArray", Doc: `{"a":"b"}`, Patch: `["c"]`, Expected: `["c"]`},
+		{Name: "Null", Doc: `{"a":"foo"}`, Patch: `null`, Expected: `null`},
+		{Name: "String", Doc: `{"a":"foo"}`, Patch: `"bar"`, Expected: `"bar"`},
+		{Name: "KeepNull", Doc: `{"e":null}`, Patch: `{"a":1}`, Expected: `{"a":1,"e":null}`},
+		{Name: "ArrayToObject", Doc: `[1,2]`, Patch: `{"a":"b","c":null}`, Expected: `{"a":"b"}`},
+		{Name: "NewNested", Doc: `{}`, Patch: `{"a":{"bb":{"ccc":null}}}`, Expected: `{"a":{"bb":{}}}`},
+	} {
+		t.Run(test.Name, func(t *testing.T) {
+			res, err := MergePatch([]byte(test.Doc), []byte(test.Patch))
+			if err != nil {
+				t.Fatal(err)
+			}
+			a.So(string(res), assertions.ShouldEqual, test.Expected)
+		})
+	}
+
+	_, err := MergePatch([]byte(`{}`), []byte(`{`))
+	a.So(errors.Is(err, ErrInvalidPatch), assertions.ShouldBeTrue)
+}
+
+func TestJSONPatch(t *testing.T) {
+	a := assertions.New(t)
+
+	// Most test cases are from RFC 6902, appendix A.
+	for _, test := range []struct {
+		Name     string
+		Doc      string
+		Patch    string
+		Expected string
+		Error    error
+	}{
+		{
+			Name:     "AddObjectMember",
+			Doc:      `{"foo":"bar"}`,
+			Patch:    `[{"op":"add","path":"/baz","value":"qux"}]`,
+			Expected: `{"baz":"qux","foo":"bar"}`,
+		},
+		{
+			Name:     "AddArrayElement",
+			Doc:      `{"foo":["bar","baz"]}`,
+			Patch:    `[{"op":"add","path":"/foo/1","value":"qux"}]`,
+			Expected: `{"foo":["bar","qux","baz"]}`,
+		},
+		{
+			Name:     "AppendArrayElement",
+			Doc:      `{"foo":["bar"]}`,
+			Patch:    `[{"op":"add","path":"/foo/-","value":["abc","def"]}]`,
+			Expected: `{"foo":["bar",["abc","def"]]}`,
+		},
+		{
+			Name:     "RemoveObjectMember",
+			Doc:      `{"baz":"qux","foo":"bar"}`,
+			Patch:    `[{"op":"remove","path":"/baz"}]`,
+			Expected: `{"foo":"bar"}`,
+		},
+		{
+			Name:     "RemoveArrayElement",
+			Doc:      `{"foo":["bar","qux","baz"]}`,
+			Patch:    `[{"op":"remove","path":"/foo/1"}]`,
+			Expected: `{"foo":["bar","baz"]}`,
+		},
+		{
+			Name:     "Replace",
+			Doc:      `{"baz":"qux","foo":"bar"}`,
+			Patch:    `[{"op":"replace","path":"/baz","value":"boo"}]`,
+			Expected: `{"baz":"boo","foo":"bar"}`,
+		},
+		{
+			Name:     "Move",
+			Doc:      `{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`,
+			Patch:    `[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`,
+			Expected: `{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`,
+		},
+		{
+			Name:     "MoveArrayElement",
+			Doc:      `{"foo":["all","grass","cows","eat"]}`,
+			Patch:    `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`,
+			Expected: `{"foo":["all","cows","eat","grass"]}`,
+		},
+		{
+			Name:     "Copy",
+			Doc:      `{"foo":{"bar":1}}`,
+			Patch:    `[{"op":"copy","from":"/foo","path":"/baz"},{"op":"replace","path":"/baz/bar","value":2}]`,
+			Expected: `{"baz":{"bar":2},"foo":{"bar":1}}`,
+		},
+		{
+			Name:     "Test",
+			Doc:      `{"baz":"qux","foo":["a",2,"c"]}`,
+			Patch:    `[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2.0}]`,
+			Expected: `{"baz":"qux","foo":["a",2,"c"]}`,
+		},
+		{
+			Name:  "TestFailed",
+			Doc:   `{"baz":"qux"}`,
+			Patch: `[{"op":"test","path":"/baz","value":"bar"}]`,
+			Error: ErrTestFailed,
+		},
+		{
+			Name:  "AddToNonexistentTarget",
+			Doc:   `{"foo":"bar"}`,
+			Patch: `[{"op":"add","path":"/baz/bat","value":"qux"}]`,
+			Error: ErrPathNotFound,
+		},
+		{
+			Name:     "EscapedPointer",
+			Doc:      `{"/":9,"~1":10}`,
+			Patch:    `[{"op":"test","path":"/~01","value":10},{"op":"replace","path":"/~1","value":8}]`,
+			Expected: `{"/":8,"~1":10}`,
+		},
+		{
+			Name:  "InvalidArrayIndex",
+			Doc:   `{"foo":["bar"]}`,
+			Patch: `[{"op":"replace","path":"/foo/01","value":"baz"}]`,
+			Error: ErrInvalidPointer,
+		},
+		{
+			Name:  "RemoveMissing",
+			Doc:   `{"foo":"bar"}`,
+			Patch: `[{"op":"remove","path":"/baz"}]`,
+			Error: ErrPathNotFound,
+		},
+		{
+			Name:  "UnknownOperation",
+			Doc:   `{"foo":"bar"}`,
+			Patch: `[{"op":"delete","path":"/foo"}]`,
+			Error: ErrInvalidPatch,
+		},
+		{
+			Name:  "MissingValue",
+			Doc:   `{"foo":"bar"}`,
+			Patch: `[{"op":"add","path":"/baz"}]`,
+			Error: ErrInvalidPatch,
+		},
+		{
+			Name:  "MoveIntoChild",
+			Doc:   `{"foo":{"bar":1}}`,
+			Patch: `[{"op":"move","from":"/foo","path":"/foo/bar"}]`,
+			Error: ErrInvalidPatch,
+		},
+	} {
+		t.Run(test.Name, func(t *testing.T) {
+			res, err := JSONPatch([]byte(test.Doc), []byte(test.Patch))
+			if test.Error != nil {
+				a.So(errors.Is(err, test.Error), assertions.ShouldBeTrue)
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			a.So(string(res), assertions.ShouldEqual, test.Expected)
+		})
+	}
+}
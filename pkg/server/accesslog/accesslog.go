@@ -0,0 +1,234 @@
+// Package accesslog logs a line for every request served, in the Apache Common or Combined log format,
+// or in JSON lines.
+//
+// The JSON format has more fields than the Apache formats: the route template of gorilla/mux, the duration
+// and the request ID (see the requestid package).
+package accesslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kicodelibrary/go-http-server-2024/pkg/server/requestid"
+	"github.com/kicodelibrary/go-http-server-2024/pkg/server/route"
+)
+
+// Format is the format of the access log.
+type Format string
+
+// Formats.
+const (
+	// FormatCommon is the Common Log Format, ex:
+	// `127.0.0.1 - - [10/Oct/2024:13:55:36 +0000] "GET /users/alice HTTP/1.1" 200 2326`.
+	FormatCommon Format = "common"
+	// FormatCombined is the Combined Log Format: the Common Log Format followed by the referer and the user agent.
+	FormatCombined Format = "combined"
+	// FormatJSON is a JSON object per line (see Entry).
+	FormatJSON Format = "json"
+)
+
+// clfTime is the time layout of the Common Log Format.
+const clfTime = "02/Jan/2006:15:04:05 -0700"
+
+// Entry is a line of the access log, in the JSON format.
+type Entry struct {
+	Time       time.Time `json:"time"`
+	RequestID  string    `json:"request_id,omitempty"`
+	RemoteAddr string    `json:"remote_addr"`
+	Method     string    `json:"method"`
+	// Route is the route template, ex: `/users/{id}`. It is empty if the request does not match a route.
+	Route string `json:"route"`
+	// URI is the request URI, with the query.
+	URI      string `json:"uri"`
+	Proto    string `json:"proto"`
+	Status   int    `json:"status"`
+	Bytes    int64  `json:"bytes"`
+	Duration string `json:"duration"`
+	// DurationSeconds is the duration, for queries.
+	DurationSeconds float64 `json:"duration_seconds"`
+	Referer         string  `json:"referer,omitempty"`
+	UserAgent       string  `json:"user_agent,omitempty"`
+}
+
+// Logger writes the access log.
+type Logger struct {
+	format Format
+	// sample2xx is the fraction of successful requests that are logged.
+	sample2xx float64
+	random    func() float64
+	now       func() time.Time
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// Option configures the logger.
+type Option func(*Logger)
+
+// WithSampling logs only a fraction (between 0 and 1) of the requests with a 2xx status, which are usually the bulk
+// of the traffic and the least interesting. The other requests are always logged. The default is 1 (log everything).
+func WithSampling(rate float64) Option {
+	return func(l *Logger) {
+		l.sample2xx = rate
+	}
+}
+
+// WithRandom sets the source of the sampling, which returns numbers in [0, 1). The default is math/rand/v2.Float64.
+func WithRandom(random func() float64) Option {
+	return func(l *Logger) {
+		l.random = random
+	}
+}
+
+// WithClock sets the function that returns the current time. The default is time.Now.
+func WithClock(now func() time.Time) Option {
+	return func(l *Logger) {
+		l.now = now
+	}
+}
+
+// New creates a logger that writes the access log to w in the format.
+func New(w io.Writer, format Format, opts ...Option) (*Logger, error) {
+	switch format {
+	case FormatCommon, FormatCombined, FormatJSON:
+	default:
+		return nil, fmt.Errorf("unknown access log format %q, must be %s, %s or %s", format, FormatCommon, FormatCombined, FormatJSON)
+	}
+	l := &Logger{
+		format:    format,
+		sample2xx: 1,
+		random:    rand.Float64,
+		now:       time.Now,
+		w:         w,
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	if l.sample2xx < 0 || l.sample2xx > 1 {
+		return nil, fmt.Errorf("the sampling rate must be between 0 and 1, got %v", l.sample2xx)
+	}
+	return l, nil
+}
+
+// Middleware logs the requests once they are served. It wraps the root router, so that the requests that do not match
+// a route are logged too. The route is only known if the router uses route.Record, inside route.Middleware.
+func (l *Logger) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := l.now()
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		if rec.status >= 200 && rec.status < 300 && l.sample2xx < 1 && l.random() >= l.sample2xx {
+			return
+		}
+		entry := Entry{
+			Time:       start,
+			RequestID:  requestid.FromContext(r.Context()),
+			RemoteAddr: r.RemoteAddr,
+			Method:     r.Method,
+			URI:        r.RequestURI,
+			Proto:      r.Proto,
+			Status:     rec.status,
+			Bytes:      rec.bytes,
+			Referer:    r.Referer(),
+			UserAgent:  r.UserAgent(),
+		}
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			entry.RemoteAddr = host
+		}
+		if entry.URI == "" {
+			entry.URI = r.URL.RequestURI()
+		}
+		entry.Route = route.Template(r)
+		duration := l.now().Sub(start)
+		entry.Duration = duration.String()
+		entry.DurationSeconds = duration.Seconds()
+		l.write(entry)
+	})
+}
+
+// write writes the entry in the format of the logger.
+func (l *Logger) write(entry Entry) {
+	var line []byte
+	switch l.format {
+	case FormatJSON:
+		b, err := json.Marshal(entry)
+		if err != nil {
+			panic(err) // There should be no error here.
+		}
+		line = append(b, '\n')
+	default:
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "%s - - [%s] %s %d %s",
+			orDash(entry.RemoteAddr),
+			entry.Time.Format(clfTime),
+			strconv.Quote(entry.Method+" "+entry.URI+" "+entry.Proto),
+			entry.Status,
+			clfBytes(entry.Bytes),
+		)
+		if l.format == FormatCombined {
+			fmt.Fprintf(&sb, " %s %s", strconv.Quote(entry.Referer), strconv.Quote(entry.UserAgent))
+		}
+		sb.WriteByte('\n')
+		line = []byte(sb.String())
+	}
+
+	// Lines are written at once, so that concurrent requests do not interleave.
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(line)
+}
+
+// orDash returns `-` for empty values, as in the Common Log Format.
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// clfBytes returns the size of the body in the Common Log Format, where empty bodies are `-`.
+func clfBytes(n int64) string {
+	if n == 0 {
+		return "-"
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+// responseRecorder records the status code and the size of the body of the response.
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (r *responseRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements http.ResponseWriter.
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap returns the original response writer, for http.ResponseController.
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,160 @@
+package accesslog_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	. "github.com/kicodelibrary/go-http-server-2024/pkg/server/accesslog"
+	"github.com/kicodelibrary/go-http-server-2024/pkg/server/requestid"
+	"github.com/kicodelibrary/go-http-server-2024/pkg/server/route"
+	"github.com/smarty/assertions"
+)
+
+// clock is the clock of the loggers in the tests.
+func clock() time.Time {
+	return time.Date(2024, 10, 10, 13, 55, 36, 0, time.UTC)
+}
+
+// serve serves the requests with a router logged by the logger.
+func serve(t *testing.T, logger *Logger, paths ...string) {
+	router := mux.NewRouter()
+	router.Use(route.Record)
+	handler := route.Middleware(logger.Middleware(router))
+	router.HandleFunc("/users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if mux.Vars(r)["id"] == "missing" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"id":"alice"}`))
+	}).Methods("GET")
+
+	for _, path := range paths {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("User-Agent", "test/1.0")
+		req.Header.Set("Referer", "https://example.com/")
+		req = req.WithContext(requestid.NewContext(req.Context(), "abc123"))
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	a := assertions.New(t)
+
+	for _, tc := range []struct {
+		Name     string
+		Format   Format
+		Expected string
+	}{
+		{
+			Name:   "Common",
+			Format: FormatCommon,
+			Expected: `192.0.2.1 - - [10/Oct/2024:13:55:36 +0000] "GET /users/alice?fields=id HTTP/1.1" 200 14` + "\n" +
+				`192.0.2.1 - - [10/Oct/2024:13:55:36 +0000] "GET /users/missing HTTP/1.1" 404 10` + "\n",
+		},
+		{
+			Name:   "Combined",
+			Format: FormatCombined,
+			Expected: `192.0.2.1 - - [10/Oct/2024:13:55:36 +0000] "GET /users/alice?fields=id HTTP/1.1" 200 14 "https://example.com/" "test/1.0"` + "\n" +
+				`192.0.2.1 - - [10/Oct/2024:13:55:36 +0000] "GET /users/missing HTTP/1.1" 404 10 "https://example.com/" "test/1.0"` + "\n",
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger, err := New(&buf, tc.Format, WithClock(clock))
+			if err != nil {
+				t.Fatal(err)
+			}
+			serve(t, logger, "/users/alice?fields=id", "/users/missing")
+			a.So(buf.String(), assertions.ShouldEqual, tc.Expected)
+		})
+	}
+
+	t.Run("JSON", func(t *testing.T) {
+		var buf bytes.Buffer
+		logger, err := New(&buf, FormatJSON, WithClock(clock))
+		if err != nil {
+			t.Fatal(err)
+		}
+		serve(t, logger, "/users/alice")
+		var entry Entry
+		if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+			t.Fatal(err)
+		}
+		a.So(entry, assertions.ShouldResemble, Entry{
+			Time:       clock(),
+			RequestID:  "abc123",
+			RemoteAddr: "192.0.2.1",
+			Method:     http.MethodGet,
+			Route:      "/users/{id}",
+			URI:        "/users/alice",
+			Proto:      "HTTP/1.1",
+			Status:     http.StatusOK,
+			Bytes:      14,
+			Duration:   "0s",
+			Referer:    "https://example.com/",
+			UserAgent:  "test/1.0",
+		})
+	})
+
+	_, err := New(&bytes.Buffer{}, "apache")
+	a.So(err, assertions.ShouldNotBeNil)
+	_, err = New(&bytes.Buffer{}, FormatJSON, WithSampling(2))
+	a.So(err, assertions.ShouldNotBeNil)
+}
+
+func TestLoggerUnmatched(t *testing.T) {
+	a := assertions.New(t)
+	var buf bytes.Buffer
+	logger, err := New(&buf, FormatJSON, WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve(t, logger, "/users/alice", "/other")
+
+	// The requests that do not match a route are logged, without a route.
+	var entries []Entry
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry Entry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	if !a.So(entries, assertions.ShouldHaveLength, 2) {
+		return
+	}
+	a.So(entries[0].Route, assertions.ShouldEqual, "/users/{id}")
+	a.So(entries[1].URI, assertions.ShouldEqual, "/other")
+	a.So(entries[1].Status, assertions.ShouldEqual, http.StatusNotFound)
+	a.So(entries[1].Route, assertions.ShouldBeEmpty)
+}
+
+func TestLoggerSampling(t *testing.T) {
+	a := assertions.New(t)
+
+	// The random numbers alternate, so that half of the successful requests are sampled with a rate of 0.5.
+	var n int
+	random := func() float64 {
+		n++
+		return float64(n%2) * 0.9
+	}
+	var buf bytes.Buffer
+	logger, err := New(&buf, FormatCommon, WithClock(clock), WithSampling(0.5), WithRandom(random))
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve(t, logger, "/users/a", "/users/b", "/users/c", "/users/d", "/users/missing", "/users/missing")
+
+	// The errors are always logged.
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	a.So(lines, assertions.ShouldHaveLength, 4)
+	a.So(strings.Count(buf.String(), `" 200 `), assertions.ShouldEqual, 2)
+	a.So(strings.Count(buf.String(), `" 404 `), assertions.ShouldEqual, 2)
+}
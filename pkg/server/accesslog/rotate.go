@@ -0,0 +1,112 @@
+package accesslog
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// RotatingFile is a file that is rotated when it reaches a maximum size: `access.log` is renamed to `access.log.1`,
+// `access.log.1` to `access.log.2` and so on, and the oldest backup is deleted. It is safe for concurrent use.
+type RotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// OpenRotatingFile opens the file for appending. It is created if it does not exist.
+// If maxSize is zero, the file is never rotated. maxBackups is the number of rotated files that are kept.
+func OpenRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	f, size, err := open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &RotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+		f:          f,
+		size:       size,
+	}, nil
+}
+
+// open opens the file for appending and gets its size.
+func open(path string) (*os.File, int64, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not open access log: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, fmt.Errorf("could not open access log: %w", err)
+	}
+	return f, info.Size(), nil
+}
+
+// Write implements io.Writer. The file is rotated before the write if it would exceed the maximum size,
+// so that lines are not split between files. If the rotation fails, the line is still written to the current file,
+// and the rotation is retried on the next write.
+func (r *RotatingFile) Write(b []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var rotateErr error
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(b)) > r.maxSize {
+		rotateErr = r.rotate()
+	}
+	n, err := r.f.Write(b)
+	r.size += int64(n)
+	if err == nil {
+		err = rotateErr
+	}
+	return n, err
+}
+
+// rotate renames the file and the backups, and opens a new file. The lock must be held.
+// The current file is only closed once the new file is open, so that it can still be written if the rotation fails.
+func (r *RotatingFile) rotate() error {
+	if r.maxBackups == 0 {
+		// There is no backup to rename the file to: empty it. The writes are appended, so they restart at the beginning.
+		if err := r.f.Truncate(0); err != nil {
+			return fmt.Errorf("could not rotate access log: %w", err)
+		}
+		r.size = 0
+		return nil
+	}
+	for i := r.maxBackups - 1; i > 0; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("could not rotate access log: %w", err)
+		}
+	}
+	// The open file is renamed too, and can still be written.
+	if err := os.Rename(r.path, r.path+".1"); err != nil {
+		return fmt.Errorf("could not rotate access log: %w", err)
+	}
+	f, size, err := open(r.path)
+	if err != nil {
+		// Move the file back, so that the next rotation starts from a consistent state.
+		if renameErr := os.Rename(r.path+".1", r.path); renameErr != nil {
+			return errors.Join(err, fmt.Errorf("could not restore access log: %w", renameErr))
+		}
+		return err
+	}
+	old := r.f
+	r.f, r.size = f, size
+	if err := old.Close(); err != nil {
+		return fmt.Errorf("could not close rotated access log: %w", err)
+	}
+	return nil
+}
+
+// Close closes the file.
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
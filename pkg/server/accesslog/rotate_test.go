@@ -0,0 +1,122 @@
+package accesslog_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/kicodelibrary/go-http-server-2024/pkg/server/accesslog"
+	"github.com/smarty/assertions"
+)
+
+func TestRotatingFile(t *testing.T) {
+	a := assertions.New(t)
+	path := filepath.Join(t.TempDir(), "access.log")
+
+	// read returns the content of the file, or an empty string if it does not exist.
+	read := func(path string) string {
+		b, err := os.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	// Each file holds two lines of 4 bytes, and two backups are kept.
+	f, err := OpenRotatingFile(path, 8, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"aaa\n", "bbb\n", "ccc\n", "ddd\n", "eee\n", "fff\n", "ggg\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	a.So(read(path), assertions.ShouldEqual, "ggg\n")
+	a.So(read(path+".1"), assertions.ShouldEqual, "eee\nfff\n")
+	a.So(read(path+".2"), assertions.ShouldEqual, "ccc\nddd\n")
+	a.So(read(path+".3"), assertions.ShouldEqual, "")
+
+	// The size of an existing file is taken into account.
+	f, err = OpenRotatingFile(path, 8, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write([]byte("hhhh\n")); err != nil {
+		t.Fatal(err)
+	}
+	a.So(read(path), assertions.ShouldEqual, "hhhh\n")
+	a.So(read(path+".1"), assertions.ShouldEqual, "ggg\n")
+	a.So(read(path+".2"), assertions.ShouldEqual, "eee\nfff\n")
+}
+
+func TestRotatingFileNoBackups(t *testing.T) {
+	a := assertions.New(t)
+	path := filepath.Join(t.TempDir(), "access.log")
+	f, err := OpenRotatingFile(path, 8, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, line := range []string{"aaa\n", "bbb\n", "ccc\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.So(string(b), assertions.ShouldEqual, "ccc\n")
+	_, err = os.Stat(path + ".1")
+	a.So(os.IsNotExist(err), assertions.ShouldBeTrue)
+}
+
+func TestRotatingFileRenameError(t *testing.T) {
+	a := assertions.New(t)
+	path := filepath.Join(t.TempDir(), "access.log")
+
+	// read returns the content of the file.
+	read := func(path string) string {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	// The backup is a directory, so the file cannot be renamed to it.
+	if err := os.Mkdir(path+".1", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := OpenRotatingFile(path, 8, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, line := range []string{"aaa\n", "bbb\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The rotation fails, but the line is written to the current file.
+	n, err := f.Write([]byte("ccc\n"))
+	a.So(err, assertions.ShouldNotBeNil)
+	a.So(n, assertions.ShouldEqual, 4)
+	a.So(read(path), assertions.ShouldEqual, "aaa\nbbb\nccc\n")
+
+	// The rotation is retried on the next write.
+	if err := os.Remove(path + ".1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("ddd\n")); err != nil {
+		t.Fatal(err)
+	}
+	a.So(read(path), assertions.ShouldEqual, "ddd\n")
+	a.So(read(path+".1"), assertions.ShouldEqual, "aaa\nbbb\nccc\n")
+}
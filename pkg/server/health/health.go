@@ -0,0 +1,159 @@
+// Package health serves the liveness (`/healthz`) and readiness (`/readyz`) routes, which are probed by orchestrators
+// such as Kubernetes.
+//
+// The server is live if it can serve requests: if not, it should be restarted. It is ready if it can serve requests
+// successfully, ex: if the database is reachable: if not, it should not receive traffic until it recovers.
+// Components register the checks of their state in a Registry.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/kicodelibrary/go-http-server-2024/api"
+)
+
+// Check checks a component. It returns nil if the component is healthy.
+// It must return when the context is done.
+type Check func(ctx context.Context) error
+
+// namedCheck is a registered check.
+type namedCheck struct {
+	Name  string
+	Check Check
+}
+
+// Registry holds the health checks. It is safe for concurrent use, so checks can be added while serving.
+type Registry struct {
+	timeout time.Duration
+
+	mu        sync.RWMutex
+	liveness  []namedCheck
+	readiness []namedCheck
+}
+
+// Option configures the registry.
+type Option func(*Registry)
+
+// WithTimeout sets the maximum duration of each check. A check that takes longer fails. The default is 5 seconds.
+func WithTimeout(timeout time.Duration) Option {
+	return func(r *Registry) {
+		r.timeout = timeout
+	}
+}
+
+// NewRegistry creates a new registry without checks.
+func NewRegistry(opts ...Option) *Registry {
+	r := &Registry{
+		timeout: 5 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// AddLiveness adds a liveness check. Liveness checks should only fail if restarting the server fixes the problem.
+func (r *Registry) AddLiveness(name string, check Check) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.liveness = append(r.liveness, namedCheck{Name: name, Check: check})
+}
+
+// AddReadiness adds a readiness check, ex: that a dependency is reachable.
+func (r *Registry) AddReadiness(name string, check Check) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.readiness = append(r.readiness, namedCheck{Name: name, Check: check})
+}
+
+// AddRoutes adds the `/healthz` and `/readyz` routes to the router.
+func (r *Registry) AddRoutes(router *mux.Router) {
+	router.HandleFunc("/healthz", r.Liveness).Methods("GET")
+	router.HandleFunc("/readyz", r.Readiness).Methods("GET")
+}
+
+// Liveness runs the liveness checks. The response is 200 OK if all the checks pass, and 503 Service Unavailable otherwise.
+// The body lists the result of each check (see api.HealthResponse).
+func (r *Registry) Liveness(w http.ResponseWriter, req *http.Request) {
+	r.mu.RLock()
+	checks := r.liveness
+	r.mu.RUnlock()
+	r.serve(w, req, checks)
+}
+
+// Readiness runs the readiness checks, like Liveness.
+func (r *Registry) Readiness(w http.ResponseWriter, req *http.Request) {
+	r.mu.RLock()
+	checks := r.readiness
+	r.mu.RUnlock()
+	r.serve(w, req, checks)
+}
+
+// serve runs the checks concurrently and writes the response.
+func (r *Registry) serve(w http.ResponseWriter, req *http.Request, checks []namedCheck) {
+	// The response is always going to be JSON.
+	w.Header().Set("Content-Type", "application/json")
+	// Probes must see the current state.
+	w.Header().Set("Cache-Control", "no-store")
+
+	res := api.HealthResponse{
+		Status: api.HealthStatusPass,
+	}
+	if len(checks) > 0 {
+		res.Checks = make(map[string]api.HealthCheck, len(checks))
+	}
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	for _, c := range checks {
+		wg.Add(1)
+		go func(c namedCheck) {
+			defer wg.Done()
+			result := r.run(req.Context(), c.Check)
+			mu.Lock()
+			defer mu.Unlock()
+			res.Checks[c.Name] = result
+			if result.Status != api.HealthStatusPass {
+				res.Status = api.HealthStatusFail
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	msg, err := json.Marshal(res)
+	if err != nil {
+		slog.ErrorContext(req.Context(), "could not marshal response", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if res.Status != api.HealthStatusPass {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.Write(msg)
+}
+
+// run runs the check with the timeout.
+func (r *Registry) run(ctx context.Context, check Check) api.HealthCheck {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	start := time.Now()
+	err := check(ctx)
+	result := api.HealthCheck{
+		Status:   api.HealthStatusPass,
+		Duration: time.Since(start).String(),
+	}
+	if err != nil {
+		result.Status = api.HealthStatusFail
+		result.Error = err.Error()
+	}
+	return result
+}
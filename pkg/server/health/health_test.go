@@ -0,0 +1,101 @@
+package health_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/kicodelibrary/go-http-server-2024/api"
+	. "github.com/kicodelibrary/go-http-server-2024/pkg/server/health"
+	"github.com/smarty/assertions"
+)
+
+// probe gets the route and returns the status code and the decoded response.
+func probe(t *testing.T, router http.Handler, path string) (int, api.HealthResponse) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("unexpected content type: %q", rec.Header().Get("Content-Type"))
+	}
+	var res api.HealthResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Code, res
+}
+
+// statuses returns the status and error of each check, without the durations.
+func statuses(res api.HealthResponse) map[string]api.HealthCheck {
+	ret := make(map[string]api.HealthCheck, len(res.Checks))
+	for name, check := range res.Checks {
+		check.Duration = ""
+		ret[name] = check
+	}
+	return ret
+}
+
+func TestRegistry(t *testing.T) {
+	a := assertions.New(t)
+	registry := NewRegistry(WithTimeout(50 * time.Millisecond))
+	router := mux.NewRouter()
+	registry.AddRoutes(router)
+
+	// Without checks, the server is live and ready.
+	code, res := probe(t, router, "/healthz")
+	a.So(code, assertions.ShouldEqual, http.StatusOK)
+	a.So(res, assertions.ShouldResemble, api.HealthResponse{Status: api.HealthStatusPass})
+	code, res = probe(t, router, "/readyz")
+	a.So(code, assertions.ShouldEqual, http.StatusOK)
+	a.So(res, assertions.ShouldResemble, api.HealthResponse{Status: api.HealthStatusPass})
+
+	// The readiness fails if any check fails, and reports all the checks.
+	var dbErr error
+	registry.AddReadiness("database", func(ctx context.Context) error {
+		return dbErr
+	})
+	registry.AddReadiness("cache", func(ctx context.Context) error {
+		return nil
+	})
+	code, res = probe(t, router, "/readyz")
+	a.So(code, assertions.ShouldEqual, http.StatusOK)
+	a.So(res.Status, assertions.ShouldEqual, api.HealthStatusPass)
+	a.So(statuses(res), assertions.ShouldResemble, map[string]api.HealthCheck{
+		"database": {Status: api.HealthStatusPass},
+		"cache":    {Status: api.HealthStatusPass},
+	})
+	a.So(res.Checks["database"].Duration, assertions.ShouldNotBeEmpty)
+
+	dbErr = errors.New("connection refused")
+	code, res = probe(t, router, "/readyz")
+	a.So(code, assertions.ShouldEqual, http.StatusServiceUnavailable)
+	a.So(res.Status, assertions.ShouldEqual, api.HealthStatusFail)
+	a.So(statuses(res), assertions.ShouldResemble, map[string]api.HealthCheck{
+		"database": {Status: api.HealthStatusFail, Error: "connection refused"},
+		"cache":    {Status: api.HealthStatusPass},
+	})
+
+	// The liveness checks are separate.
+	code, _ = probe(t, router, "/healthz")
+	a.So(code, assertions.ShouldEqual, http.StatusOK)
+
+	// Slow checks fail after the timeout.
+	registry.AddLiveness("deadlock", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	code, res = probe(t, router, "/healthz")
+	a.So(code, assertions.ShouldEqual, http.StatusServiceUnavailable)
+	a.So(statuses(res), assertions.ShouldResemble, map[string]api.HealthCheck{
+		"deadlock": {Status: api.HealthStatusFail, Error: context.DeadlineExceeded.Error()},
+	})
+}
@@ -0,0 +1,252 @@
+// Package ratelimit limits the rate of the requests of each client with token buckets.
+//
+// Each client has a bucket for the read requests (GET, HEAD and OPTIONS) and a bucket for the write requests
+// (the other methods). A bucket holds up to Burst tokens, and is refilled at Rate tokens per second. Each request takes
+// a token, and is rejected with 429 Too Many Requests if the bucket is empty.
+//
+// By default, clients are identified by their principal (see auth.FromContext), ex: their API key, so the middleware
+// must run after the authentication. Clients that are not authenticated are identified by their IP address.
+// Since the requests with invalid credentials are rejected by the authentication, a limiter of the IP addresses
+// (see WithClient and IP) should also run before the authentication, so that guessing credentials is limited too.
+//
+// The responses have the RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers
+// (see https://datatracker.ietf.org/doc/draft-ietf-httpapi-ratelimit-headers/), and the rejected requests have
+// a Retry-After header.
+//
+// The memory is bounded: the buckets of idle clients are evicted, and so are the least recently used buckets when there
+// are too many clients.
+package ratelimit
+
+import (
+	"container/list"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/kicodelibrary/go-http-server-2024/api"
+	"github.com/kicodelibrary/go-http-server-2024/pkg/auth"
+)
+
+// Headers.
+const (
+	// LimitHeader is the maximum number of requests that can be sent at once (the burst).
+	LimitHeader = "RateLimit-Limit"
+	// RemainingHeader is the number of requests that can be sent now.
+	RemainingHeader = "RateLimit-Remaining"
+	// ResetHeader is the number of seconds until the bucket is full again.
+	ResetHeader = "RateLimit-Reset"
+)
+
+// Limit is the limit of a kind of requests.
+type Limit struct {
+	// Rate is the number of requests per second. Zero disables the limit.
+	Rate float64
+	// Burst is the number of requests that can be sent at once. It is at least 1.
+	Burst int
+}
+
+// bucket is the token bucket of a client.
+type bucket struct {
+	key    string
+	tokens float64
+	// last is the time of the last request, when the tokens were refilled.
+	last time.Time
+}
+
+// Limiter limits the rate of the requests of each client. It is safe for concurrent use.
+type Limiter struct {
+	read, write Limit
+	now         func() time.Time
+	idleTimeout time.Duration
+	maxClients  int
+	client      func(r *http.Request) string
+
+	mu sync.Mutex
+	// buckets are the buckets by key, which are the elements of lru.
+	buckets map[string]*list.Element
+	// lru is the list of the buckets, from the most recently used.
+	lru *list.List
+}
+
+// Option configures the limiter.
+type Option func(*Limiter)
+
+// WithClock sets the function that returns the current time. The default is time.Now.
+func WithClock(now func() time.Time) Option {
+	return func(l *Limiter) {
+		l.now = now
+	}
+}
+
+// WithIdleTimeout sets the time after which the bucket of an idle client is evicted. The default is 10 minutes.
+// It should be longer than the time to refill the buckets (Burst / Rate), otherwise idle clients get more requests.
+func WithIdleTimeout(timeout time.Duration) Option {
+	return func(l *Limiter) {
+		l.idleTimeout = timeout
+	}
+}
+
+// WithMaxClients sets the maximum number of buckets. The default is 100000.
+// When there are more clients, the least recently used buckets are evicted.
+func WithMaxClients(n int) Option {
+	return func(l *Limiter) {
+		l.maxClients = n
+	}
+}
+
+// WithClient sets the function that identifies the client of a request. The default is Client.
+func WithClient(client func(r *http.Request) string) Option {
+	return func(l *Limiter) {
+		l.client = client
+	}
+}
+
+// New creates a limiter with the limits of the read and the write requests.
+// The options with values that are not positive are ignored.
+func New(read, write Limit, opts ...Option) *Limiter {
+	l := &Limiter{
+		read:    read.normalize(),
+		write:   write.normalize(),
+		now:     time.Now,
+		client:  Client,
+		buckets: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	if l.idleTimeout <= 0 {
+		l.idleTimeout = 10 * time.Minute
+	}
+	if l.maxClients <= 0 {
+		l.maxClients = 100000
+	}
+	return l
+}
+
+// normalize returns the limit with a burst of at least 1.
+func (l Limit) normalize() Limit {
+	l.Burst = max(l.Burst, 1)
+	return l
+}
+
+// Middleware rejects the requests of the clients that exceed their limit. It is a mux.MiddlewareFunc.
+func (l *Limiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit, kind := l.write, "write"
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			limit, kind = l.read, "read"
+		}
+		if limit.Rate <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		res := l.take(kind+" "+l.client(r), limit)
+		w.Header().Set(LimitHeader, strconv.Itoa(limit.Burst))
+		w.Header().Set(RemainingHeader, strconv.Itoa(res.remaining))
+		w.Header().Set(ResetHeader, strconv.Itoa(seconds(res.reset)))
+		if !res.allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(max(seconds(res.retryAfter), 1)))
+			api.NewProblem(http.StatusTooManyRequests, api.CodeRateLimited, "too many requests, retry later").Write(w)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Client identifies the client of the request by its principal, or by its IP address if it is not authenticated.
+func Client(r *http.Request) string {
+	if principal := auth.FromContext(r.Context()); principal != nil {
+		return "principal " + principal.Method + " " + principal.Subject
+	}
+	return IP(r)
+}
+
+// IP identifies the client of the request by the IP address of the connection.
+func IP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip " + host
+}
+
+// result is the result of taking a token.
+type result struct {
+	allowed bool
+	// remaining is the number of tokens left.
+	remaining int
+	// reset is the time until the bucket is full.
+	reset time.Duration
+	// retryAfter is the time until there is a token, if the request is not allowed.
+	retryAfter time.Duration
+}
+
+// take takes a token from the bucket of the key.
+func (l *Limiter) take(key string, limit Limit) result {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.evict(now)
+
+	var b *bucket
+	if e, ok := l.buckets[key]; ok {
+		l.lru.MoveToFront(e)
+		b = e.Value.(*bucket)
+		// Refill the tokens since the last request.
+		b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	} else {
+		if l.lru.Len() >= l.maxClients {
+			l.remove(l.lru.Back())
+		}
+		b = &bucket{key: key, tokens: float64(limit.Burst)}
+		l.buckets[key] = l.lru.PushFront(b)
+	}
+	b.last = now
+
+	var res result
+	if b.tokens >= 1 {
+		b.tokens--
+		res.allowed = true
+	} else {
+		res.retryAfter = rateDuration(1-b.tokens, limit.Rate)
+	}
+	res.remaining = int(b.tokens)
+	res.reset = rateDuration(float64(limit.Burst)-b.tokens, limit.Rate)
+	return res
+}
+
+// evict removes the buckets that are idle since the timeout. The lock must be held.
+func (l *Limiter) evict(now time.Time) {
+	for e := l.lru.Back(); e != nil && now.Sub(e.Value.(*bucket).last) >= l.idleTimeout; e = l.lru.Back() {
+		l.remove(e)
+	}
+}
+
+// remove removes a bucket. The lock must be held.
+func (l *Limiter) remove(e *list.Element) {
+	l.lru.Remove(e)
+	delete(l.buckets, e.Value.(*bucket).key)
+}
+
+// Len returns the number of buckets, ex: for tests and metrics.
+func (l *Limiter) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lru.Len()
+}
+
+// rateDuration returns the time to get the tokens at the rate.
+func rateDuration(tokens, rate float64) time.Duration {
+	return time.Duration(tokens / rate * float64(time.Second))
+}
+
+// seconds rounds up the duration to seconds, as in the headers.
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,121 @@
+package ratelimit_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kicodelibrary/go-http-server-2024/api"
+	"github.com/kicodelibrary/go-http-server-2024/pkg/auth"
+	. "github.com/kicodelibrary/go-http-server-2024/pkg/server/ratelimit"
+	"github.com/smarty/assertions"
+)
+
+// ok is the handler of the allowed requests.
+var ok = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+// do sends a request from the address, and the principal if not nil.
+func do(h http.Handler, method, remoteAddr string, principal *auth.Principal) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/users/", nil)
+	req.RemoteAddr = remoteAddr
+	if principal != nil {
+		req = req.WithContext(auth.NewContext(req.Context(), principal))
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestLimiter(t *testing.T) {
+	a := assertions.New(t)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := New(Limit{Rate: 1, Burst: 2}, Limit{Rate: 0.25, Burst: 1}, WithClock(func() time.Time { return now }))
+	h := l.Middleware(ok)
+
+	// The burst is allowed, with the remaining requests in the headers.
+	for _, remaining := range []string{"1", "0"} {
+		rec := do(h, http.MethodGet, "192.0.2.1:1234", nil)
+		a.So(rec.Code, assertions.ShouldEqual, http.StatusOK)
+		a.So(rec.Header().Get(LimitHeader), assertions.ShouldEqual, "2")
+		a.So(rec.Header().Get(RemainingHeader), assertions.ShouldEqual, remaining)
+	}
+	a.So(do(h, http.MethodGet, "192.0.2.1:1234", nil).Header().Get(ResetHeader), assertions.ShouldEqual, "2")
+
+	// Then the requests are rejected until a token is added.
+	rec := do(h, http.MethodGet, "192.0.2.1:5678", nil)
+	a.So(rec.Code, assertions.ShouldEqual, http.StatusTooManyRequests)
+	a.So(rec.Header().Get("Retry-After"), assertions.ShouldEqual, "1")
+	a.So(rec.Header().Get(RemainingHeader), assertions.ShouldEqual, "0")
+	var p api.Problem
+	if err := json.Unmarshal(rec.Body.Bytes(), &p); err != nil {
+		t.Fatal(err)
+	}
+	a.So(p.Code, assertions.ShouldEqual, api.CodeRateLimited)
+
+	// The write requests and the other clients have their own buckets.
+	a.So(do(h, http.MethodPost, "192.0.2.1:1234", nil).Code, assertions.ShouldEqual, http.StatusOK)
+	rec = do(h, http.MethodDelete, "192.0.2.1:1234", nil)
+	a.So(rec.Code, assertions.ShouldEqual, http.StatusTooManyRequests)
+	a.So(rec.Header().Get("Retry-After"), assertions.ShouldEqual, "4")
+	a.So(do(h, http.MethodGet, "192.0.2.2:1234", nil).Code, assertions.ShouldEqual, http.StatusOK)
+
+	// The bucket is refilled over time.
+	now = now.Add(time.Second)
+	a.So(do(h, http.MethodGet, "192.0.2.1:1234", nil).Code, assertions.ShouldEqual, http.StatusOK)
+	a.So(do(h, http.MethodGet, "192.0.2.1:1234", nil).Code, assertions.ShouldEqual, http.StatusTooManyRequests)
+
+	// Authenticated clients are identified by their principal, from any address.
+	principal := &auth.Principal{Subject: "key1", Method: "api_key"}
+	a.So(do(h, http.MethodGet, "192.0.2.1:1234", principal).Code, assertions.ShouldEqual, http.StatusOK)
+	a.So(do(h, http.MethodGet, "192.0.2.3:1234", principal).Code, assertions.ShouldEqual, http.StatusOK)
+	a.So(do(h, http.MethodGet, "192.0.2.4:1234", principal).Code, assertions.ShouldEqual, http.StatusTooManyRequests)
+}
+
+func TestLimiterEviction(t *testing.T) {
+	a := assertions.New(t)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := New(Limit{Rate: 1, Burst: 1}, Limit{Rate: 1, Burst: 1},
+		WithClock(func() time.Time { return now }),
+		WithIdleTimeout(time.Minute),
+		WithMaxClients(2),
+	)
+	h := l.Middleware(ok)
+
+	// The least recently used buckets are evicted when there are too many clients.
+	do(h, http.MethodGet, "192.0.2.1:1234", nil)
+	do(h, http.MethodGet, "192.0.2.2:1234", nil)
+	do(h, http.MethodGet, "192.0.2.3:1234", nil)
+	a.So(l.Len(), assertions.ShouldEqual, 2)
+
+	// The idle buckets are evicted.
+	now = now.Add(30 * time.Second)
+	do(h, http.MethodGet, "192.0.2.3:1234", nil)
+	now = now.Add(30 * time.Second)
+	do(h, http.MethodPost, "192.0.2.3:1234", nil)
+	a.So(l.Len(), assertions.ShouldEqual, 2)
+	now = now.Add(time.Minute)
+	do(h, http.MethodGet, "192.0.2.4:1234", nil)
+	a.So(l.Len(), assertions.ShouldEqual, 1)
+}
+
+func TestLimiterDisabled(t *testing.T) {
+	a := assertions.New(t)
+	h := New(Limit{}, Limit{Rate: 1, Burst: 1}).Middleware(ok)
+	for i := 0; i < 10; i++ {
+		rec := do(h, http.MethodGet, "192.0.2.1:1234", nil)
+		a.So(rec.Code, assertions.ShouldEqual, http.StatusOK)
+		a.So(rec.Header().Get(LimitHeader), assertions.ShouldBeEmpty)
+	}
+}
+
+func TestLimiterIP(t *testing.T) {
+	a := assertions.New(t)
+	h := New(Limit{Rate: 1, Burst: 1}, Limit{Rate: 1, Burst: 1}, WithClient(IP)).Middleware(ok)
+
+	// The principals share the bucket of their address.
+	a.So(do(h, http.MethodGet, "192.0.2.1:1234", &auth.Principal{Subject: "key1", Method: "api_key"}).Code, assertions.ShouldEqual, http.StatusOK)
+	a.So(do(h, http.MethodGet, "192.0.2.1:5678", &auth.Principal{Subject: "key2", Method: "api_key"}).Code, assertions.ShouldEqual, http.StatusTooManyRequests)
+	a.So(do(h, http.MethodGet, "192.0.2.2:1234", nil).Code, assertions.ShouldEqual, http.StatusOK)
+}
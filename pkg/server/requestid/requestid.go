@@ -0,0 +1,55 @@
+// Package requestid correlates the logs and the responses of a request with an ID.
+//
+// The ID is taken from the X-Request-ID header of the request, so that it can be set by a proxy or by the client,
+// or generated if there is none. It is returned in the X-Request-ID header of the response.
+package requestid
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+
+	"github.com/kicodelibrary/go-http-server-2024/api"
+	"github.com/kicodelibrary/go-http-server-2024/pkg/ids"
+)
+
+// validID restricts the IDs that are propagated, so that clients cannot inject arbitrary content in the logs.
+var validID = regexp.MustCompile(`^[A-Za-z0-9._:/+=-]{1,128}$`)
+
+// contextKey is the key of the ID in the context.
+type contextKey struct{}
+
+// NewContext returns a context with the request ID.
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the request ID of the context, or an empty string if there is none.
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
+
+// Middleware sets the ID of the requests. Invalid IDs are replaced by generated IDs.
+// The ID is set in the response header before calling the next handler, so that problem responses include it
+// (see api.Problem.Write).
+func Middleware(next http.Handler) http.Handler {
+	g, err := ids.NewGenerator(ids.FormatULID, nil, nil)
+	if err != nil {
+		panic(err) // The format is valid.
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(api.RequestIDHeader)
+		if !validID.MatchString(id) {
+			generated, err := g.New()
+			if err != nil {
+				// Serve the request without an ID rather than failing it.
+				next.ServeHTTP(w, r)
+				return
+			}
+			id = generated
+		}
+		w.Header().Set(api.RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), id)))
+	})
+}
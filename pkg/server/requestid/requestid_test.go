@@ -0,0 +1,60 @@
+package requestid_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kicodelibrary/go-http-server-2024/api"
+	. "github.com/kicodelibrary/go-http-server-2024/pkg/server/requestid"
+	"github.com/smarty/assertions"
+)
+
+func TestMiddleware(t *testing.T) {
+	a := assertions.New(t)
+
+	// The handler returns the ID of the context in a problem.
+	var fromContext string
+	h := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fromContext = FromContext(r.Context())
+		api.NewProblem(http.StatusBadRequest, api.CodeInvalidBody, "").Write(w)
+	}))
+
+	for _, tc := range []struct {
+		Name      string
+		RequestID string
+		Generated bool
+	}{
+		{Name: "Propagated", RequestID: "f47ac10b-58cc-4372-a567-0e02b2c3d479"},
+		{Name: "Missing", Generated: true},
+		{Name: "Invalid", RequestID: "id\nwith newline", Generated: true},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, "/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.RequestID != "" {
+				req.Header.Set(api.RequestIDHeader, tc.RequestID)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			id := rec.Header().Get(api.RequestIDHeader)
+			if tc.Generated {
+				a.So(id, assertions.ShouldHaveLength, 26)
+			} else {
+				a.So(id, assertions.ShouldEqual, tc.RequestID)
+			}
+			a.So(fromContext, assertions.ShouldEqual, id)
+
+			// Error responses have the ID.
+			var p api.Problem
+			if err := json.Unmarshal(rec.Body.Bytes(), &p); err != nil {
+				t.Fatal(err)
+			}
+			a.So(p.RequestID, assertions.ShouldEqual, id)
+		})
+	}
+}
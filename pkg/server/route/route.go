@@ -0,0 +1,59 @@
+// Package route makes the route template of gorilla/mux available to the middlewares that wrap the whole router.
+//
+// The middlewares of mux only run for the requests that match a route, so the middlewares that must also see the
+// other requests (ex: the 404 and 405 responses in the access log and the metrics) wrap the router instead.
+// mux passes the matched route to the handlers in a copy of the request, which these middlewares do not see:
+// Middleware adds a holder to the context of the request, and Record fills it with the route matched by the router.
+package route
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// holder holds the template of the route matched by the router.
+type holder struct {
+	template string
+}
+
+// contextKey is the key of the holder in the context.
+type contextKey struct{}
+
+// Middleware adds a holder of the route to the context of the requests. It wraps the router, which must use Record.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Context().Value(contextKey{}).(*holder); ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, &holder{})))
+	})
+}
+
+// Record records the template of the matched route, for Template. It is a mux.MiddlewareFunc: add it to the router
+// with Use.
+func Record(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h, ok := r.Context().Value(contextKey{}).(*holder); ok {
+			if current := mux.CurrentRoute(r); current != nil {
+				h.template, _ = current.GetPathTemplate()
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Template returns the template of the route of the request, ex: `/users/{id}`, or an empty string if the request
+// does not match a route. The middlewares that wrap the router must call it after the router served the request.
+func Template(r *http.Request) string {
+	if current := mux.CurrentRoute(r); current != nil {
+		template, _ := current.GetPathTemplate()
+		return template
+	}
+	if h, ok := r.Context().Value(contextKey{}).(*holder); ok {
+		return h.template
+	}
+	return ""
+}
@@ -0,0 +1,54 @@
+package route_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	. "github.com/kicodelibrary/go-http-server-2024/pkg/server/route"
+	"github.com/smarty/assertions"
+)
+
+func TestTemplate(t *testing.T) {
+	a := assertions.New(t)
+	router := mux.NewRouter()
+	router.Use(Record)
+	var inside string
+	router.HandleFunc("/users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		inside = Template(r)
+	}).Methods("GET")
+
+	// outside is the template seen by a middleware that wraps the router.
+	var outside string
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		router.ServeHTTP(w, r)
+		outside = Template(r)
+	}))
+
+	for _, tc := range []struct {
+		Name     string
+		Method   string
+		Path     string
+		Status   int
+		Template string
+	}{
+		{Name: "Match", Method: http.MethodGet, Path: "/users/alice", Status: http.StatusOK, Template: "/users/{id}"},
+		{Name: "NotFound", Method: http.MethodGet, Path: "/other", Status: http.StatusNotFound},
+		{Name: "MethodNotAllowed", Method: http.MethodPost, Path: "/users/alice", Status: http.StatusMethodNotAllowed},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			inside, outside = "", "unset"
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(tc.Method, tc.Path, nil))
+			a.So(rec.Code, assertions.ShouldEqual, tc.Status)
+			a.So(inside, assertions.ShouldEqual, tc.Template)
+			a.So(outside, assertions.ShouldEqual, tc.Template)
+		})
+	}
+
+	// Without Middleware, the template is only known inside the router.
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/users/alice", nil))
+	a.So(inside, assertions.ShouldEqual, "/users/{id}")
+	a.So(Template(httptest.NewRequest(http.MethodGet, "/users/alice", nil)), assertions.ShouldBeEmpty)
+}
@@ -0,0 +1,242 @@
+// Package tlsconfig configures the TLS of the server.
+//
+// The certificate is reloaded when its files change, so that it can be renewed (ex: by cert-manager or certbot)
+// without a restart. The files are checked at most once per second, on the handshakes. With a client CA bundle,
+// the clients must present a certificate signed by one of the CAs (mutual TLS), and the verified certificate
+// authenticates the client (see the mtls package).
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config is the TLS configuration of the server.
+type Config struct {
+	// CertFile and KeyFile are the paths of the PEM certificate (with the intermediates) and private key.
+	CertFile, KeyFile string
+	// MinVersion is the minimum version of TLS: 1.2 or 1.3. Empty means 1.2.
+	MinVersion string
+	// CipherSuites are the names of the cipher suites of TLS 1.2, ex: `TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256`.
+	// Empty means the secure defaults of Go. The cipher suites of TLS 1.3 cannot be configured.
+	CipherSuites []string
+	// ClientCAFile is the path of the PEM bundle of the CAs of the client certificates. Empty disables mutual TLS.
+	ClientCAFile string
+	// ClientAuth is `require` to reject the clients without a certificate, or `optional` to only verify the
+	// certificates that are presented (ex: for the health checks of load balancers). Empty means `require`.
+	ClientAuth string
+}
+
+// Enabled returns true if TLS is configured.
+func (c Config) Enabled() bool {
+	return c.CertFile != "" || c.KeyFile != ""
+}
+
+// TLSConfig returns the TLS configuration of the server. The options configure the reloading of the certificate.
+func (c Config) TLSConfig(opts ...Option) (*tls.Config, error) {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return nil, errors.New("tls: both the certificate and the key are required")
+	}
+	minVersion, err := ParseVersion(c.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	cipherSuites, err := ParseCipherSuites(c.CipherSuites)
+	if err != nil {
+		return nil, err
+	}
+	reloader, err := NewReloader(c.CertFile, c.KeyFile, opts...)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		MinVersion:     minVersion,
+		CipherSuites:   cipherSuites,
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	switch {
+	case c.ClientCAFile != "":
+		b, err := os.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls: could not read client CAs: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("tls: no certificate in client CAs %s", c.ClientCAFile)
+		}
+		config.ClientCAs = pool
+		switch c.ClientAuth {
+		case "", "require":
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		case "optional":
+			config.ClientAuth = tls.VerifyClientCertIfGiven
+		default:
+			return nil, fmt.Errorf("tls: unknown client auth %q, must be require or optional", c.ClientAuth)
+		}
+	case c.ClientAuth != "":
+		return nil, errors.New("tls: the client auth requires client CAs")
+	}
+	return config, nil
+}
+
+// ParseVersion parses a TLS version: 1.2 or 1.3. Empty means 1.2.
+func ParseVersion(s string) (uint16, error) {
+	switch s {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("tls: unsupported version %q, must be 1.2 or 1.3", s)
+	}
+}
+
+// ParseCipherSuites parses the names of cipher suites. Only the secure cipher suites are supported (see tls.CipherSuites).
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	ids := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		ids[suite.Name] = suite.ID
+	}
+	suites := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := ids[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("tls: unsupported or insecure cipher suite %q", name)
+		}
+		suites = append(suites, id)
+	}
+	return suites, nil
+}
+
+// fileState is the state of a file, to detect changes.
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+// stat returns the state of the file.
+func stat(path string) (fileState, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileState{}, err
+	}
+	return fileState{modTime: info.ModTime(), size: info.Size()}, nil
+}
+
+// Reloader loads a certificate, and reloads it when its files change. It is safe for concurrent use.
+type Reloader struct {
+	certFile, keyFile string
+	now               func() time.Time
+	interval          time.Duration
+	logger            *slog.Logger
+
+	mu                  sync.Mutex
+	cert                *tls.Certificate
+	certState, keyState fileState
+	// checked is the time of the last check of the files.
+	checked time.Time
+	// lastErr is the error of the last reload, to log the errors once and not on every check.
+	lastErr string
+}
+
+// Option configures the reloader.
+type Option func(*Reloader)
+
+// WithClock sets the function that returns the current time. The default is time.Now.
+func WithClock(now func() time.Time) Option {
+	return func(r *Reloader) {
+		r.now = now
+	}
+}
+
+// WithCheckInterval sets the minimum time between the checks of the files. The default is 1 second.
+// Zero checks the files on every handshake.
+func WithCheckInterval(interval time.Duration) Option {
+	return func(r *Reloader) {
+		r.interval = interval
+	}
+}
+
+// WithLogger sets the logger of the reload errors. The default is slog.Default.
+func WithLogger(logger *slog.Logger) Option {
+	return func(r *Reloader) {
+		r.logger = logger
+	}
+}
+
+// NewReloader loads the certificate and its key.
+func NewReloader(certFile, keyFile string, opts ...Option) (*Reloader, error) {
+	r := &Reloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		now:      time.Now,
+		interval: time.Second,
+		logger:   slog.Default(),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	r.checked = r.now()
+	return r, nil
+}
+
+// reload loads the certificate again if its files changed. The lock must be held.
+func (r *Reloader) reload() error {
+	certState, err := stat(r.certFile)
+	if err != nil {
+		return fmt.Errorf("tls: could not read certificate: %w", err)
+	}
+	keyState, err := stat(r.keyFile)
+	if err != nil {
+		return fmt.Errorf("tls: could not read key: %w", err)
+	}
+	if r.cert != nil && certState == r.certState && keyState == r.keyState {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		// This also happens while the files are replaced: the reload is retried on the next handshake.
+		return fmt.Errorf("tls: could not load certificate: %w", err)
+	}
+	r.cert, r.certState, r.keyState = &cert, certState, keyState
+	return nil
+}
+
+// GetCertificate returns the certificate, for tls.Config.GetCertificate.
+// The files are checked if the check interval elapsed since the last check.
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	if now.Sub(r.checked) < r.interval {
+		return r.cert, nil
+	}
+	r.checked = now
+
+	// Keep the certificate that was loaded on errors, so that the server keeps working. The errors are only logged
+	// when they change, since they are retried on every check until the files are fixed.
+	err := r.reload()
+	switch {
+	case err != nil && err.Error() != r.lastErr:
+		r.logger.Warn("could not reload TLS certificate", "error", err)
+		r.lastErr = err.Error()
+	case err == nil && r.lastErr != "":
+		r.logger.Info("reloaded TLS certificate")
+		r.lastErr = ""
+	}
+	return r.cert, nil
+}
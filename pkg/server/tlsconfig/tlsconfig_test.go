@@ -0,0 +1,205 @@
+package tlsconfig_test
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kicodelibrary/go-http-server-2024/pkg/logging"
+	. "github.com/kicodelibrary/go-http-server-2024/pkg/server/tlsconfig"
+	"github.com/kicodelibrary/go-http-server-2024/pkg/server/tlsconfig/tlsconfigtest"
+	"github.com/smarty/assertions"
+)
+
+func TestConfig(t *testing.T) {
+	dir := t.TempDir()
+	ca := tlsconfigtest.NewCA(t, "ca")
+	certFile, keyFile := ca.Issue(t, dir, pkix.Name{CommonName: "localhost"}, "localhost")
+	caFile := ca.WriteFile(t, dir)
+
+	for _, tc := range []struct {
+		Name   string
+		Config Config
+		Valid  bool
+		Check  func(a *assertions.Assertion, c *tls.Config)
+	}{
+		{
+			Name:   "Default",
+			Config: Config{CertFile: certFile, KeyFile: keyFile},
+			Valid:  true,
+			Check: func(a *assertions.Assertion, c *tls.Config) {
+				a.So(c.MinVersion, assertions.ShouldEqual, tls.VersionTLS12)
+				a.So(c.CipherSuites, assertions.ShouldBeNil)
+				a.So(c.ClientAuth, assertions.ShouldEqual, tls.NoClientCert)
+			},
+		},
+		{
+			Name: "Options",
+			Config: Config{
+				CertFile:     certFile,
+				KeyFile:      keyFile,
+				MinVersion:   "1.3",
+				CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+				ClientCAFile: caFile,
+			},
+			Valid: true,
+			Check: func(a *assertions.Assertion, c *tls.Config) {
+				a.So(c.MinVersion, assertions.ShouldEqual, tls.VersionTLS13)
+				a.So(c.CipherSuites, assertions.ShouldResemble, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256})
+				a.So(c.ClientAuth, assertions.ShouldEqual, tls.RequireAndVerifyClientCert)
+				a.So(c.ClientCAs, assertions.ShouldNotBeNil)
+			},
+		},
+		{
+			Name:   "OptionalClientAuth",
+			Config: Config{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile, ClientAuth: "optional"},
+			Valid:  true,
+			Check: func(a *assertions.Assertion, c *tls.Config) {
+				a.So(c.ClientAuth, assertions.ShouldEqual, tls.VerifyClientCertIfGiven)
+			},
+		},
+		{Name: "NoKey", Config: Config{CertFile: certFile}},
+		{Name: "MissingCertificate", Config: Config{CertFile: dir + "/missing.pem", KeyFile: keyFile}},
+		{Name: "WrongKey", Config: Config{CertFile: caFile, KeyFile: keyFile}},
+		{Name: "OldVersion", Config: Config{CertFile: certFile, KeyFile: keyFile, MinVersion: "1.1"}},
+		{Name: "InsecureCipherSuite", Config: Config{CertFile: certFile, KeyFile: keyFile, CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}}},
+		{Name: "InvalidClientCAs", Config: Config{CertFile: certFile, KeyFile: keyFile, ClientCAFile: keyFile}},
+		{Name: "UnknownClientAuth", Config: Config{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile, ClientAuth: "maybe"}},
+		{Name: "ClientAuthWithoutCAs", Config: Config{CertFile: certFile, KeyFile: keyFile, ClientAuth: "optional"}},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			a := assertions.New(t)
+			c, err := tc.Config.TLSConfig()
+			if !tc.Valid {
+				a.So(err, assertions.ShouldNotBeNil)
+				return
+			}
+			if !a.So(err, assertions.ShouldBeNil) {
+				return
+			}
+			tc.Check(a, c)
+		})
+	}
+}
+
+func TestReloader(t *testing.T) {
+	a := assertions.New(t)
+	dir := t.TempDir()
+	ca := tlsconfigtest.NewCA(t, "ca")
+	certFile, keyFile := ca.Issue(t, dir, pkix.Name{CommonName: "localhost"}, "127.0.0.1")
+
+	// Check the files on every handshake (see TestReloaderInterval).
+	config, err := Config{CertFile: certFile, KeyFile: keyFile}.TLSConfig(WithCheckInterval(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	// Serve with the configuration as is: httptest.Server.StartTLS would set its own certificate.
+	server.Listener = tls.NewListener(server.Listener, config)
+	server.Start()
+	defer server.Close()
+	url := "https://" + server.Listener.Addr().String()
+
+	// serial returns the serial number of the certificate of the server, with a new connection.
+	serial := func() string {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: ca.Pool()},
+			DisableKeepAlives: true,
+		}}
+		res, err := client.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.TLS.PeerCertificates[0].SerialNumber.String()
+	}
+	first := serial()
+	a.So(serial(), assertions.ShouldEqual, first)
+
+	// Renew the certificate. The files are dated in the future, in case the file system has a coarse resolution.
+	ca.Issue(t, dir, pkix.Name{CommonName: "localhost"}, "127.0.0.1")
+	future := time.Now().Add(time.Minute)
+	for _, path := range []string{certFile, keyFile} {
+		if err := os.Chtimes(path, future, future); err != nil {
+			t.Fatal(err)
+		}
+	}
+	second := serial()
+	a.So(second, assertions.ShouldNotEqual, first)
+
+	// An invalid certificate keeps the previous one.
+	if err := os.WriteFile(certFile, []byte("invalid"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	a.So(serial(), assertions.ShouldEqual, second)
+}
+
+func TestReloaderInterval(t *testing.T) {
+	a := assertions.New(t)
+	dir := t.TempDir()
+	ca := tlsconfigtest.NewCA(t, "ca")
+	certFile, keyFile := ca.Issue(t, dir, pkix.Name{CommonName: "localhost"}, "127.0.0.1")
+
+	var buf bytes.Buffer
+	logger, err := logging.New(&buf, logging.FormatText, "info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	reloader, err := NewReloader(certFile, keyFile, WithClock(func() time.Time { return now }), WithLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// serial returns the serial number of the certificate.
+	serial := func() string {
+		cert, err := reloader.GetCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.SerialNumber.String()
+	}
+	first := serial()
+
+	// Renew the certificate. The files are dated in the future, in case the file system has a coarse resolution.
+	ca.Issue(t, dir, pkix.Name{CommonName: "localhost"}, "127.0.0.1")
+	future := time.Now().Add(time.Minute)
+	for _, path := range []string{certFile, keyFile} {
+		if err := os.Chtimes(path, future, future); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The files are not checked again within the interval.
+	now = now.Add(500 * time.Millisecond)
+	a.So(serial(), assertions.ShouldEqual, first)
+	now = now.Add(500 * time.Millisecond)
+	second := serial()
+	a.So(second, assertions.ShouldNotEqual, first)
+
+	// The errors are logged once, and the recovery is logged too.
+	if err := os.WriteFile(certFile, []byte("invalid"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		now = now.Add(time.Second)
+		a.So(serial(), assertions.ShouldEqual, second)
+	}
+	a.So(strings.Count(buf.String(), "could not reload TLS certificate"), assertions.ShouldEqual, 1)
+
+	ca.Issue(t, dir, pkix.Name{CommonName: "localhost"}, "127.0.0.1")
+	now = now.Add(time.Second)
+	a.So(serial(), assertions.ShouldNotEqual, second)
+	a.So(strings.Count(buf.String(), "reloaded TLS certificate"), assertions.ShouldEqual, 1)
+}
@@ -0,0 +1,102 @@
+package users
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	dbErrors "github.com/kicodelibrary/go-http-server-2024/pkg/database/errors"
+)
+
+// errPreconditionFailed is returned when the If-Match header does not match the current user.
+var errPreconditionFailed = errors.New("precondition failed")
+
+// etag returns the entity tag of a user version (RFC 9110, section 8.8.3), ex: `"3"`.
+func etag(version uint64) string {
+	return `"` + strconv.FormatUint(version, 10) + `"`
+}
+
+// entityTags is a parsed If-Match or If-None-Match header.
+type entityTags struct {
+	// Any is true for `*`.
+	Any bool
+	// Strong are the versions of the strong entity tags.
+	Strong []uint64
+	// Weak are the versions of the weak entity tags (`W/"3"`).
+	Weak []uint64
+}
+
+// parseEntityTags parses the header, which may be sent on several lines.
+// Entity tags that are not user versions are ignored, since they can never match. This includes `"0"`: versions start
+// at 1, and the databases treat the expected version 0 as an unconditional change.
+func parseEntityTags(h http.Header, name string) entityTags {
+	var tags entityTags
+	for _, v := range h.Values(name) {
+		for _, tag := range strings.Split(v, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" {
+				tags.Any = true
+				continue
+			}
+			weak := strings.HasPrefix(tag, "W/")
+			tag = strings.TrimPrefix(tag, "W/")
+			if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+				continue
+			}
+			version, err := strconv.ParseUint(tag[1:len(tag)-1], 10, 64)
+			if err != nil || version == 0 {
+				continue
+			}
+			if weak {
+				tags.Weak = append(tags.Weak, version)
+			} else {
+				tags.Strong = append(tags.Strong, version)
+			}
+		}
+	}
+	return tags
+}
+
+// matchStrong returns true if the version matches with the strong comparison, as required by If-Match.
+func (t entityTags) matchStrong(version uint64) bool {
+	return t.Any || slices.Contains(t.Strong, version)
+}
+
+// matchWeak returns true if the version matches with the weak comparison, as required by If-None-Match.
+func (t entityTags) matchWeak(version uint64) bool {
+	return t.matchStrong(version) || slices.Contains(t.Weak, version)
+}
+
+// expectedVersion returns the version that the If-Match header requires the user to have.
+// It is passed to the database, which compares it atomically with the update. Zero means that the update is unconditional.
+//
+// If the header lists several entity tags, the current user is fetched to select the one that matches.
+// errPreconditionFailed is returned if no entity tag can match.
+func (h *Handler) expectedVersion(r *http.Request, id string) (uint64, error) {
+	if len(r.Header.Values("If-Match")) == 0 {
+		return 0, nil
+	}
+	tags := parseEntityTags(r.Header, "If-Match")
+	switch {
+	case tags.Any:
+		// The database fails if the user does not exist.
+		return 0, nil
+	case len(tags.Strong) == 0:
+		return 0, errPreconditionFailed
+	case len(tags.Strong) == 1:
+		return tags.Strong[0], nil
+	}
+	user, err := h.users.Get(r.Context(), id)
+	if errors.Is(err, dbErrors.ErrUserNotFound) {
+		return 0, errPreconditionFailed
+	}
+	if err != nil {
+		return 0, err
+	}
+	if !tags.matchStrong(user.Version) {
+		return 0, errPreconditionFailed
+	}
+	return user.Version, nil
+}
@@ -0,0 +1,55 @@
+package users
+
+import (
+	"encoding/base64"
+	"encoding/json"
+
+	"github.com/kicodelibrary/go-http-server-2024/api"
+)
+
+// pageToken is the cursor that is passed to clients as an opaque `page_token`.
+// It holds the sort keys of the last user of the previous page.
+type pageToken struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+	Age  int    `json:"age,omitempty"`
+	// Sort is the sort order of the query, since the cursor is only valid for that order.
+	Sort string `json:"sort,omitempty"`
+}
+
+// newPageToken creates a token that continues after the user.
+func newPageToken(after api.User, sort api.UserSort) pageToken {
+	return pageToken{
+		ID:   after.ID,
+		Name: after.Name,
+		Age:  after.Age,
+		Sort: sort.String(),
+	}
+}
+
+// user returns the cursor as a user with the sort keys set.
+func (t pageToken) user() *api.User {
+	return &api.User{
+		ID:   t.ID,
+		Name: t.Name,
+		Age:  t.Age,
+	}
+}
+
+// encode encodes the token as URL safe base64 JSON.
+func (t pageToken) encode() string {
+	b, err := json.Marshal(t)
+	if err != nil {
+		panic(err) // There should be no error here.
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decode decodes a token created by encode.
+func (t *pageToken) decode(s string) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, t)
+}
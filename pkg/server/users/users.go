@@ -1,71 +1,241 @@
 package users
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/kicodelibrary/go-http-server-2024/api"
+	"github.com/kicodelibrary/go-http-server-2024/pkg/auth"
 	"github.com/kicodelibrary/go-http-server-2024/pkg/database"
 	dbErrors "github.com/kicodelibrary/go-http-server-2024/pkg/database/errors"
+	"github.com/kicodelibrary/go-http-server-2024/pkg/ids"
+	"github.com/kicodelibrary/go-http-server-2024/pkg/patch"
+	"github.com/kicodelibrary/go-http-server-2024/pkg/validation"
 )
 
+// Permissions of the routes (see WithAuthorizer).
+const (
+	// PermissionRead allows to list and get users.
+	PermissionRead auth.Permission = "users:read"
+	// PermissionWrite allows to create, update and patch users.
+	PermissionWrite auth.Permission = "users:write"
+	// PermissionDelete allows to delete users.
+	PermissionDelete auth.Permission = "users:delete"
+)
+
+// maxPatchAttempts is the number of times a patch is applied if the user is modified concurrently.
+const maxPatchAttempts = 3
+
 // Handler handles the `/users/` routes.
+// Errors are returned as problem details (see api.Problem) with a stable error code.
 type Handler struct {
-	users database.Users
+	users  database.Users
+	now    func() time.Time
+	rules  *validation.Rules
+	logger *slog.Logger
+	// newID generates the IDs of users created without an ID.
+	newID func() (string, error)
+	// clientIDs is true if clients can choose the IDs of the users they create.
+	clientIDs bool
+	// authorizer checks the permissions of the routes, if not nil.
+	authorizer auth.Authorizer
+	// maxBodySize is the maximum size of the request bodies, in bytes.
+	maxBodySize int64
+}
+
+// Option configures the handler.
+type Option func(*Handler)
+
+// WithClock sets the function that returns the current time, which is used for the timestamps of users.
+// The default is time.Now.
+func WithClock(now func() time.Time) Option {
+	return func(h *Handler) {
+		h.now = now
+	}
+}
+
+// WithRules sets the validation rules of users. The default is validation.Default.
+func WithRules(rules *validation.Rules) Option {
+	return func(h *Handler) {
+		h.rules = rules
+	}
+}
+
+// WithLogger sets the logger. The records are logged with the context of the request, so that they have its ID.
+// The default is slog.Default.
+func WithLogger(logger *slog.Logger) Option {
+	return func(h *Handler) {
+		h.logger = logger
+	}
+}
+
+// WithIDGenerator sets the function that generates the IDs of users created without an ID.
+// The default generates ULIDs (see ids.Generator).
+func WithIDGenerator(newID func() (string, error)) Option {
+	return func(h *Handler) {
+		h.newID = newID
+	}
+}
+
+// WithClientIDs sets whether clients can choose the IDs of the users they create. The default is true.
+// If false, creating a user with an ID fails, and all IDs are generated by the server.
+func WithClientIDs(allowed bool) Option {
+	return func(h *Handler) {
+		h.clientIDs = allowed
+	}
+}
+
+// WithAuthorizer sets the authorizer of the permissions of the routes (ex: rbac.Policy). The default allows all the
+// requests. The routes of a user (`/users/{id}`) are owned by the user, so that principals can be allowed to access
+// their own user only (ex: `users:write:self`). The requests must be authenticated first (see auth.Middleware).
+func WithAuthorizer(authorizer auth.Authorizer) Option {
+	return func(h *Handler) {
+		h.authorizer = authorizer
+	}
+}
+
+// DefaultMaxBodySize is the default maximum size of the request bodies. Users are small, and the databases re-encode
+// them in JSON, which can be several times larger than the body (ex: `<` is escaped as `\u003c`), so this leaves
+// room below the maximum size of the records of the write-ahead log.
+const DefaultMaxBodySize = 64 << 10
+
+// WithMaxBodySize sets the maximum size of the request bodies, in bytes. The default is DefaultMaxBodySize.
+// Larger bodies are rejected with 413 Request Entity Too Large.
+func WithMaxBodySize(n int64) Option {
+	return func(h *Handler) {
+		h.maxBodySize = n
+	}
 }
 
 // New creates a new handler.
-func New(users database.Users) *Handler {
-	return &Handler{
-		users: users,
+func New(users database.Users, opts ...Option) *Handler {
+	h := &Handler{
+		users:       users,
+		now:         time.Now,
+		rules:       validation.Default(),
+		clientIDs:   true,
+		logger:      slog.Default(),
+		maxBodySize: DefaultMaxBodySize,
+	}
+	for _, opt := range opts {
+		opt(h)
 	}
+	if h.newID == nil {
+		// Use the clock of the handler, which may be set by an option.
+		g, err := ids.NewGenerator(ids.FormatULID, h.now, nil)
+		if err != nil {
+			panic(err) // The format is valid.
+		}
+		h.newID = g.New
+	}
+	return h
 }
 
 // AddRoutes adds routes dynamically to the router.
 // The argument passed would be a sub-router with the prefix `/users`.
+// Each route requires a permission, which is checked if the handler has an authorizer.
 func (h Handler) AddRoutes(r *mux.Router) {
 	// List users (GET requests on the `/users/` route.)
-	r.HandleFunc("/", h.List).Methods("GET")
+	r.Handle("/", h.require(PermissionRead, h.List)).Methods("GET")
 
 	// Create users (POST request to /users/).
-	r.HandleFunc("/", h.Create).Methods("POST")
+	r.Handle("/", h.require(PermissionWrite, h.Create)).Methods("POST")
 
 	// Get users (GET request to /users/{id}).
 	// {id} is a variable path (not a query).
-	r.HandleFunc("/{id}", h.Get).Methods("GET")
+	r.Handle("/{id}", h.require(PermissionRead, h.Get)).Methods("GET")
 
 	// Update users (PUT request to /users/{id}).
-	r.HandleFunc("/{id}", h.Update).Methods("PUT")
+	r.Handle("/{id}", h.require(PermissionWrite, h.Update)).Methods("PUT")
+
+	// Partially update users (PATCH request to /users/{id}).
+	r.Handle("/{id}", h.require(PermissionWrite, h.Patch)).Methods("PATCH")
 
 	// Delete users (DELETE request to /users/{id}).
-	r.HandleFunc("/{id}", h.Delete).Methods("DELETE")
+	r.Handle("/{id}", h.require(PermissionDelete, h.Delete)).Methods("DELETE")
+}
+
+// require returns the handler of a route that requires the permission.
+func (h Handler) require(permission auth.Permission, next http.HandlerFunc) http.Handler {
+	if h.authorizer == nil {
+		return next
+	}
+	return auth.Require(h.authorizer, permission, owner)(next)
+}
+
+// owner returns the owner of the resource of the request: a user owns itself, and the list has no owner.
+func owner(r *http.Request) string {
+	return mux.Vars(r)["id"]
 }
 
 // List handles the list user route (`/`).
+// The users are filtered, sorted and paginated based on the query (see api.ParseListUsersOptions).
+// The `page_token` parameter continues from the `next_page_token` of the previous page.
+//
+// If there are more users, the response contains a `next_page_token` and a `Link` header to the next page.
 func (h Handler) List(w http.ResponseWriter, r *http.Request) {
 	// The response is always going to be JSON.
 	w.Header().Set("Content-Type", "application/json")
 
+	// Parse the query.
+	query := r.URL.Query()
+	opts, err := api.ParseListUsersOptions(query)
+	if err != nil {
+		api.NewProblem(http.StatusBadRequest, api.CodeInvalidQuery, err.Error()).Write(w)
+		return
+	}
+	if v := query.Get("page_token"); v != "" {
+		var cursor pageToken
+		if err := cursor.decode(v); err != nil || cursor.Sort != opts.Sort.String() {
+			api.NewProblem(http.StatusBadRequest, api.CodeInvalidPageToken, "the page token is invalid or was issued for another query").Write(w)
+			return
+		}
+		opts.After = cursor.user()
+	}
+	limit := opts.Limit
+
 	// List users from the database.
-	users, err := h.users.List()
+	// Ask for one more user than the limit to know if there is a next page.
+	opts.Limit++
+	users, err := h.users.List(r.Context(), opts)
 	if err != nil {
-		log.Printf("could not list users: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		// Sometimes we may want to return the actual error to the user.
-		w.Write(api.NewJSONResponse("internal error"))
+		h.logger.ErrorContext(r.Context(), "could not list users", "error", err)
+		api.NewProblem(http.StatusInternalServerError, api.CodeInternal, "").Write(w)
 		return
 	}
 
-	msg, err := json.Marshal(users)
+	res := api.ListUsersResponse{
+		Users: users,
+	}
+	if len(users) > limit {
+		res.Users = users[:limit]
+		res.NextPageToken = newPageToken(res.Users[limit-1], opts.Sort).encode()
+
+		// Link to the next page (RFC 8288), keeping the other query parameters.
+		query.Set("page_token", res.NextPageToken)
+		query.Set("limit", strconv.Itoa(limit))
+		link := url.URL{
+			Path:     r.URL.Path,
+			RawQuery: query.Encode(),
+		}
+		w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, link.String()))
+	}
+
+	msg, err := json.Marshal(res)
 	if err != nil {
-		log.Printf("could not marshal response: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		// Sometimes we may want to return the actual error to the user.
-		w.Write(api.NewJSONResponse("internal error"))
+		h.logger.ErrorContext(r.Context(), "could not marshal response", "error", err)
+		api.NewProblem(http.StatusInternalServerError, api.CodeInternal, "").Write(w)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
@@ -73,14 +243,15 @@ func (h Handler) List(w http.ResponseWriter, r *http.Request) {
 }
 
 // Create handles the create user route (`/`).
+// If the user has no ID, the server generates one. The response contains the ID of the user,
+// and the Location header is the path of the user.
 func (h Handler) Create(w http.ResponseWriter, r *http.Request) {
 	// The response is always going to be JSON.
 	w.Header().Set("Content-Type", "application/json")
 
 	// Check the content-type header.
 	if r.Header.Get("Content-Type") != "application/json" {
-		w.WriteHeader(http.StatusUnsupportedMediaType)
-		w.Write(api.NewJSONResponse("Content-Type must be application/json"))
+		api.NewProblem(http.StatusUnsupportedMediaType, api.CodeUnsupportedMediaType, "Content-Type must be application/json").Write(w)
 		return
 	}
 
@@ -88,59 +259,65 @@ func (h Handler) Create(w http.ResponseWriter, r *http.Request) {
 	var user api.User
 
 	// Read the body and decode it.
-	body, err := io.ReadAll(r.Body)
-	// Always close the body after reading it.
-	defer r.Body.Close()
-	if err != nil {
-		log.Printf("could not decode body: %v", err)
-		w.WriteHeader(http.StatusBadRequest)
-		// Sometimes we may want to return the actual error to the user.
-		w.Write(api.NewJSONResponse("Unable to parse the request body"))
+	body, ok := h.readBody(w, r)
+	if !ok {
 		return
 	}
 	if err := json.Unmarshal(body, &user); err != nil {
-		log.Printf("could not unmarshal JSON: %v", err)
-		w.WriteHeader(http.StatusBadRequest)
-		// Sometimes we may want to return the actual error to the user.
-		w.Write(api.NewJSONResponse("Unable to unmarshal JSON"))
+		h.logger.DebugContext(r.Context(), "could not unmarshal JSON", "error", err)
+		api.NewProblem(http.StatusBadRequest, api.CodeInvalidBody, fmt.Sprintf("could not decode JSON: %v", err)).Write(w)
 		return
 	}
 
-	// Validate the request.
-	if err := user.Validate(); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write(api.NewJSONResponse("invalid request"))
+	// Generate the ID, unless the client chose it.
+	if user.ID != "" && !h.clientIDs {
+		validationProblem(&api.ValidationError{
+			Violations: []api.Violation{{Field: "id", Message: "must be empty, IDs are generated by the server"}},
+		}).Write(w)
 		return
 	}
+	if user.ID == "" {
+		id, err := h.newID()
+		if err != nil {
+			h.logger.ErrorContext(r.Context(), "could not generate ID", "error", err)
+			api.NewProblem(http.StatusInternalServerError, api.CodeInternal, "").Write(w)
+			return
+		}
+		user.ID = id
+	}
 
-	// Check if user already exists and error if true.
-	_, err = h.users.Get(user.ID)
-	if err == nil {
-		// This means that the user already exists.
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write(api.NewJSONResponse("user already exists"))
-		return
-	} else if !errors.Is(err, dbErrors.ErrUserNotFound) {
-		// The error is not errors.ErrUserNotFound. This means that something else went wrong.
-		log.Printf("could not get user: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write(api.NewJSONResponse("internal error"))
+	// Validate the request.
+	h.prepare(&user)
+	if err := h.validate(user); err != nil {
+		validationProblem(err).Write(w)
 		return
 	}
 
 	// Create the user.
-	err = h.users.Create(user)
+	// This fails atomically if the user already exists, so there is no need to check beforehand.
+	created, err := h.users.Create(r.Context(), user)
+	if errors.Is(err, dbErrors.ErrUserAlreadyExists) {
+		api.NewProblem(http.StatusBadRequest, api.CodeUserAlreadyExists, fmt.Sprintf("user %q already exists", user.ID)).Write(w)
+		return
+	}
+	if errors.Is(err, dbErrors.ErrEmailAlreadyExists) {
+		api.NewProblem(http.StatusBadRequest, api.CodeEmailAlreadyExists, fmt.Sprintf("email %q is used by another user", user.Email)).Write(w)
+		return
+	}
 	if err != nil {
-		log.Printf("could not create user: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write(api.NewJSONResponse("user could not be created"))
+		h.logger.ErrorContext(r.Context(), "could not create user", "id", user.ID, "error", err)
+		api.NewProblem(http.StatusInternalServerError, api.CodeInternal, "").Write(w)
 		return
 	}
+	w.Header().Set("ETag", etag(created.Version))
+	// The path of the user is relative to the prefix of the routes, ex: `/users/` + ID.
+	w.Header().Set("Location", path.Join(r.URL.Path, created.ID))
 	w.WriteHeader(http.StatusCreated)
-	w.Write(api.NewJSONResponse("user created"))
+	w.Write(api.NewCreatedResponse("user created", created.ID))
 }
 
 // Get gets a user. It handles a GET request for the dynamic route `/users/{id}`.
+// The ETag header is the version of the user. If it matches the If-None-Match header, the response is 304 Not Modified.
 func (h *Handler) Get(w http.ResponseWriter, r *http.Request) {
 	// The response is always going to be JSON.
 	w.Header().Set("Content-Type", "application/json")
@@ -149,30 +326,34 @@ func (h *Handler) Get(w http.ResponseWriter, r *http.Request) {
 	id, ok := mux.Vars(r)["id"] // Don't use brackets here (`{}`).
 	if !ok {
 		// This is mostly a problem with the code.
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write(api.NewJSONResponse("internal error"))
+		api.NewProblem(http.StatusInternalServerError, api.CodeInternal, "").Write(w)
 		return
 	}
 
 	// Check if the user exists.
-	user, err := h.users.Get(id)
+	user, err := h.users.Get(r.Context(), id)
 	if err != nil {
 		if errors.Is(err, dbErrors.ErrUserNotFound) {
-			w.WriteHeader(http.StatusNotFound)
-			w.Write(api.NewJSONResponse("user not found"))
+			api.NewProblem(http.StatusNotFound, api.CodeUserNotFound, fmt.Sprintf("user %q does not exist", id)).Write(w)
 			return
 		}
-		log.Printf("could not get user: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write(api.NewJSONResponse("internal error"))
+		h.logger.ErrorContext(r.Context(), "could not get user", "id", id, "error", err)
+		api.NewProblem(http.StatusInternalServerError, api.CodeInternal, "").Write(w)
+		return
+	}
+	w.Header().Set("ETag", etag(user.Version))
+	if parseEntityTags(r.Header, "If-None-Match").matchWeak(user.Version) {
+		// The client already has this version.
+		w.Header().Del("Content-Type")
+		w.WriteHeader(http.StatusNotModified)
 		return
 	}
+
 	// Marshal the user as a JSON and return to the client.
 	msg, err := json.Marshal(user)
 	if err != nil {
-		log.Printf("could not unmarshal the user: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write(api.NewJSONResponse("internal error"))
+		h.logger.ErrorContext(r.Context(), "could not unmarshal the user", "error", err)
+		api.NewProblem(http.StatusInternalServerError, api.CodeInternal, "").Write(w)
 		return
 	}
 
@@ -181,14 +362,15 @@ func (h *Handler) Get(w http.ResponseWriter, r *http.Request) {
 }
 
 // Update updates the user (PUT request).
+// The update is conditional if the request has an If-Match header: it fails with 412 Precondition Failed if the user
+// was modified since the client got it. The version in the body is ignored.
 func (h *Handler) Update(w http.ResponseWriter, r *http.Request) {
 	// The response is always going to be JSON.
 	w.Header().Set("Content-Type", "application/json")
 
 	// Check the content-type header.
 	if r.Header.Get("Content-Type") != "application/json" {
-		w.WriteHeader(http.StatusUnsupportedMediaType)
-		w.Write(api.NewJSONResponse("Content-Type must be application/json"))
+		api.NewProblem(http.StatusUnsupportedMediaType, api.CodeUnsupportedMediaType, "Content-Type must be application/json").Write(w)
 		return
 	}
 
@@ -196,24 +378,7 @@ func (h *Handler) Update(w http.ResponseWriter, r *http.Request) {
 	id, ok := mux.Vars(r)["id"] // Don't use brackets here (`{}`).
 	if !ok {
 		// This is mostly a problem with the code.
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write(api.NewJSONResponse("internal error"))
-		return
-	}
-
-	// Check and error if user is not found.
-	// If err == nil, the user exists and we proceed.
-	// If not, we check the error type and return an appropriate code.
-	_, err := h.users.Get(id)
-	if err != nil {
-		if errors.Is(err, dbErrors.ErrUserNotFound) {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write(api.NewJSONResponse("user not found"))
-			return
-		}
-		log.Printf("could not get user: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write(api.NewJSONResponse("internal error"))
+		api.NewProblem(http.StatusInternalServerError, api.CodeInternal, "").Write(w)
 		return
 	}
 
@@ -221,48 +386,191 @@ func (h *Handler) Update(w http.ResponseWriter, r *http.Request) {
 	var update api.User
 
 	// Read the body and decode it.
-	body, err := io.ReadAll(r.Body)
-	// Always close the body after reading it.
-	defer r.Body.Close()
-	if err != nil {
-		log.Printf("could not decode body: %v", err)
-		w.WriteHeader(http.StatusBadRequest)
-		// Sometimes we may want to return the actual error to the user.
-		w.Write(api.NewJSONResponse("Unable to parse the request body"))
+	body, ok := h.readBody(w, r)
+	if !ok {
 		return
 	}
 	if err := json.Unmarshal(body, &update); err != nil {
-		log.Printf("could not unmarshal JSON: %v", err)
-		w.WriteHeader(http.StatusBadRequest)
-		// Sometimes we may want to return the actual error to the user.
-		w.Write(api.NewJSONResponse("Unable to unmarshal JSON"))
+		h.logger.DebugContext(r.Context(), "could not unmarshal JSON", "error", err)
+		api.NewProblem(http.StatusBadRequest, api.CodeInvalidBody, fmt.Sprintf("could not decode JSON: %v", err)).Write(w)
 		return
 	}
 
 	// Validate the request. Check that the user ID is correct.
-	if err := update.Validate(); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write(api.NewJSONResponse("invalid request"))
+	h.prepare(&update)
+	if err := h.validate(update); err != nil {
+		validationProblem(err).Write(w)
 		return
 	}
 	if id != update.ID {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write(api.NewJSONResponse("ID in the body does not match the path"))
+		api.NewProblem(http.StatusBadRequest, api.CodeIDMismatch, "ID in the body does not match the path").Write(w)
+		return
+	}
+
+	// The version is managed by the server. Clients select the version to update with the If-Match header.
+	version, err := h.expectedVersion(r, id)
+	if err != nil {
+		h.writeVersionError(w, r, err)
 		return
 	}
+	update.Version = version
 
-	if err := h.users.Update(id, update); err != nil {
-		log.Printf("could not update user: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write(api.NewJSONResponse("internal error, could not update user"))
+	// Update the user.
+	// This fails atomically if the user does not exist or was modified, so there is no need to check beforehand.
+	updated, err := h.users.Update(r.Context(), id, update)
+	if err != nil {
+		if isPreconditionFailed(r, err) {
+			api.NewProblem(http.StatusPreconditionFailed, api.CodePreconditionFailed, "the user does not match the If-Match header").Write(w)
+			return
+		}
+		if errors.Is(err, dbErrors.ErrUserNotFound) {
+			api.NewProblem(http.StatusBadRequest, api.CodeUserNotFound, fmt.Sprintf("user %q does not exist", id)).Write(w)
+			return
+		}
+		if errors.Is(err, dbErrors.ErrEmailAlreadyExists) {
+			api.NewProblem(http.StatusBadRequest, api.CodeEmailAlreadyExists, fmt.Sprintf("email %q is used by another user", update.Email)).Write(w)
+			return
+		}
+		h.logger.ErrorContext(r.Context(), "could not update user", "id", id, "error", err)
+		api.NewProblem(http.StatusInternalServerError, api.CodeInternal, "").Write(w)
 		return
 	}
 
+	w.Header().Set("ETag", etag(updated.Version))
 	w.WriteHeader(http.StatusOK)
 	w.Write(api.NewJSONResponse("user updated"))
 }
 
+// Patch partially updates the user (PATCH request).
+// The body is either a JSON Merge Patch (RFC 7396) or a JSON Patch (RFC 6902), depending on the Content-Type.
+// The patched user is validated like a PUT, and the ID cannot be changed.
+// Like Update, the patch is conditional if the request has an If-Match header.
+func (h *Handler) Patch(w http.ResponseWriter, r *http.Request) {
+	// The response is always going to be JSON.
+	w.Header().Set("Content-Type", "application/json")
+
+	// Check the content-type header and select the patch format.
+	var apply func(doc, patch []byte) ([]byte, error)
+	switch r.Header.Get("Content-Type") {
+	case patch.MergePatchType:
+		apply = patch.MergePatch
+	case patch.JSONPatchType:
+		apply = patch.JSONPatch
+	default:
+		api.NewProblem(http.StatusUnsupportedMediaType, api.CodeUnsupportedMediaType, fmt.Sprintf("Content-Type must be %s or %s", patch.MergePatchType, patch.JSONPatchType)).Write(w)
+		return
+	}
+
+	// Get the ID from the path.
+	id, ok := mux.Vars(r)["id"] // Don't use brackets here (`{}`).
+	if !ok {
+		// This is mostly a problem with the code.
+		api.NewProblem(http.StatusInternalServerError, api.CodeInternal, "").Write(w)
+		return
+	}
+
+	// Read the body.
+	body, ok := h.readBody(w, r)
+	if !ok {
+		return
+	}
+
+	// The patch is applied to the current user and the update is conditional on its version, so that concurrent changes
+	// are not lost. If the user was modified in between, the patch is applied again to the new version,
+	// unless the client asked for a specific version with If-Match.
+	var updated api.User
+	for attempt := 1; ; attempt++ {
+		// Get the current user to apply the patch to.
+		user, err := h.users.Get(r.Context(), id)
+		if err != nil {
+			if isPreconditionFailed(r, err) {
+				api.NewProblem(http.StatusPreconditionFailed, api.CodePreconditionFailed, "the user does not match the If-Match header").Write(w)
+				return
+			}
+			if errors.Is(err, dbErrors.ErrUserNotFound) {
+				api.NewProblem(http.StatusBadRequest, api.CodeUserNotFound, fmt.Sprintf("user %q does not exist", id)).Write(w)
+				return
+			}
+			h.logger.ErrorContext(r.Context(), "could not get user", "id", id, "error", err)
+			api.NewProblem(http.StatusInternalServerError, api.CodeInternal, "").Write(w)
+			return
+		}
+		if len(r.Header.Values("If-Match")) > 0 && !parseEntityTags(r.Header, "If-Match").matchStrong(user.Version) {
+			api.NewProblem(http.StatusPreconditionFailed, api.CodePreconditionFailed, "the user does not match the If-Match header").Write(w)
+			return
+		}
+		doc, err := json.Marshal(user)
+		if err != nil {
+			h.logger.ErrorContext(r.Context(), "could not marshal the user", "error", err)
+			api.NewProblem(http.StatusInternalServerError, api.CodeInternal, "").Write(w)
+			return
+		}
+
+		// Apply the patch.
+		doc, err = apply(doc, body)
+		if err != nil {
+			api.NewProblem(http.StatusBadRequest, api.CodeInvalidPatch, fmt.Sprintf("could not apply patch: %v", err)).Write(w)
+			return
+		}
+		// Decode strictly, so that patches to unknown fields are not silently dropped.
+		var update api.User
+		d := json.NewDecoder(bytes.NewReader(doc))
+		d.DisallowUnknownFields()
+		if err := d.Decode(&update); err != nil {
+			api.NewProblem(http.StatusBadRequest, api.CodeInvalidPatch, fmt.Sprintf("patched user is invalid: %v", err)).Write(w)
+			return
+		}
+
+		// Validate the patched user. Check that the user ID did not change.
+		if update.ID != id {
+			api.NewProblem(http.StatusBadRequest, api.CodeIDImmutable, "the user ID cannot be changed").Write(w)
+			return
+		}
+		h.prepare(&update)
+		if err := h.validate(update); err != nil {
+			validationProblem(err).Write(w)
+			return
+		}
+
+		// The version is managed by the server, changes to it are ignored.
+		update.Version = user.Version
+		updated, err = h.users.Update(r.Context(), id, update)
+		if err == nil {
+			break
+		}
+		if errors.Is(err, dbErrors.ErrVersionMismatch) && len(r.Header.Values("If-Match")) == 0 && attempt < maxPatchAttempts {
+			continue
+		}
+		switch {
+		case isPreconditionFailed(r, err):
+			api.NewProblem(http.StatusPreconditionFailed, api.CodePreconditionFailed, "the user does not match the If-Match header").Write(w)
+		case errors.Is(err, dbErrors.ErrVersionMismatch):
+			api.NewProblem(http.StatusConflict, api.CodeConflict, "the user was modified concurrently, try again").Write(w)
+		case errors.Is(err, dbErrors.ErrUserNotFound):
+			api.NewProblem(http.StatusBadRequest, api.CodeUserNotFound, fmt.Sprintf("user %q does not exist", id)).Write(w)
+		case errors.Is(err, dbErrors.ErrEmailAlreadyExists):
+			api.NewProblem(http.StatusBadRequest, api.CodeEmailAlreadyExists, fmt.Sprintf("email %q is used by another user", update.Email)).Write(w)
+		default:
+			h.logger.ErrorContext(r.Context(), "could not update user", "id", id, "error", err)
+			api.NewProblem(http.StatusInternalServerError, api.CodeInternal, "").Write(w)
+		}
+		return
+	}
+
+	// Return the patched user, since the client may not know the result.
+	msg, err := json.Marshal(updated)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "could not marshal the user", "error", err)
+		api.NewProblem(http.StatusInternalServerError, api.CodeInternal, "").Write(w)
+		return
+	}
+	w.Header().Set("ETag", etag(updated.Version))
+	w.WriteHeader(http.StatusOK)
+	w.Write(msg)
+}
+
 // Delete deletes the user.
+// Like Update, the deletion is conditional if the request has an If-Match header.
 func (h *Handler) Delete(w http.ResponseWriter, r *http.Request) {
 	// The response is always going to be JSON.
 	w.Header().Set("Content-Type", "application/json")
@@ -271,35 +579,110 @@ func (h *Handler) Delete(w http.ResponseWriter, r *http.Request) {
 	id, ok := mux.Vars(r)["id"] // Don't use brackets here (`{}`).
 	if !ok {
 		// This is mostly a problem with the code.
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write(api.NewJSONResponse("internal error"))
+		api.NewProblem(http.StatusInternalServerError, api.CodeInternal, "").Write(w)
 		return
 	}
 
-	// Check and error if user is not found.
-	// If err != nil, check the error type and return an appropriate response.
-	// If err == nil, the user exists, so proceed to deletion.
-	_, err := h.users.Get(id)
+	version, err := h.expectedVersion(r, id)
 	if err != nil {
-		if errors.Is(err, dbErrors.ErrUserNotFound) {
-			log.Printf("could not get user: %v", err)
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write(api.NewJSONResponse("user not found"))
-			return
-		}
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write(api.NewJSONResponse("internal error"))
+		h.writeVersionError(w, r, err)
 		return
 	}
 
 	// Delete the user.
-	if err := h.users.Delete(id); err != nil {
-		log.Printf("could not delete user: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write(api.NewJSONResponse("internal error, could not delete user"))
+	// This fails atomically if the user does not exist or was modified, so there is no need to check beforehand.
+	if err := h.users.Delete(r.Context(), id, version); err != nil {
+		if isPreconditionFailed(r, err) {
+			api.NewProblem(http.StatusPreconditionFailed, api.CodePreconditionFailed, "the user does not match the If-Match header").Write(w)
+			return
+		}
+		if errors.Is(err, dbErrors.ErrUserNotFound) {
+			api.NewProblem(http.StatusBadRequest, api.CodeUserNotFound, fmt.Sprintf("user %q does not exist", id)).Write(w)
+			return
+		}
+		h.logger.ErrorContext(r.Context(), "could not delete user", "id", id, "error", err)
+		api.NewProblem(http.StatusInternalServerError, api.CodeInternal, "").Write(w)
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
 	w.Write(api.NewJSONResponse("user deleted"))
 }
+
+// readBody reads the request body, up to the maximum size. If the body cannot be read, it writes the problem and
+// returns false.
+func (h *Handler) readBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	// Always close the body after reading it.
+	defer r.Body.Close()
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, h.maxBodySize))
+	if err != nil {
+		h.logger.DebugContext(r.Context(), "could not read body", "error", err)
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			api.NewProblem(http.StatusRequestEntityTooLarge, api.CodeBodyTooLarge, fmt.Sprintf("the request body must be at most %d bytes", maxBytesErr.Limit)).Write(w)
+			return nil, false
+		}
+		api.NewProblem(http.StatusBadRequest, api.CodeInvalidBody, "could not read the request body").Write(w)
+		return nil, false
+	}
+	return body, true
+}
+
+// prepare normalizes a user received from a client and sets the fields that are managed by the server,
+// so that clients cannot forge them. The version is set separately, since it depends on the request.
+func (h *Handler) prepare(user *api.User) {
+	user.Email = strings.ToLower(user.Email)
+	if user.Status == "" {
+		user.Status = api.UserStatusActive
+	}
+	// The database keeps the creation time on updates.
+	now := h.now().UTC()
+	user.CreatedAt = now
+	user.UpdatedAt = now
+}
+
+// validate validates the format of the user (see api.User.Validate) and the rules, and reports all the violations.
+func (h *Handler) validate(user api.User) error {
+	var violations []api.Violation
+	if err := user.Validate(); err != nil {
+		var verr *api.ValidationError
+		if !errors.As(err, &verr) {
+			return err
+		}
+		violations = append(violations, verr.Violations...)
+	}
+	violations = append(violations, h.rules.Validate(user)...)
+	if len(violations) > 0 {
+		return &api.ValidationError{
+			Violations: violations,
+		}
+	}
+	return nil
+}
+
+// isPreconditionFailed returns true if the error means that the If-Match header of the request does not match the user.
+// A missing user does not match any entity tag, not even `*`.
+func isPreconditionFailed(r *http.Request, err error) bool {
+	return errors.Is(err, dbErrors.ErrVersionMismatch) ||
+		(errors.Is(err, dbErrors.ErrUserNotFound) && len(r.Header.Values("If-Match")) > 0)
+}
+
+// writeVersionError writes the response for an error of expectedVersion.
+func (h *Handler) writeVersionError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errPreconditionFailed) {
+		api.NewProblem(http.StatusPreconditionFailed, api.CodePreconditionFailed, "the user does not match the If-Match header").Write(w)
+		return
+	}
+	h.logger.ErrorContext(r.Context(), "could not get user", "error", err)
+	api.NewProblem(http.StatusInternalServerError, api.CodeInternal, "").Write(w)
+}
+
+// validationProblem returns the problem for an error of User.Validate, with the invalid fields.
+func validationProblem(err error) *api.Problem {
+	p := api.NewProblem(http.StatusBadRequest, api.CodeValidationFailed, err.Error())
+	var verr *api.ValidationError
+	if errors.As(err, &verr) {
+		p.Violations = verr.Violations
+	}
+	return p
+}
@@ -2,23 +2,38 @@ package users_test
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/kicodelibrary/go-http-server-2024/api"
+	"github.com/kicodelibrary/go-http-server-2024/pkg/auth"
+	"github.com/kicodelibrary/go-http-server-2024/pkg/auth/rbac"
 	"github.com/kicodelibrary/go-http-server-2024/pkg/database/mock"
+	"github.com/kicodelibrary/go-http-server-2024/pkg/logging"
+	"github.com/kicodelibrary/go-http-server-2024/pkg/server/requestid"
 	. "github.com/kicodelibrary/go-http-server-2024/pkg/server/users"
+	"github.com/kicodelibrary/go-http-server-2024/pkg/validation"
 	"github.com/smarty/assertions"
 )
 
+// clock is the clock of the handlers in the tests, so that the timestamps of users are known.
+func clock() time.Time {
+	return time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+}
+
 func TestUser(t *testing.T) {
 	a := assertions.New(t)
-	h := New(mock.NewUsers())
+	h := New(mock.NewUsers(), WithClock(clock))
 
 	// Create a test router.
 	router := mux.NewRouter().PathPrefix("/users").Subrouter()
@@ -48,7 +63,7 @@ func TestUser(t *testing.T) {
 	t.Cleanup(func() {
 		response.Body.Close()
 	})
-	a.So(string(body), assertions.ShouldEqual, "[]")
+	a.So(string(body), assertions.ShouldEqual, `{"users":[]}`)
 
 	// Test the create user function.
 	alice := api.User{
@@ -76,7 +91,18 @@ func TestUser(t *testing.T) {
 		response.Body.Close()
 	})
 	a.So(response.StatusCode, assertions.ShouldEqual, http.StatusCreated)
-	a.So(string(body), assertions.ShouldEqual, `{"message":"user created"}`)
+	a.So(string(body), assertions.ShouldEqual, `{"message":"user created","id":"alice"}`)
+	a.So(response.Header.Get("Location"), assertions.ShouldEqual, "/users/alice")
+
+	// The server sets the status, timestamps and version of new users.
+	alice.Status = api.UserStatusActive
+	alice.CreatedAt = clock()
+	alice.UpdatedAt = clock()
+	alice.Version = 1
+	aliceMsg, err = json.Marshal(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	// Test the get user method.
 	req, err = http.NewRequest(http.MethodGet, "/users/alice", nil)
@@ -120,6 +146,13 @@ func TestUser(t *testing.T) {
 	a.So(response.StatusCode, assertions.ShouldEqual, http.StatusOK)
 	a.So(string(body), assertions.ShouldEqual, `{"message":"user updated"}`)
 
+	// Each update increments the version.
+	alice.Version = 2
+	aliceMsgUpdated, err = json.Marshal(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+
 	// Get the updated user.
 	req, err = http.NewRequest(http.MethodGet, "/users/alice", nil)
 	if err != nil {
@@ -172,12 +205,12 @@ func TestUser(t *testing.T) {
 		response.Body.Close()
 	})
 	a.So(response.StatusCode, assertions.ShouldEqual, http.StatusNotFound)
-	a.So(string(body), assertions.ShouldEqual, `{"message":"user not found"}`)
+	a.So(string(body), assertions.ShouldEqual, problem(http.StatusNotFound, api.CodeUserNotFound, `user "alice" does not exist`))
 }
 
 func TestUsers(t *testing.T) {
 	a := assertions.New(t)
-	h := New(mock.NewUsers())
+	h := New(mock.NewUsers(), WithClock(clock))
 
 	// Create a test router.
 	router := mux.NewRouter().PathPrefix("/users").Subrouter()
@@ -203,7 +236,7 @@ func TestUsers(t *testing.T) {
 				return req
 			},
 			ResponseCode: http.StatusOK,
-			ResponseBody: "[]",
+			ResponseBody: `{"users":[]}`,
 		},
 		{
 			Name: "CreateIncorrectContentType",
@@ -224,7 +257,7 @@ func TestUsers(t *testing.T) {
 				return req
 			},
 			ResponseCode: http.StatusUnsupportedMediaType,
-			ResponseBody: `{"message":"Content-Type must be application/json"}`,
+			ResponseBody: problem(http.StatusUnsupportedMediaType, api.CodeUnsupportedMediaType, "Content-Type must be application/json"),
 		},
 		{
 			Name: "Create",
@@ -246,7 +279,29 @@ func TestUsers(t *testing.T) {
 				return req
 			},
 			ResponseCode: http.StatusCreated,
-			ResponseBody: `{"message":"user created"}`,
+			ResponseBody: `{"message":"user created","id":"alice"}`,
+		},
+		{
+			Name: "CreateAlreadyExists",
+			Request: func() *http.Request {
+				alice := api.User{
+					ID:   "alice",
+					Name: "Alice",
+					Age:  30,
+				}
+				aliceMsg, err := json.Marshal(alice)
+				if err != nil {
+					t.Fatal(err)
+				}
+				req, err := http.NewRequest(http.MethodPost, "/users/", bytes.NewBuffer(aliceMsg))
+				if err != nil {
+					t.Fatal(err)
+				}
+				req.Header.Set("Content-Type", "application/json")
+				return req
+			},
+			ResponseCode: http.StatusBadRequest,
+			ResponseBody: problem(http.StatusBadRequest, api.CodeUserAlreadyExists, `user "alice" already exists`),
 		},
 		{
 			Name: "Get",
@@ -258,7 +313,7 @@ func TestUsers(t *testing.T) {
 				return req
 			},
 			ResponseCode: http.StatusOK,
-			ResponseBody: `{"id":"alice","name":"Alice","age":30}`,
+			ResponseBody: `{"id":"alice","name":"Alice","age":30,"status":"active","created_at":"2024-01-01T00:00:00Z","updated_at":"2024-01-01T00:00:00Z","version":1}`,
 		},
 		{
 			Name: "Update",
@@ -292,7 +347,7 @@ func TestUsers(t *testing.T) {
 				return req
 			},
 			ResponseCode: http.StatusOK,
-			ResponseBody: `{"id":"alice","name":"Alice Smith","age":30}`,
+			ResponseBody: `{"id":"alice","name":"Alice Smith","age":30,"status":"active","created_at":"2024-01-01T00:00:00Z","updated_at":"2024-01-01T00:00:00Z","version":2}`,
 		},
 		{
 			Name: "Delete",
@@ -316,7 +371,41 @@ func TestUsers(t *testing.T) {
 				return req
 			},
 			ResponseCode: http.StatusNotFound,
-			ResponseBody: `{"message":"user not found"}`,
+			ResponseBody: problem(http.StatusNotFound, api.CodeUserNotFound, `user "alice" does not exist`),
+		},
+		{
+			Name: "UpdateAfterDelete",
+			Request: func() *http.Request {
+				alice := api.User{
+					ID:   "alice",
+					Name: "Alice",
+					Age:  30,
+				}
+				aliceMsg, err := json.Marshal(alice)
+				if err != nil {
+					t.Fatal(err)
+				}
+				req, err := http.NewRequest(http.MethodPut, "/users/alice", bytes.NewBuffer(aliceMsg))
+				if err != nil {
+					t.Fatal(err)
+				}
+				req.Header.Set("Content-Type", "application/json")
+				return req
+			},
+			ResponseCode: http.StatusBadRequest,
+			ResponseBody: problem(http.StatusBadRequest, api.CodeUserNotFound, `user "alice" does not exist`),
+		},
+		{
+			Name: "DeleteAfterDelete",
+			Request: func() *http.Request {
+				req, err := http.NewRequest(http.MethodDelete, "/users/alice", nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return req
+			},
+			ResponseCode: http.StatusBadRequest,
+			ResponseBody: problem(http.StatusBadRequest, api.CodeUserNotFound, `user "alice" does not exist`),
 		},
 	} {
 		t.Run(tc.Name, func(t *testing.T) {
@@ -344,7 +433,7 @@ func TestUsers(t *testing.T) {
 
 func TestUsersMulti(t *testing.T) {
 	a := assertions.New(t)
-	h := New(mock.NewUsers())
+	h := New(mock.NewUsers(), WithClock(clock))
 
 	// Create a test router.
 	router := mux.NewRouter().PathPrefix("/users").Subrouter()
@@ -392,7 +481,7 @@ func TestUsersMulti(t *testing.T) {
 					return req
 				},
 				ResponseCode:     http.StatusOK,
-				ResponseBodyFunc: func() string { return "[]" },
+				ResponseBodyFunc: func() string { return `{"users":[]}` },
 			},
 			{
 				Name: "CreateIncorrectContentType",
@@ -409,7 +498,7 @@ func TestUsersMulti(t *testing.T) {
 				},
 				ResponseCode: http.StatusUnsupportedMediaType,
 				ResponseBodyFunc: func() string {
-					return `{"message":"Content-Type must be application/json"}`
+					return problem(http.StatusUnsupportedMediaType, api.CodeUnsupportedMediaType, "Content-Type must be application/json")
 				},
 			},
 			{
@@ -428,7 +517,7 @@ func TestUsersMulti(t *testing.T) {
 				},
 				ResponseCode: http.StatusCreated,
 				ResponseBodyFunc: func() string {
-					return `{"message":"user created"}`
+					return fmt.Sprintf(`{"message":"user created","id":%q}`, tu.UserName)
 				},
 			},
 			{
@@ -442,7 +531,12 @@ func TestUsersMulti(t *testing.T) {
 				},
 				ResponseCode: http.StatusOK,
 				ResponseBodyFunc: func() string {
-					msg, err := json.Marshal(tu.User)
+					created := tu.User
+					created.Status = api.UserStatusActive
+					created.CreatedAt = clock()
+					created.UpdatedAt = clock()
+					created.Version = 1
+					msg, err := json.Marshal(created)
 					if err != nil {
 						t.Fatal(err)
 					}
@@ -483,6 +577,10 @@ func TestUsersMulti(t *testing.T) {
 				ResponseBodyFunc: func() string {
 					updated := tu.User
 					updated.Name = "Abcd"
+					updated.Status = api.UserStatusActive
+					updated.CreatedAt = clock()
+					updated.UpdatedAt = clock()
+					updated.Version = 2
 					msg, err := json.Marshal(updated)
 					if err != nil {
 						t.Fatal(err)
@@ -515,7 +613,7 @@ func TestUsersMulti(t *testing.T) {
 				},
 				ResponseCode: http.StatusNotFound,
 				ResponseBodyFunc: func() string {
-					return `{"message":"user not found"}`
+					return problem(http.StatusNotFound, api.CodeUserNotFound, fmt.Sprintf("user %q does not exist", tu.UserName))
 				},
 			},
 		} {
@@ -541,3 +639,1124 @@ func TestUsersMulti(t *testing.T) {
 		}
 	}
 }
+
+// TestUsersConcurrent hammers the handler from multiple goroutines.
+// Run it with `go test -race` to detect data races in the handler and the database.
+func TestUsersConcurrent(t *testing.T) {
+	a := assertions.New(t)
+	h := New(mock.NewUsers(), WithClock(clock))
+
+	// Create a test router.
+	router := mux.NewRouter().PathPrefix("/users").Subrouter()
+	h.AddRoutes(router)
+
+	// do serves the request and checks the response code.
+	do := func(method, path string, user *api.User, code int) {
+		var body io.Reader
+		if user != nil {
+			msg, err := json.Marshal(user)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			body = bytes.NewBuffer(msg)
+		}
+		req, err := http.NewRequest(method, path, body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != code {
+			t.Errorf("%s %s: unexpected status code: %d", method, path, rec.Code)
+		}
+	}
+
+	const (
+		workers = 16
+		rounds  = 50
+	)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < rounds; j++ {
+				user := api.User{
+					ID:   fmt.Sprintf("user%dx%d", i, j),
+					Name: "User",
+					Age:  30,
+				}
+				path := fmt.Sprintf("/users/%s", user.ID)
+				do(http.MethodPost, "/users/", &user, http.StatusCreated)
+				user.Age++
+				do(http.MethodPut, path, &user, http.StatusOK)
+				do(http.MethodGet, path, nil, http.StatusOK)
+				do(http.MethodGet, "/users/", nil, http.StatusOK)
+				do(http.MethodDelete, path, nil, http.StatusOK)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// All users were deleted.
+	req, err := http.NewRequest(http.MethodGet, "/users/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	a.So(rec.Code, assertions.ShouldEqual, http.StatusOK)
+	a.So(rec.Body.String(), assertions.ShouldEqual, `{"users":[]}`)
+}
+
+// TestUsersConcurrentCreate checks that only one of many concurrent creations of the same user succeeds.
+func TestUsersConcurrentCreate(t *testing.T) {
+	a := assertions.New(t)
+	h := New(mock.NewUsers(), WithClock(clock))
+
+	// Create a test router.
+	router := mux.NewRouter().PathPrefix("/users").Subrouter()
+	h.AddRoutes(router)
+
+	msg, err := json.Marshal(api.User{
+		ID:   "alice",
+		Name: "Alice",
+		Age:  30,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const workers = 32
+	var (
+		wg      sync.WaitGroup
+		created atomic.Int32
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, err := http.NewRequest(http.MethodPost, "/users/", bytes.NewBuffer(msg))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			req.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			switch rec.Code {
+			case http.StatusCreated:
+				created.Add(1)
+			case http.StatusBadRequest:
+			default:
+				t.Errorf("unexpected status code: %d", rec.Code)
+			}
+		}()
+	}
+	wg.Wait()
+	a.So(created.Load(), assertions.ShouldEqual, 1)
+}
+
+// TestUsersCancelled checks that a cancelled request does not reach the database.
+func TestUsersCancelled(t *testing.T) {
+	a := assertions.New(t)
+	h := New(mock.NewUsers(), WithClock(clock))
+
+	// Create a test router.
+	router := mux.NewRouter().PathPrefix("/users").Subrouter()
+	h.AddRoutes(router)
+
+	msg, err := json.Marshal(api.User{
+		ID:   "alice",
+		Name: "Alice",
+		Age:  30,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Cancel the request before it is served, as if the client went away.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "/users/", bytes.NewBuffer(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	a.So(rec.Code, assertions.ShouldEqual, http.StatusInternalServerError)
+
+	// The user was not created.
+	req, err = http.NewRequest(http.MethodGet, "/users/alice", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	a.So(rec.Code, assertions.ShouldEqual, http.StatusNotFound)
+}
+
+func TestUsersPagination(t *testing.T) {
+	a := assertions.New(t)
+	h := New(mock.NewUsers(), WithClock(clock))
+
+	// Create a test router.
+	router := mux.NewRouter().PathPrefix("/users").Subrouter()
+	h.AddRoutes(router)
+
+	// Create users out of order.
+	for _, id := range []string{"eve", "bob", "dan", "alice", "carol"} {
+		msg, err := json.Marshal(api.User{
+			ID:   id,
+			Name: "User",
+			Age:  30,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest(http.MethodPost, "/users/", bytes.NewBuffer(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("unexpected status code: %d", rec.Code)
+		}
+	}
+
+	for _, tc := range []struct {
+		Name     string
+		Query    string
+		Expected []string
+	}{
+		{
+			Name:     "ByID",
+			Query:    "limit=2",
+			Expected: []string{"alice", "bob", "carol", "dan", "eve"},
+		},
+		{
+			Name:     "ByIDDesc",
+			Query:    "limit=1&sort=-id",
+			Expected: []string{"eve", "dan", "carol", "bob", "alice"},
+		},
+		{
+			Name:     "Filter",
+			Query:    "age_gte=18&limit=3&name_prefix=Us",
+			Expected: []string{"alice", "bob", "carol", "dan", "eve"},
+		},
+		{
+			Name:     "FilterNoMatch",
+			Query:    "age_gte=31",
+			Expected: nil,
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			// Follow the pages until the end.
+			var (
+				ids  []string
+				path = "/users/?" + tc.Query
+			)
+			for pages := 0; path != ""; pages++ {
+				if pages > len(tc.Expected) {
+					t.Fatal("too many pages")
+				}
+				rec, res := listUsers(t, router, path)
+				for _, user := range res.Users {
+					ids = append(ids, user.ID)
+				}
+
+				// Follow the Link header to the next page, if there is one.
+				link := rec.Header().Get("Link")
+				if res.NextPageToken == "" {
+					a.So(link, assertions.ShouldBeEmpty)
+					break
+				}
+				if _, err := fmt.Sscanf(link, "<%s", &path); err != nil {
+					t.Fatalf("invalid Link header: %s", link)
+				}
+				a.So(link, assertions.ShouldEndWith, `>; rel="next"`)
+				path = strings.TrimSuffix(path, ">;")
+				a.So(path, assertions.ShouldContainSubstring, "page_token="+res.NextPageToken)
+			}
+			a.So(ids, assertions.ShouldResemble, tc.Expected)
+		})
+	}
+
+	// A page token is only valid for the same sort order.
+	_, res := listUsers(t, router, "/users/?limit=1&sort=-id")
+
+	// Invalid parameters.
+	for _, path := range []string{
+		"/users/?limit=0",
+		"/users/?limit=1001",
+		"/users/?limit=abc",
+		"/users/?page_token=%21%21",
+		"/users/?page_token=" + res.NextPageToken,
+		"/users/?age_gte=abc",
+		"/users/?sort=email",
+	} {
+		req, err := http.NewRequest(http.MethodGet, path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		a.So(rec.Code, assertions.ShouldEqual, http.StatusBadRequest)
+	}
+}
+
+// listUsers lists users and decodes the response.
+func listUsers(t *testing.T, router http.Handler, path string) (*httptest.ResponseRecorder, api.ListUsersResponse) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", rec.Code)
+	}
+	var res api.ListUsersResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	return rec, res
+}
+
+func TestUsersPatch(t *testing.T) {
+	a := assertions.New(t)
+	users := mock.NewUsers()
+	h := New(users, WithClock(clock))
+
+	// Create a test router.
+	router := mux.NewRouter().PathPrefix("/users").Subrouter()
+	h.AddRoutes(router)
+
+	if _, err := users.Create(context.Background(), api.User{
+		ID:        "alice",
+		Name:      "Alice",
+		Age:       30,
+		Status:    api.UserStatusActive,
+		CreatedAt: clock(),
+		UpdatedAt: clock(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		Name         string
+		Path         string
+		ContentType  string
+		Body         string
+		ResponseCode int
+		ResponseBody string
+	}{
+		{
+			Name:         "MergePatch",
+			Path:         "/users/alice",
+			ContentType:  "application/merge-patch+json",
+			Body:         `{"age":31}`,
+			ResponseCode: http.StatusOK,
+			ResponseBody: `{"id":"alice","name":"Alice","age":31,"status":"active","created_at":"2024-01-01T00:00:00Z","updated_at":"2024-01-01T00:00:00Z","version":2}`,
+		},
+		{
+			Name:         "JSONPatch",
+			Path:         "/users/alice",
+			ContentType:  "application/json-patch+json",
+			Body:         `[{"op":"test","path":"/age","value":31},{"op":"replace","path":"/name","value":"Alice Smith"}]`,
+			ResponseCode: http.StatusOK,
+			ResponseBody: `{"id":"alice","name":"Alice Smith","age":31,"status":"active","created_at":"2024-01-01T00:00:00Z","updated_at":"2024-01-01T00:00:00Z","version":3}`,
+		},
+		{
+			// The version is managed by the server.
+			Name:         "ChangeVersion",
+			Path:         "/users/alice",
+			ContentType:  "application/merge-patch+json",
+			Body:         `{"version":10}`,
+			ResponseCode: http.StatusOK,
+			ResponseBody: `{"id":"alice","name":"Alice Smith","age":31,"status":"active","created_at":"2024-01-01T00:00:00Z","updated_at":"2024-01-01T00:00:00Z","version":4}`,
+		},
+		{
+			Name:         "JSONPatchTestFailed",
+			Path:         "/users/alice",
+			ContentType:  "application/json-patch+json",
+			Body:         `[{"op":"test","path":"/age","value":30},{"op":"replace","path":"/age","value":40}]`,
+			ResponseCode: http.StatusBadRequest,
+			ResponseBody: problem(http.StatusBadRequest, api.CodeInvalidPatch, "could not apply patch: operation 0 (test): test operation failed"),
+		},
+		{
+			Name:         "ChangeID",
+			Path:         "/users/alice",
+			ContentType:  "application/merge-patch+json",
+			Body:         `{"id":"bob"}`,
+			ResponseCode: http.StatusBadRequest,
+			ResponseBody: problem(http.StatusBadRequest, api.CodeIDImmutable, "the user ID cannot be changed"),
+		},
+		{
+			Name:         "RemoveID",
+			Path:         "/users/alice",
+			ContentType:  "application/json-patch+json",
+			Body:         `[{"op":"remove","path":"/id"}]`,
+			ResponseCode: http.StatusBadRequest,
+			ResponseBody: problem(http.StatusBadRequest, api.CodeIDImmutable, "the user ID cannot be changed"),
+		},
+		{
+			Name:         "UnknownField",
+			Path:         "/users/alice",
+			ContentType:  "application/merge-patch+json",
+			Body:         `{"nickname":"Ali"}`,
+			ResponseCode: http.StatusBadRequest,
+			ResponseBody: problem(http.StatusBadRequest, api.CodeInvalidPatch, `patched user is invalid: json: unknown field "nickname"`),
+		},
+		{
+			Name:         "InvalidPatch",
+			Path:         "/users/alice",
+			ContentType:  "application/merge-patch+json",
+			Body:         `{`,
+			ResponseCode: http.StatusBadRequest,
+			ResponseBody: problem(http.StatusBadRequest, api.CodeInvalidPatch, "could not apply patch: invalid patch: unexpected EOF"),
+		},
+		{
+			Name:         "IncorrectContentType",
+			Path:         "/users/alice",
+			ContentType:  "application/json",
+			Body:         `{"age":31}`,
+			ResponseCode: http.StatusUnsupportedMediaType,
+			ResponseBody: problem(http.StatusUnsupportedMediaType, api.CodeUnsupportedMediaType, "Content-Type must be application/merge-patch+json or application/json-patch+json"),
+		},
+		{
+			Name:         "NotFound",
+			Path:         "/users/bob",
+			ContentType:  "application/merge-patch+json",
+			Body:         `{"age":31}`,
+			ResponseCode: http.StatusBadRequest,
+			ResponseBody: problem(http.StatusBadRequest, api.CodeUserNotFound, `user "bob" does not exist`),
+		},
+		{
+			Name:         "GetAfterPatch",
+			Path:         "/users/alice",
+			ResponseCode: http.StatusOK,
+			ResponseBody: `{"id":"alice","name":"Alice Smith","age":31,"status":"active","created_at":"2024-01-01T00:00:00Z","updated_at":"2024-01-01T00:00:00Z","version":4}`,
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			method := http.MethodPatch
+			if tc.Body == "" {
+				method = http.MethodGet
+			}
+			req, err := http.NewRequest(method, tc.Path, strings.NewReader(tc.Body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", tc.ContentType)
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			a.So(rec.Code, assertions.ShouldEqual, tc.ResponseCode)
+			a.So(rec.Body.String(), assertions.ShouldEqual, tc.ResponseBody)
+		})
+	}
+}
+
+func TestUsersETag(t *testing.T) {
+	a := assertions.New(t)
+	h := New(mock.NewUsers(), WithClock(clock))
+
+	// Create a test router.
+	router := mux.NewRouter().PathPrefix("/users").Subrouter()
+	h.AddRoutes(router)
+
+	// The test cases run in order, each one depends on the state left by the previous ones.
+	for _, tc := range []struct {
+		Name         string
+		Method       string
+		Header       http.Header
+		Body         string
+		ResponseCode int
+		ResponseBody string
+		ETag         string
+	}{
+		{
+			Name:         "Create",
+			Method:       http.MethodPost,
+			Header:       http.Header{"Content-Type": {"application/json"}},
+			Body:         `{"id":"alice","name":"Alice","age":30}`,
+			ResponseCode: http.StatusCreated,
+			ResponseBody: `{"message":"user created","id":"alice"}`,
+			ETag:         `"1"`,
+		},
+		{
+			Name:         "Get",
+			Method:       http.MethodGet,
+			ResponseCode: http.StatusOK,
+			ResponseBody: `{"id":"alice","name":"Alice","age":30,"status":"active","created_at":"2024-01-01T00:00:00Z","updated_at":"2024-01-01T00:00:00Z","version":1}`,
+			ETag:         `"1"`,
+		},
+		{
+			Name:         "GetNotModified",
+			Method:       http.MethodGet,
+			Header:       http.Header{"If-None-Match": {`"1"`}},
+			ResponseCode: http.StatusNotModified,
+			ETag:         `"1"`,
+		},
+		{
+			// If-None-Match uses the weak comparison.
+			Name:         "GetNotModifiedWeak",
+			Method:       http.MethodGet,
+			Header:       http.Header{"If-None-Match": {`"0", W/"1"`}},
+			ResponseCode: http.StatusNotModified,
+			ETag:         `"1"`,
+		},
+		{
+			Name:         "GetNotModifiedAny",
+			Method:       http.MethodGet,
+			Header:       http.Header{"If-None-Match": {"*"}},
+			ResponseCode: http.StatusNotModified,
+			ETag:         `"1"`,
+		},
+		{
+			Name:         "GetModified",
+			Method:       http.MethodGet,
+			Header:       http.Header{"If-None-Match": {`"2"`}},
+			ResponseCode: http.StatusOK,
+			ResponseBody: `{"id":"alice","name":"Alice","age":30,"status":"active","created_at":"2024-01-01T00:00:00Z","updated_at":"2024-01-01T00:00:00Z","version":1}`,
+			ETag:         `"1"`,
+		},
+		{
+			Name:   "UpdateStale",
+			Method: http.MethodPut,
+			Header: http.Header{
+				"Content-Type": {"application/json"},
+				"If-Match":     {`"2"`},
+			},
+			Body:         `{"id":"alice","name":"Alice Smith","age":30}`,
+			ResponseCode: http.StatusPreconditionFailed,
+			ResponseBody: problem(http.StatusPreconditionFailed, api.CodePreconditionFailed, "the user does not match the If-Match header"),
+		},
+		{
+			// If-Match uses the strong comparison, so weak entity tags never match.
+			Name:   "UpdateWeak",
+			Method: http.MethodPut,
+			Header: http.Header{
+				"Content-Type": {"application/json"},
+				"If-Match":     {`W/"1"`},
+			},
+			Body:         `{"id":"alice","name":"Alice Smith","age":30}`,
+			ResponseCode: http.StatusPreconditionFailed,
+			ResponseBody: problem(http.StatusPreconditionFailed, api.CodePreconditionFailed, "the user does not match the If-Match header"),
+		},
+		{
+			// Versions start at 1, so `"0"` never matches, and does not make the update unconditional.
+			Name:   "UpdateZero",
+			Method: http.MethodPut,
+			Header: http.Header{
+				"Content-Type": {"application/json"},
+				"If-Match":     {`"0"`},
+			},
+			Body:         `{"id":"alice","name":"Alice Smith","age":30}`,
+			ResponseCode: http.StatusPreconditionFailed,
+			ResponseBody: problem(http.StatusPreconditionFailed, api.CodePreconditionFailed, "the user does not match the If-Match header"),
+		},
+		{
+			// The version in the body is ignored.
+			Name:   "Update",
+			Method: http.MethodPut,
+			Header: http.Header{
+				"Content-Type": {"application/json"},
+				"If-Match":     {`"1"`},
+			},
+			Body:         `{"id":"alice","name":"Alice Smith","age":30,"version":7}`,
+			ResponseCode: http.StatusOK,
+			ResponseBody: `{"message":"user updated"}`,
+			ETag:         `"2"`,
+		},
+		{
+			Name:   "UpdateList",
+			Method: http.MethodPut,
+			Header: http.Header{
+				"Content-Type": {"application/json"},
+				"If-Match":     {`"5", "2"`},
+			},
+			Body:         `{"id":"alice","name":"Alice Smith","age":31}`,
+			ResponseCode: http.StatusOK,
+			ResponseBody: `{"message":"user updated"}`,
+			ETag:         `"3"`,
+		},
+		{
+			Name:   "PatchStale",
+			Method: http.MethodPatch,
+			Header: http.Header{
+				"Content-Type": {"application/merge-patch+json"},
+				"If-Match":     {`"2"`},
+			},
+			Body:         `{"age":32}`,
+			ResponseCode: http.StatusPreconditionFailed,
+			ResponseBody: problem(http.StatusPreconditionFailed, api.CodePreconditionFailed, "the user does not match the If-Match header"),
+		},
+		{
+			Name:   "Patch",
+			Method: http.MethodPatch,
+			Header: http.Header{
+				"Content-Type": {"application/merge-patch+json"},
+				"If-Match":     {`"3"`},
+			},
+			Body:         `{"age":32}`,
+			ResponseCode: http.StatusOK,
+			ResponseBody: `{"id":"alice","name":"Alice Smith","age":32,"status":"active","created_at":"2024-01-01T00:00:00Z","updated_at":"2024-01-01T00:00:00Z","version":4}`,
+			ETag:         `"4"`,
+		},
+		{
+			Name:         "DeleteZero",
+			Method:       http.MethodDelete,
+			Header:       http.Header{"If-Match": {`"0"`}},
+			ResponseCode: http.StatusPreconditionFailed,
+			ResponseBody: problem(http.StatusPreconditionFailed, api.CodePreconditionFailed, "the user does not match the If-Match header"),
+		},
+		{
+			Name:         "DeleteStale",
+			Method:       http.MethodDelete,
+			Header:       http.Header{"If-Match": {`"3"`}},
+			ResponseCode: http.StatusPreconditionFailed,
+			ResponseBody: problem(http.StatusPreconditionFailed, api.CodePreconditionFailed, "the user does not match the If-Match header"),
+		},
+		{
+			Name:         "Delete",
+			Method:       http.MethodDelete,
+			Header:       http.Header{"If-Match": {"*"}},
+			ResponseCode: http.StatusOK,
+			ResponseBody: `{"message":"user deleted"}`,
+		},
+		{
+			// A missing user does not match any entity tag.
+			Name:   "UpdateMissing",
+			Method: http.MethodPut,
+			Header: http.Header{
+				"Content-Type": {"application/json"},
+				"If-Match":     {"*"},
+			},
+			Body:         `{"id":"alice","name":"Alice","age":30}`,
+			ResponseCode: http.StatusPreconditionFailed,
+			ResponseBody: problem(http.StatusPreconditionFailed, api.CodePreconditionFailed, "the user does not match the If-Match header"),
+		},
+		{
+			Name:         "DeleteMissing",
+			Method:       http.MethodDelete,
+			Header:       http.Header{"If-Match": {`"4"`}},
+			ResponseCode: http.StatusPreconditionFailed,
+			ResponseBody: problem(http.StatusPreconditionFailed, api.CodePreconditionFailed, "the user does not match the If-Match header"),
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			path := "/users/alice"
+			if tc.Method == http.MethodPost {
+				path = "/users/"
+			}
+			req, err := http.NewRequest(tc.Method, path, strings.NewReader(tc.Body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range tc.Header {
+				req.Header[k] = v
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			a.So(rec.Code, assertions.ShouldEqual, tc.ResponseCode)
+			a.So(rec.Body.String(), assertions.ShouldEqual, tc.ResponseBody)
+			a.So(rec.Header().Get("ETag"), assertions.ShouldEqual, tc.ETag)
+		})
+	}
+}
+
+// problem returns the expected body of an error response.
+func problem(status int, code api.ErrorCode, detail string) string {
+	b, err := json.Marshal(api.NewProblem(status, code, detail))
+	if err != nil {
+		panic(err)
+	}
+	return string(b)
+}
+
+func TestUsersProblem(t *testing.T) {
+	a := assertions.New(t)
+	users := mock.NewUsers()
+	h := New(users, WithClock(clock))
+
+	// Create a test router.
+	router := mux.NewRouter().PathPrefix("/users").Subrouter()
+	h.AddRoutes(router)
+
+	if _, err := users.Create(context.Background(), api.User{
+		ID:        "alice",
+		Name:      "Alice",
+		Age:       30,
+		Status:    api.UserStatusActive,
+		CreatedAt: clock(),
+		UpdatedAt: clock(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		Name        string
+		Method      string
+		Path        string
+		ContentType string
+		Body        string
+		Status      int
+		Code        api.ErrorCode
+		Violations  []api.Violation
+	}{
+		{
+			Name:        "CreateInvalidID",
+			Method:      http.MethodPost,
+			Path:        "/users/",
+			ContentType: "application/json",
+			Body:        `{"id":"A!","name":"A","age":30}`,
+			Status:      http.StatusBadRequest,
+			Code:        api.CodeValidationFailed,
+			Violations: []api.Violation{
+				{Field: "id", Message: `must be 3 to 32 lowercase letters or digits, got "A!"`},
+			},
+		},
+		{
+			Name:        "CreateInvalidJSON",
+			Method:      http.MethodPost,
+			Path:        "/users/",
+			ContentType: "application/json",
+			Body:        `{"id":`,
+			Status:      http.StatusBadRequest,
+			Code:        api.CodeInvalidBody,
+		},
+		{
+			Name:        "CreateNameTooLong",
+			Method:      http.MethodPost,
+			Path:        "/users/",
+			ContentType: "application/json",
+			Body:        `{"id":"bob","name":"` + strings.Repeat("b", 257) + `","age":30}`,
+			Status:      http.StatusBadRequest,
+			Code:        api.CodeValidationFailed,
+			Violations: []api.Violation{
+				{Field: "name", Message: "must be at most 256 characters"},
+			},
+		},
+		{
+			Name:        "CreateBodyTooLarge",
+			Method:      http.MethodPost,
+			Path:        "/users/",
+			ContentType: "application/json",
+			Body:        `{"id":"bob","name":"Bob","age":30}` + strings.Repeat(" ", DefaultMaxBodySize),
+			Status:      http.StatusRequestEntityTooLarge,
+			Code:        api.CodeBodyTooLarge,
+		},
+		{
+			Name:        "UpdateBodyTooLarge",
+			Method:      http.MethodPut,
+			Path:        "/users/alice",
+			ContentType: "application/json",
+			Body:        `{"id":"alice","name":"Alice","age":30}` + strings.Repeat(" ", DefaultMaxBodySize),
+			Status:      http.StatusRequestEntityTooLarge,
+			Code:        api.CodeBodyTooLarge,
+		},
+		{
+			Name:        "PatchBodyTooLarge",
+			Method:      http.MethodPatch,
+			Path:        "/users/alice",
+			ContentType: "application/merge-patch+json",
+			Body:        `{"name":"Alicia"}` + strings.Repeat(" ", DefaultMaxBodySize),
+			Status:      http.StatusRequestEntityTooLarge,
+			Code:        api.CodeBodyTooLarge,
+		},
+		{
+			Name:        "UpdateIDMismatch",
+			Method:      http.MethodPut,
+			Path:        "/users/alice",
+			ContentType: "application/json",
+			Body:        `{"id":"bob","name":"Bob","age":30}`,
+			Status:      http.StatusBadRequest,
+			Code:        api.CodeIDMismatch,
+		},
+		{
+			Name:        "PatchInvalidID",
+			Method:      http.MethodPatch,
+			Path:        "/users/alice",
+			ContentType: "application/json-patch+json",
+			Body:        `[{"op":"replace","path":"/id","value":"al"}]`,
+			Status:      http.StatusBadRequest,
+			Code:        api.CodeIDImmutable,
+		},
+		{
+			Name:   "ListInvalidQuery",
+			Method: http.MethodGet,
+			Path:   "/users/?limit=0",
+			Status: http.StatusBadRequest,
+			Code:   api.CodeInvalidQuery,
+		},
+		{
+			Name:   "ListInvalidPageToken",
+			Method: http.MethodGet,
+			Path:   "/users/?page_token=abc",
+			Status: http.StatusBadRequest,
+			Code:   api.CodeInvalidPageToken,
+		},
+		{
+			Name:   "GetNotFound",
+			Method: http.MethodGet,
+			Path:   "/users/bob",
+			Status: http.StatusNotFound,
+			Code:   api.CodeUserNotFound,
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			req, err := http.NewRequest(tc.Method, tc.Path, strings.NewReader(tc.Body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", tc.ContentType)
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			a.So(rec.Code, assertions.ShouldEqual, tc.Status)
+			a.So(rec.Header().Get("Content-Type"), assertions.ShouldEqual, api.ProblemContentType)
+
+			var p api.Problem
+			if err := json.Unmarshal(rec.Body.Bytes(), &p); err != nil {
+				t.Fatal(err)
+			}
+			a.So(p.Status, assertions.ShouldEqual, tc.Status)
+			a.So(p.Code, assertions.ShouldEqual, tc.Code)
+			a.So(p.Type, assertions.ShouldEqual, api.ProblemTypeBase+"#"+string(tc.Code))
+			a.So(p.Title, assertions.ShouldNotBeEmpty)
+			a.So(p.Violations, assertions.ShouldResemble, tc.Violations)
+		})
+	}
+}
+
+func TestUsersFields(t *testing.T) {
+	a := assertions.New(t)
+	now := clock()
+	h := New(mock.NewUsers(), WithClock(func() time.Time { return now }))
+
+	// Create a test router.
+	router := mux.NewRouter().PathPrefix("/users").Subrouter()
+	h.AddRoutes(router)
+
+	// do serves the request and returns the response.
+	do := func(method, path, contentType, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", contentType)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+	// get gets the user.
+	get := func(id string) api.User {
+		rec := do(http.MethodGet, "/users/"+id, "", "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("unexpected status code: %d", rec.Code)
+		}
+		var user api.User
+		if err := json.Unmarshal(rec.Body.Bytes(), &user); err != nil {
+			t.Fatal(err)
+		}
+		return user
+	}
+
+	// The server-managed fields cannot be forged, and the email is stored in lowercase.
+	rec := do(http.MethodPost, "/users/", "application/json", `{
+		"id": "alice",
+		"name": "Alice",
+		"age": 30,
+		"email": "Alice@Example.com",
+		"labels": {"team": "blue"},
+		"created_at": "2000-01-01T00:00:00Z",
+		"updated_at": "2000-01-01T00:00:00Z",
+		"version": 42
+	}`)
+	a.So(rec.Code, assertions.ShouldEqual, http.StatusCreated)
+	a.So(get("alice"), assertions.ShouldResemble, api.User{
+		ID:        "alice",
+		Name:      "Alice",
+		Age:       30,
+		Email:     "alice@example.com",
+		Status:    api.UserStatusActive,
+		Labels:    map[string]string{"team": "blue"},
+		CreatedAt: clock(),
+		UpdatedAt: clock(),
+		Version:   1,
+	})
+
+	// Emails are unique, regardless of case.
+	rec = do(http.MethodPost, "/users/", "application/json", `{"id":"bob","name":"Bob","age":25,"email":"ALICE@example.com"}`)
+	a.So(rec.Code, assertions.ShouldEqual, http.StatusBadRequest)
+	a.So(rec.Body.String(), assertions.ShouldEqual, problem(http.StatusBadRequest, api.CodeEmailAlreadyExists, `email "alice@example.com" is used by another user`))
+
+	// Updates keep the creation time.
+	now = now.Add(time.Hour)
+	rec = do(http.MethodPut, "/users/alice", "application/json", `{"id":"alice","name":"Alice","age":31,"status":"suspended","created_at":"2000-01-01T00:00:00Z"}`)
+	a.So(rec.Code, assertions.ShouldEqual, http.StatusOK)
+	a.So(get("alice"), assertions.ShouldResemble, api.User{
+		ID:        "alice",
+		Name:      "Alice",
+		Age:       31,
+		Status:    api.UserStatusSuspended,
+		CreatedAt: clock(),
+		UpdatedAt: now,
+		Version:   2,
+	})
+
+	// Labels are merged by merge patches.
+	now = now.Add(time.Hour)
+	rec = do(http.MethodPatch, "/users/alice", "application/merge-patch+json", `{"labels":{"team":"red","tier":"gold"},"updated_at":null}`)
+	a.So(rec.Code, assertions.ShouldEqual, http.StatusOK)
+	rec = do(http.MethodPatch, "/users/alice", "application/merge-patch+json", `{"labels":{"team":null}}`)
+	a.So(rec.Code, assertions.ShouldEqual, http.StatusOK)
+	a.So(get("alice"), assertions.ShouldResemble, api.User{
+		ID:        "alice",
+		Name:      "Alice",
+		Age:       31,
+		Status:    api.UserStatusSuspended,
+		Labels:    map[string]string{"tier": "gold"},
+		CreatedAt: clock(),
+		UpdatedAt: now,
+		Version:   4,
+	})
+
+	// All invalid fields are reported.
+	rec = do(http.MethodPost, "/users/", "application/json", `{"id":"bob","name":"Bob","age":25,"email":"bob","status":"deleted","labels":{"Team":"blue"}}`)
+	a.So(rec.Code, assertions.ShouldEqual, http.StatusBadRequest)
+	var p api.Problem
+	if err := json.Unmarshal(rec.Body.Bytes(), &p); err != nil {
+		t.Fatal(err)
+	}
+	a.So(p.Code, assertions.ShouldEqual, api.CodeValidationFailed)
+	var fields []string
+	for _, v := range p.Violations {
+		fields = append(fields, v.Field)
+	}
+	a.So(fields, assertions.ShouldResemble, []string{"email", "status", "labels.Team"})
+}
+
+func TestUsersRules(t *testing.T) {
+	a := assertions.New(t)
+	rules, err := validation.Parse([]byte(`{"fields":{"name":{"required":true,"allowed_characters":"A-Za-z"},"email":{"required":true}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := New(mock.NewUsers(), WithClock(clock), WithRules(rules))
+
+	// Create a test router.
+	router := mux.NewRouter().PathPrefix("/users").Subrouter()
+	h.AddRoutes(router)
+
+	// do serves the request and returns the problem in the response, if any.
+	do := func(method, path, body string) (int, api.Problem) {
+		req, err := http.NewRequest(method, path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		var p api.Problem
+		if rec.Code >= 400 {
+			if err := json.Unmarshal(rec.Body.Bytes(), &p); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rec.Code, p
+	}
+
+	// The configured rules replace the default rules: the age is not limited.
+	code, _ := do(http.MethodPost, "/users/", `{"id":"alice","name":"Alice","age":5,"email":"alice@example.com"}`)
+	a.So(code, assertions.ShouldEqual, http.StatusCreated)
+
+	// The violations of the rules are reported with the violations of the format of the fields.
+	code, p := do(http.MethodPost, "/users/", `{"id":"bob","name":"Bob2","age":25,"status":"deleted"}`)
+	a.So(code, assertions.ShouldEqual, http.StatusBadRequest)
+	a.So(p.Code, assertions.ShouldEqual, api.CodeValidationFailed)
+	a.So(p.Violations, assertions.ShouldResemble, []api.Violation{
+		{Field: "status", Message: `must be active or suspended, got "deleted"`},
+		{Field: "name", Message: "must only contain the characters [A-Za-z]"},
+		{Field: "email", Message: "is required"},
+	})
+
+	// The rules also apply to updates.
+	code, p = do(http.MethodPut, "/users/alice", `{"id":"alice","name":"Alice","age":5}`)
+	a.So(code, assertions.ShouldEqual, http.StatusBadRequest)
+	a.So(p.Violations, assertions.ShouldResemble, []api.Violation{{Field: "email", Message: "is required"}})
+}
+
+func TestUsersGeneratedIDs(t *testing.T) {
+	a := assertions.New(t)
+
+	// do creates the user and returns the response.
+	do := func(h *Handler, body string) *httptest.ResponseRecorder {
+		router := mux.NewRouter().PathPrefix("/users").Subrouter()
+		h.AddRoutes(router)
+		req, err := http.NewRequest(http.MethodPost, "/users/", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// The server generates the ID of users created without an ID.
+	var n int
+	newID := func() (string, error) {
+		n++
+		return fmt.Sprintf("generated%d", n), nil
+	}
+	users := mock.NewUsers()
+	h := New(users, WithClock(clock), WithIDGenerator(newID))
+	rec := do(h, `{"name":"Alice","age":30}`)
+	a.So(rec.Code, assertions.ShouldEqual, http.StatusCreated)
+	a.So(rec.Body.String(), assertions.ShouldEqual, `{"message":"user created","id":"generated1"}`)
+	a.So(rec.Header().Get("Location"), assertions.ShouldEqual, "/users/generated1")
+	user, err := users.Get(context.Background(), "generated1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.So(user.Name, assertions.ShouldEqual, "Alice")
+
+	// Clients can still choose the ID.
+	rec = do(h, `{"id":"bob","name":"Bob","age":30}`)
+	a.So(rec.Code, assertions.ShouldEqual, http.StatusCreated)
+	a.So(rec.Header().Get("Location"), assertions.ShouldEqual, "/users/bob")
+
+	// Unless it is forbidden.
+	h = New(users, WithClock(clock), WithIDGenerator(newID), WithClientIDs(false))
+	rec = do(h, `{"id":"carol","name":"Carol","age":30}`)
+	a.So(rec.Code, assertions.ShouldEqual, http.StatusBadRequest)
+	var p api.Problem
+	if err := json.Unmarshal(rec.Body.Bytes(), &p); err != nil {
+		t.Fatal(err)
+	}
+	a.So(p.Code, assertions.ShouldEqual, api.CodeValidationFailed)
+	a.So(p.Violations, assertions.ShouldResemble, []api.Violation{{Field: "id", Message: "must be empty, IDs are generated by the server"}})
+	rec = do(h, `{"name":"Carol","age":30}`)
+	a.So(rec.Code, assertions.ShouldEqual, http.StatusCreated)
+	a.So(rec.Header().Get("Location"), assertions.ShouldEqual, "/users/generated2")
+
+	// The default IDs are ULIDs, which are valid user IDs.
+	h = New(mock.NewUsers())
+	var created api.Response
+	rec = do(h, `{"name":"Dave","age":30}`)
+	a.So(rec.Code, assertions.ShouldEqual, http.StatusCreated)
+	if err := json.Unmarshal(rec.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	a.So(created.ID, assertions.ShouldHaveLength, 26)
+	a.So(rec.Header().Get("Location"), assertions.ShouldEqual, "/users/"+created.ID)
+}
+
+func TestUsersLogger(t *testing.T) {
+	a := assertions.New(t)
+	var buf bytes.Buffer
+	logger, err := logging.New(&buf, logging.FormatJSON, "debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := New(mock.NewUsers(), WithClock(clock), WithLogger(logger))
+
+	// Create a test router.
+	router := mux.NewRouter().PathPrefix("/users").Subrouter()
+	h.AddRoutes(router)
+
+	// The logs are written with the context of the request, so they have its ID.
+	ctx := requestid.NewContext(context.Background(), "abc123")
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "/users/", strings.NewReader(`{`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	a.So(rec.Code, assertions.ShouldEqual, http.StatusBadRequest)
+
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatal(err)
+	}
+	a.So(record["level"], assertions.ShouldEqual, "DEBUG")
+	a.So(record["msg"], assertions.ShouldEqual, "could not unmarshal JSON")
+	a.So(record["error"], assertions.ShouldEqual, "unexpected end of JSON input")
+	a.So(record["request_id"], assertions.ShouldEqual, "abc123")
+}
+
+func TestUsersAuthorization(t *testing.T) {
+	a := assertions.New(t)
+	policy, err := rbac.Parse([]byte(`{"roles": {
+		"admin": ["users:read", "users:write", "users:delete"],
+		"reader": ["users:read"],
+		"member": ["users:read:self", "users:write:self"]
+	}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := mock.NewUsers()
+	for _, id := range []string{"alice", "bob"} {
+		if _, err := users.Create(context.Background(), api.User{ID: id, Name: "Name", Age: 30}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := New(users, WithClock(clock), WithAuthorizer(policy))
+	router := mux.NewRouter().PathPrefix("/users").Subrouter()
+	h.AddRoutes(router)
+
+	for _, tc := range []struct {
+		Name      string
+		Principal *auth.Principal
+		Method    string
+		Path      string
+		Body      string
+		Code      int
+	}{
+		{Name: "NoPrincipal", Method: http.MethodGet, Path: "/users/", Code: http.StatusUnauthorized},
+		{Name: "NoRole", Principal: &auth.Principal{Subject: "carol"}, Method: http.MethodGet, Path: "/users/", Code: http.StatusForbidden},
+		{Name: "ReaderList", Principal: &auth.Principal{Subject: "reader", Roles: []string{"reader"}}, Method: http.MethodGet, Path: "/users/", Code: http.StatusOK},
+		{Name: "ReaderGet", Principal: &auth.Principal{Subject: "reader", Roles: []string{"reader"}}, Method: http.MethodGet, Path: "/users/bob", Code: http.StatusOK},
+		{Name: "ReaderCreate", Principal: &auth.Principal{Subject: "reader", Roles: []string{"reader"}}, Method: http.MethodPost, Path: "/users/", Body: `{"id":"carol","name":"Carol","age":30}`, Code: http.StatusForbidden},
+		{Name: "MemberGetSelf", Principal: &auth.Principal{Subject: "alice", Roles: []string{"member"}}, Method: http.MethodGet, Path: "/users/alice", Code: http.StatusOK},
+		{Name: "MemberGetOther", Principal: &auth.Principal{Subject: "alice", Roles: []string{"member"}}, Method: http.MethodGet, Path: "/users/bob", Code: http.StatusForbidden},
+		{Name: "MemberList", Principal: &auth.Principal{Subject: "alice", Roles: []string{"member"}}, Method: http.MethodGet, Path: "/users/", Code: http.StatusForbidden},
+		{Name: "MemberUpdateSelf", Principal: &auth.Principal{Subject: "alice", Roles: []string{"member"}}, Method: http.MethodPut, Path: "/users/alice", Body: `{"id":"alice","name":"Alice","age":31}`, Code: http.StatusOK},
+		{Name: "MemberUpdateOther", Principal: &auth.Principal{Subject: "alice", Roles: []string{"member"}}, Method: http.MethodPut, Path: "/users/bob", Body: `{"id":"bob","name":"Alice","age":31}`, Code: http.StatusForbidden},
+		{Name: "MemberDeleteSelf", Principal: &auth.Principal{Subject: "alice", Roles: []string{"member"}}, Method: http.MethodDelete, Path: "/users/alice", Code: http.StatusForbidden},
+		{Name: "AdminDelete", Principal: &auth.Principal{Subject: "admin", Roles: []string{"reader", "admin"}}, Method: http.MethodDelete, Path: "/users/bob", Code: http.StatusOK},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			ctx := context.Background()
+			if tc.Principal != nil {
+				ctx = auth.NewContext(ctx, tc.Principal)
+			}
+			req, err := http.NewRequestWithContext(ctx, tc.Method, tc.Path, strings.NewReader(tc.Body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.Body != "" {
+				req.Header.Set("Content-Type", "application/json")
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			a.So(rec.Code, assertions.ShouldEqual, tc.Code)
+			if tc.Code == http.StatusForbidden {
+				var p api.Problem
+				if err := json.Unmarshal(rec.Body.Bytes(), &p); err != nil {
+					t.Fatal(err)
+				}
+				a.So(p.Code, assertions.ShouldEqual, api.CodeForbidden)
+			}
+		})
+	}
+}
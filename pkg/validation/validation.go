@@ -0,0 +1,176 @@
+// Package validation validates users with declarative rules.
+//
+// The rules are loaded from a JSON file, so that they can be changed without a code change. For example:
+//
+//	{
+//		"fields": {
+//			"name": {"required": true, "min_length": 2, "max_length": 64, "allowed_characters": "\\p{L} .'-"},
+//			"age": {"min": 18, "max": 100},
+//			"email": {"required": true}
+//		}
+//	}
+//
+// The rules complement api.User.Validate, which checks the format of the fields (ex: the ID and the email).
+package validation
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"unicode/utf8"
+
+	"github.com/kicodelibrary/go-http-server-2024/api"
+)
+
+// Rule constrains a field.
+// Min and Max only apply to numeric fields. MinLength, MaxLength and AllowedCharacters only apply to string fields,
+// and not to empty strings: use Required to forbid them.
+type Rule struct {
+	// Required forbids the zero value of the field.
+	Required bool `json:"required,omitempty"`
+	// Min and Max are the bounds of the value, inclusive.
+	Min *int `json:"min,omitempty"`
+	Max *int `json:"max,omitempty"`
+	// MinLength and MaxLength are the bounds of the number of characters, inclusive.
+	MinLength *int `json:"min_length,omitempty"`
+	MaxLength *int `json:"max_length,omitempty"`
+	// AllowedCharacters is the content of a regular expression character class, ex: `a-z0-9_` or `\p{L} `.
+	AllowedCharacters string `json:"allowed_characters,omitempty"`
+
+	allowed *regexp.Regexp
+}
+
+// Rules are the rules of the fields of users, by JSON field name.
+// Create rules with Parse, Load or Default.
+type Rules struct {
+	Fields map[string]*Rule `json:"fields"`
+}
+
+// kind is the type of a field.
+type kind int
+
+const (
+	kindString kind = iota
+	kindInt
+)
+
+// fields are the fields that rules can apply to, in the order that violations are reported.
+var fields = []struct {
+	Name  string
+	Kind  kind
+	Value func(u api.User) any
+}{
+	{Name: "id", Kind: kindString, Value: func(u api.User) any { return u.ID }},
+	{Name: "name", Kind: kindString, Value: func(u api.User) any { return u.Name }},
+	{Name: "age", Kind: kindInt, Value: func(u api.User) any { return u.Age }},
+	{Name: "email", Kind: kindString, Value: func(u api.User) any { return u.Email }},
+	{Name: "status", Kind: kindString, Value: func(u api.User) any { return string(u.Status) }},
+}
+
+// Default returns the default rules: the age must be between 18 and 100, and the name must be at most 256 characters.
+func Default() *Rules {
+	rules, err := Parse([]byte(`{"fields": {"age": {"min": 18, "max": 100}, "name": {"max_length": 256}}}`))
+	if err != nil {
+		panic(err) // The default rules are valid.
+	}
+	return rules
+}
+
+// Load loads the rules from a JSON file.
+func Load(path string) (*Rules, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("validation: could not read rules: %w", err)
+	}
+	return Parse(b)
+}
+
+// Parse parses JSON rules and checks that they are consistent.
+func Parse(b []byte) (*Rules, error) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.DisallowUnknownFields() // Catch typos in rule names.
+	var rules Rules
+	if err := d.Decode(&rules); err != nil {
+		return nil, fmt.Errorf("validation: could not decode rules: %w", err)
+	}
+	known := make(map[string]kind, len(fields))
+	for _, f := range fields {
+		known[f.Name] = f.Kind
+	}
+	for name, rule := range rules.Fields {
+		k, ok := known[name]
+		switch {
+		case !ok:
+			return nil, fmt.Errorf("validation: unknown field %q", name)
+		case rule == nil:
+			return nil, fmt.Errorf("validation: no rule for field %q", name)
+		case k == kindInt && (rule.MinLength != nil || rule.MaxLength != nil || rule.AllowedCharacters != ""):
+			return nil, fmt.Errorf("validation: field %q is a number, it only supports required, min and max", name)
+		case k == kindString && (rule.Min != nil || rule.Max != nil):
+			return nil, fmt.Errorf("validation: field %q is a string, it does not support min and max", name)
+		}
+		if rule.AllowedCharacters != "" {
+			allowed, err := regexp.Compile(`^[` + rule.AllowedCharacters + `]*$`)
+			if err != nil {
+				return nil, fmt.Errorf("validation: invalid allowed characters of field %q: %w", name, err)
+			}
+			rule.allowed = allowed
+		}
+	}
+	return &rules, nil
+}
+
+// Validate returns the violations of the rules by the user. It returns nil if the user is valid.
+func (r *Rules) Validate(user api.User) []api.Violation {
+	var violations []api.Violation
+	for _, f := range fields {
+		rule, ok := r.Fields[f.Name]
+		if !ok {
+			continue
+		}
+		for _, msg := range rule.check(f.Value(user)) {
+			violations = append(violations, api.Violation{
+				Field:   f.Name,
+				Message: msg,
+			})
+		}
+	}
+	return violations
+}
+
+// check returns the messages of the violations of the rule by the value.
+func (r *Rule) check(value any) []string {
+	var msgs []string
+	switch v := value.(type) {
+	case int:
+		if r.Required && v == 0 {
+			return []string{"is required"}
+		}
+		if r.Min != nil && v < *r.Min {
+			msgs = append(msgs, fmt.Sprintf("must be at least %d", *r.Min))
+		}
+		if r.Max != nil && v > *r.Max {
+			msgs = append(msgs, fmt.Sprintf("must be at most %d", *r.Max))
+		}
+	case string:
+		if v == "" {
+			if r.Required {
+				return []string{"is required"}
+			}
+			return nil
+		}
+		n := utf8.RuneCountInString(v)
+		if r.MinLength != nil && n < *r.MinLength {
+			msgs = append(msgs, fmt.Sprintf("must be at least %d characters", *r.MinLength))
+		}
+		if r.MaxLength != nil && n > *r.MaxLength {
+			msgs = append(msgs, fmt.Sprintf("must be at most %d characters", *r.MaxLength))
+		}
+		if r.allowed != nil && !r.allowed.MatchString(v) {
+			msgs = append(msgs, fmt.Sprintf("must only contain the characters [%s]", r.AllowedCharacters))
+		}
+	}
+	return msgs
+}
@@ -0,0 +1,154 @@
+package validation_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kicodelibrary/go-http-server-2024/api"
+	. "github.com/kicodelibrary/go-http-server-2024/pkg/validation"
+	"github.com/smarty/assertions"
+)
+
+func TestParse(t *testing.T) {
+	a := assertions.New(t)
+
+	for _, tc := range []struct {
+		Name  string
+		Rules string
+		Error string
+	}{
+		{
+			Name:  "Valid",
+			Rules: `{"fields":{"name":{"required":true,"max_length":10,"allowed_characters":"a-z"},"age":{"min":1}}}`,
+		},
+		{
+			Name:  "UnknownField",
+			Rules: `{"fields":{"nickname":{"required":true}}}`,
+			Error: `unknown field "nickname"`,
+		},
+		{
+			Name:  "UnknownRule",
+			Rules: `{"fields":{"name":{"maxlength":10}}}`,
+			Error: `unknown field "maxlength"`,
+		},
+		{
+			Name:  "LengthOfNumber",
+			Rules: `{"fields":{"age":{"max_length":3}}}`,
+			Error: `field "age" is a number`,
+		},
+		{
+			Name:  "MinOfString",
+			Rules: `{"fields":{"name":{"min":3}}}`,
+			Error: `field "name" is a string`,
+		},
+		{
+			Name:  "InvalidCharacters",
+			Rules: `{"fields":{"name":{"allowed_characters":"\\p{Foo}"}}}`,
+			Error: `invalid allowed characters of field "name"`,
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			_, err := Parse([]byte(tc.Rules))
+			if tc.Error == "" {
+				a.So(err, assertions.ShouldBeNil)
+				return
+			}
+			if !a.So(err, assertions.ShouldNotBeNil) {
+				return
+			}
+			a.So(err.Error(), assertions.ShouldContainSubstring, tc.Error)
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	a := assertions.New(t)
+
+	rules, err := Parse([]byte(`{
+		"fields": {
+			"name": {"required": true, "min_length": 2, "max_length": 5, "allowed_characters": "\\p{L} "},
+			"age": {"required": true, "min": 18, "max": 100},
+			"email": {"max_length": 20}
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		Name       string
+		User       api.User
+		Violations []api.Violation
+	}{
+		{
+			Name: "Valid",
+			User: api.User{Name: "Zoë", Age: 18},
+		},
+		{
+			Name: "Required",
+			User: api.User{},
+			Violations: []api.Violation{
+				{Field: "name", Message: "is required"},
+				{Field: "age", Message: "is required"},
+			},
+		},
+		{
+			// All violations are reported, in the order of the fields.
+			Name: "Several",
+			User: api.User{Name: "A1", Age: 101, Email: strings.Repeat("a", 21)},
+			Violations: []api.Violation{
+				{Field: "name", Message: `must only contain the characters [\p{L} ]`},
+				{Field: "age", Message: "must be at most 100"},
+				{Field: "email", Message: "must be at most 20 characters"},
+			},
+		},
+		{
+			// Lengths are in characters, not bytes.
+			Name: "Length",
+			User: api.User{Name: "Ééééé", Age: 17},
+			Violations: []api.Violation{
+				{Field: "age", Message: "must be at least 18"},
+			},
+		},
+		{
+			Name: "TooShort",
+			User: api.User{Name: "A", Age: 30},
+			Violations: []api.Violation{
+				{Field: "name", Message: "must be at least 2 characters"},
+			},
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			a.So(rules.Validate(tc.User), assertions.ShouldResemble, tc.Violations)
+		})
+	}
+}
+
+func TestDefault(t *testing.T) {
+	a := assertions.New(t)
+	rules := Default()
+	a.So(rules.Validate(api.User{Age: 18}), assertions.ShouldBeEmpty)
+	a.So(rules.Validate(api.User{Age: 100}), assertions.ShouldBeEmpty)
+	a.So(rules.Validate(api.User{Age: 17}), assertions.ShouldResemble, []api.Violation{{Field: "age", Message: "must be at least 18"}})
+	a.So(rules.Validate(api.User{Age: 101}), assertions.ShouldResemble, []api.Violation{{Field: "age", Message: "must be at most 100"}})
+	a.So(rules.Validate(api.User{Name: strings.Repeat("é", 256), Age: 18}), assertions.ShouldBeEmpty)
+	a.So(rules.Validate(api.User{Name: strings.Repeat("é", 257), Age: 18}), assertions.ShouldResemble, []api.Violation{{Field: "name", Message: "must be at most 256 characters"}})
+}
+
+func TestLoad(t *testing.T) {
+	a := assertions.New(t)
+	path := filepath.Join(t.TempDir(), "rules.json")
+	if err := os.WriteFile(path, []byte(`{"fields":{"email":{"required":true}}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.So(rules.Validate(api.User{}), assertions.ShouldResemble, []api.Violation{{Field: "email", Message: "is required"}})
+
+	_, err = Load(filepath.Join(t.TempDir(), "missing.json"))
+	a.So(err, assertions.ShouldNotBeNil)
+}